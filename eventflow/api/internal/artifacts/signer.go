@@ -0,0 +1,61 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URLPrefix is where the API serves stored artifacts to signed requests
+const URLPrefix = "/internal/artifacts/"
+
+// Signer issues and checks expiring URLs to stored artifacts, so build Jobs
+// can download an artifact without API credentials
+type Signer struct {
+	key     []byte
+	baseURL string
+}
+
+func NewSigner(key, baseURL string) *Signer {
+	return &Signer{
+		key:     []byte(key),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// URL returns a URL to the artifact under key that is valid for ttl
+func (s *Signer) URL(key string, ttl time.Duration) string {
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {s.signature(key, expires)},
+	}
+	return s.baseURL + URLPrefix + key + "?" + query.Encode()
+}
+
+// Verify checks the expires and signature parameters of a request for the
+// artifact under key
+func (s *Signer) Verify(key, expires, signature string) error {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiry")
+	}
+	if time.Now().Unix() > unix {
+		return fmt.Errorf("link expired")
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.signature(key, expires))) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func (s *Signer) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
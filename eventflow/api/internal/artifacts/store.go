@@ -0,0 +1,51 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/eventflow/api/internal/config"
+)
+
+// ErrNotFound is returned when no artifact is stored under a key
+var ErrNotFound = errors.New("artifact not found")
+
+// Store keeps uploaded build artifacts, such as source archives, under
+// slash-separated keys
+type Store interface {
+	// Put stores size bytes read from r under key, replacing any artifact
+	// stored there before
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Open returns the artifact stored under key, or ErrNotFound
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// NewStore returns the artifact store cfg.ArtifactStore selects: filesystem
+// (the default) or s3
+func NewStore(cfg *config.Config) (Store, error) {
+	switch cfg.ArtifactStore {
+	case "", "filesystem":
+		store, err := NewFileStore(cfg.ArtifactDir)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "s3":
+		return NewS3Store(cfg.S3Endpoint, cfg.S3Bucket, cfg.S3Region, cfg.S3AccessKey, cfg.S3SecretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown artifact store %q: must be filesystem or s3", cfg.ArtifactStore)
+	}
+}
+
+// validKey reports whether key is a relative path that stays inside the store
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	return path.Clean(key) == key && key != "." && key != ".." && !strings.HasPrefix(key, "../")
+}
@@ -13,17 +13,67 @@ type Config struct {
 	MetricsPort int
 	DatabaseURL string
 	NATSUrl     string
+
+	// BuildRegistry is the registry the builder pushes function images and
+	// build caches to; the API reaches its HTTP API at BuildRegistryURL
+	BuildRegistry    string
+	BuildRegistryURL string
+
+	// BuildNamespace is where the builder runs build Jobs, and where the
+	// git credentials of a build are handed to it
+	BuildNamespace string
+
+	// ArtifactStore selects where uploaded sources are kept: filesystem or s3
+	ArtifactStore string
+	ArtifactDir   string
+
+	// S3-compatible object store used when ArtifactStore is s3
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// ArtifactSigningKey signs the artifact URLs handed to build Jobs, which
+	// download them from ArtifactURLBase
+	ArtifactSigningKey string
+	ArtifactURLBase    string
+
+	// PublicURL is where git hosts reach the API to deliver push webhooks;
+	// webhook URLs are relative when it is unset
+	PublicURL string
 }
 
 func Load() *Config {
+	jwtSecret := getEnv("JWT_SECRET", "dev-secret-change-in-production")
+	buildRegistry := getEnv("BUILD_REGISTRY", "docker-registry.eventflow.svc.cluster.local:5000")
+
 	return &Config{
 		Port:        getEnvAsInt("PORT", 8080),
 		Namespace:   getEnv("NAMESPACE", "default"),
-		JWTSecret:   getEnv("JWT_SECRET", "dev-secret-change-in-production"),
+		JWTSecret:   jwtSecret,
 		LogLevel:    getEnv("LOG_LEVEL", "info"),
 		MetricsPort: getEnvAsInt("METRICS_PORT", 9090),
 		DatabaseURL: getEnv("DATABASE_URL", ""),
 		NATSUrl:     getEnv("NATS_URL", ""),
+
+		BuildRegistry:    buildRegistry,
+		BuildRegistryURL: getEnv("BUILD_REGISTRY_URL", "http://"+buildRegistry),
+		BuildNamespace:   getEnv("BUILD_NAMESPACE", "eventflow"),
+
+		ArtifactStore: getEnv("ARTIFACT_STORE", "filesystem"),
+		ArtifactDir:   getEnv("ARTIFACT_DIR", "/var/lib/eventflow/artifacts"),
+
+		S3Endpoint:  getEnv("S3_ENDPOINT", "http://minio.eventflow.svc.cluster.local:9000"),
+		S3Bucket:    getEnv("S3_BUCKET", "eventflow-artifacts"),
+		S3Region:    getEnv("S3_REGION", "us-east-1"),
+		S3AccessKey: getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey: getEnv("S3_SECRET_KEY", ""),
+
+		ArtifactSigningKey: getEnv("ARTIFACT_SIGNING_KEY", jwtSecret),
+		ArtifactURLBase:    getEnv("ARTIFACT_URL_BASE", "http://eventflow-api.eventflow.svc.cluster.local"),
+
+		PublicURL: getEnv("PUBLIC_URL", ""),
 	}
 }
 
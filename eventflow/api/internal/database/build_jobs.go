@@ -2,109 +2,112 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 type BuildJob struct {
-	ID           string     `json:"id"`
-	FunctionName string     `json:"function_name"`
-	UserID       string     `json:"user_id"`
-	Namespace    string     `json:"namespace"`
-	Runtime      string     `json:"runtime"`
-	SourceCode   string     `json:"source_code"`
-	Status       string     `json:"status"` // pending, queued, building, pushing, success, failed
-	Image        string     `json:"image,omitempty"`
-	Error        string     `json:"error,omitempty"`
-	Logs         string     `json:"logs,omitempty"`
-	StartedAt    *time.Time `json:"started_at,omitempty"`
-	CompletedAt  *time.Time `json:"completed_at,omitempty"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
+	ID              string            `json:"id"`
+	FunctionName    string            `json:"function_name"`
+	UserID          string            `json:"user_id"`
+	Namespace       string            `json:"namespace"`
+	SourceType      string            `json:"source_type"` // code, git, tar
+	Runtime         string            `json:"runtime"`
+	SourceCode      string            `json:"source_code,omitempty"`
+	SourceFiles     map[string]string `json:"source_files,omitempty"`
+	SourceArchive   string            `json:"-"`                       // base64 .tar.gz, too large to return
+	ArtifactKey     string            `json:"-"`                       // where an uploaded source archive is stored
+	SourceDigest    string            `json:"source_digest,omitempty"` // sha256 of an uploaded source archive
+	GitURL          string            `json:"git_url,omitempty"`
+	GitRef          string            `json:"git_ref,omitempty"`
+	GitPath         string            `json:"git_path,omitempty"`               // directory to build, also for tar sources
+	GitCommit       string            `json:"git_commit,omitempty"`             // commit a git build fetched
+	ImageRef        string            `json:"image_ref"`                        // where the builder pushes the image
+	TimeoutSecs     int32             `json:"timeout_seconds,omitempty"`        // build deadline; the builder's default when 0
+	Status          string            `json:"status"`                           // pending, queued, building, pushing, success, failed, cancelled
+	QueuePosition   int               `json:"queue_position,omitempty"`         // place in the builder's queue while queued
+	EstimatedWait   int               `json:"estimated_wait_seconds,omitempty"` // estimated wait for a build slot
+	BuildStrategy   string            `json:"build_strategy,omitempty"`         // build strategy requested; auto when empty
+	Strategy        string            `json:"strategy,omitempty"`               // build strategy the builder used
+	DetectedRuntime string            `json:"detected_runtime,omitempty"`       // runtime the builder built with, detected for auto builds
+	DetectedFrom    string            `json:"detected_from,omitempty"`          // manifest or file extension the runtime was detected from
+	BuilderImage    string            `json:"builder_image,omitempty"`          // CNB builder image the builder used
+	Image           string            `json:"image,omitempty"`                  // the built image, pinned by digest
+	Digest          string            `json:"digest,omitempty"`                 // manifest digest of the built image
+	Error           string            `json:"error,omitempty"`
+	Logs            string            `json:"logs,omitempty"`
+	StartedAt       *time.Time        `json:"started_at,omitempty"`
+	CompletedAt     *time.Time        `json:"completed_at,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
 }
 
 type BuildJobRepository struct {
-	db        *DB
-	publisher Publisher
+	db *DB
 }
 
-// Publisher interface for publishing events
-type Publisher interface {
-	Publish(eventType, function string, payload map[string]interface{}) error
-}
-
-func NewBuildJobRepository(db *DB, publisher Publisher) *BuildJobRepository {
+func NewBuildJobRepository(db *DB) *BuildJobRepository {
 	return &BuildJobRepository{
-		db:        db,
-		publisher: publisher,
+		db: db,
 	}
 }
 
-// Create creates a new build job
-func (r *BuildJobRepository) Create(ctx context.Context, functionName, userID, namespace, runtime, sourceCode string) (*BuildJob, error) {
-	job := &BuildJob{
-		ID:           uuid.New().String(),
-		FunctionName: functionName,
-		UserID:       userID,
-		Namespace:    namespace,
-		Runtime:      runtime,
-		SourceCode:   sourceCode,
-		Status:       "pending",
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+// buildJobColumns is the column list read by scanBuildJob
+const buildJobColumns = `
+	id, function_name, user_id, namespace, source_type, runtime, source_code, source_files, source_archive, artifact_key, source_digest,
+	git_url, git_ref, git_path, git_commit, image_ref, timeout_seconds, status, queue_position, estimated_wait_seconds, build_strategy,
+	strategy, detected_runtime, detected_from, builder_image, image, digest, error, logs, started_at, completed_at, created_at, updated_at
+`
+
+// Create creates a new build job. The ID is generated here so the caller can
+// derive the image reference from it before the builder is told about the job.
+func (r *BuildJobRepository) Create(ctx context.Context, job *BuildJob) (*BuildJob, error) {
+	if job.ID == "" {
+		job.ID = uuid.New().String()
 	}
 
-	query := `
-		INSERT INTO build_jobs (id, function_name, user_id, namespace, runtime, source_code, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-	`
-
-	_, err := r.db.Pool().Exec(ctx, query,
-		job.ID, job.FunctionName, job.UserID, job.Namespace,
-		job.Runtime, job.SourceCode, job.Status,
-		job.CreatedAt, job.UpdatedAt,
-	)
+	sourceFiles := job.SourceFiles
+	if sourceFiles == nil {
+		sourceFiles = map[string]string{}
+	}
+	sourceFilesJSON, err := json.Marshal(sourceFiles)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create build job: %w", err)
+		return nil, fmt.Errorf("failed to marshal source files: %w", err)
 	}
 
-	// Publish build event
-	if r.publisher != nil {
-		err = r.publisher.Publish("build.created", job.FunctionName, map[string]interface{}{
-			"build_id":      job.ID,
-			"function_name": job.FunctionName,
-			"namespace":     job.Namespace,
-			"user_id":       job.UserID,
-			"runtime":       job.Runtime,
-		})
-		if err != nil {
-			// Log error but don't fail the request - worker will pick it up via fallback
-			fmt.Printf("Warning: failed to publish build event: %v\n", err)
-		}
+	query := `
+		INSERT INTO build_jobs (id, function_name, user_id, namespace, source_type, runtime, source_code,
+		                        source_files, source_archive, artifact_key, source_digest, git_url, git_ref, git_path,
+		                        image_ref, timeout_seconds, build_strategy, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, 'pending')
+		RETURNING ` + buildJobColumns
+
+	created, err := scanBuildJob(r.db.Pool().QueryRow(ctx, query,
+		job.ID, job.FunctionName, job.UserID, job.Namespace, job.SourceType, job.Runtime, job.SourceCode,
+		sourceFilesJSON, job.SourceArchive, job.ArtifactKey, job.SourceDigest, job.GitURL, job.GitRef, job.GitPath, job.ImageRef,
+		job.TimeoutSecs, job.BuildStrategy,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build job: %w", err)
 	}
 
-	return job, nil
+	return created, nil
 }
 
 // Get retrieves a build job by ID
 func (r *BuildJobRepository) Get(ctx context.Context, id string) (*BuildJob, error) {
-	job := &BuildJob{}
-
 	query := `
-		SELECT id, function_name, user_id, namespace, runtime, source_code,
-		       status, image, error, logs, started_at, completed_at, created_at, updated_at
+		SELECT ` + buildJobColumns + `
 		FROM build_jobs
 		WHERE id = $1
 	`
 
-	err := r.db.Pool().QueryRow(ctx, query, id).Scan(
-		&job.ID, &job.FunctionName, &job.UserID, &job.Namespace,
-		&job.Runtime, &job.SourceCode, &job.Status, &job.Image,
-		&job.Error, &job.Logs, &job.StartedAt, &job.CompletedAt,
-		&job.CreatedAt, &job.UpdatedAt,
-	)
+	job, err := scanBuildJob(r.db.Pool().QueryRow(ctx, query, id))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get build job: %w", err)
 	}
@@ -115,8 +118,7 @@ func (r *BuildJobRepository) Get(ctx context.Context, id string) (*BuildJob, err
 // GetByFunction retrieves build jobs for a function
 func (r *BuildJobRepository) GetByFunction(ctx context.Context, functionName, namespace string) ([]*BuildJob, error) {
 	query := `
-		SELECT id, function_name, user_id, namespace, runtime, source_code,
-		       status, image, error, logs, started_at, completed_at, created_at, updated_at
+		SELECT ` + buildJobColumns + `
 		FROM build_jobs
 		WHERE function_name = $1 AND namespace = $2
 		ORDER BY created_at DESC
@@ -131,13 +133,7 @@ func (r *BuildJobRepository) GetByFunction(ctx context.Context, functionName, na
 
 	var jobs []*BuildJob
 	for rows.Next() {
-		job := &BuildJob{}
-		err := rows.Scan(
-			&job.ID, &job.FunctionName, &job.UserID, &job.Namespace,
-			&job.Runtime, &job.SourceCode, &job.Status, &job.Image,
-			&job.Error, &job.Logs, &job.StartedAt, &job.CompletedAt,
-			&job.CreatedAt, &job.UpdatedAt,
-		)
+		job, err := scanBuildJob(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan build job: %w", err)
 		}
@@ -150,8 +146,7 @@ func (r *BuildJobRepository) GetByFunction(ctx context.Context, functionName, na
 // ListPending retrieves all pending build jobs
 func (r *BuildJobRepository) ListPending(ctx context.Context) ([]*BuildJob, error) {
 	query := `
-		SELECT id, function_name, user_id, namespace, runtime, source_code,
-		       status, image, error, logs, started_at, completed_at, created_at, updated_at
+		SELECT ` + buildJobColumns + `
 		FROM build_jobs
 		WHERE status = 'pending'
 		ORDER BY created_at ASC
@@ -166,13 +161,7 @@ func (r *BuildJobRepository) ListPending(ctx context.Context) ([]*BuildJob, erro
 
 	var jobs []*BuildJob
 	for rows.Next() {
-		job := &BuildJob{}
-		err := rows.Scan(
-			&job.ID, &job.FunctionName, &job.UserID, &job.Namespace,
-			&job.Runtime, &job.SourceCode, &job.Status, &job.Image,
-			&job.Error, &job.Logs, &job.StartedAt, &job.CompletedAt,
-			&job.CreatedAt, &job.UpdatedAt,
-		)
+		job, err := scanBuildJob(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan build job: %w", err)
 		}
@@ -182,44 +171,116 @@ func (r *BuildJobRepository) ListPending(ctx context.Context) ([]*BuildJob, erro
 	return jobs, nil
 }
 
-// UpdateStatus updates the status of a build job
-func (r *BuildJobRepository) UpdateStatus(ctx context.Context, id, status string, image, errorMsg, logs string) error {
-	now := time.Now()
+// finishedStatuses are the build_jobs statuses a build never leaves
+const finishedStatuses = `('success', 'failed', 'cancelled')`
+
+// ErrBuildFinished is returned when a build job that already finished is
+// cancelled
+var ErrBuildFinished = errors.New("build job already finished")
 
+// UpdateStatus updates the status of a build job. Empty strategy, image,
+// digest, commit, errorMsg and logs leave the stored values unchanged. A
+// build that already finished keeps its outcome; its update is dropped.
+func (r *BuildJobRepository) UpdateStatus(ctx context.Context, id, status string, strategy, image, digest, commit, errorMsg, logs string) error {
 	query := `
 		UPDATE build_jobs
-		SET status = $1, image = $2, error = $3, logs = $4, updated_at = $5
+		SET status = $1,
+		    strategy = COALESCE(NULLIF($2, ''), strategy),
+		    image = COALESCE(NULLIF($3, ''), image),
+		    digest = COALESCE(NULLIF($4, ''), digest),
+		    git_commit = COALESCE(NULLIF($5, ''), git_commit),
+		    error = COALESCE(NULLIF($6, ''), error),
+		    logs = COALESCE(NULLIF($7, ''), logs),
+		    queue_position = 0,
+		    estimated_wait_seconds = 0,
+		    started_at = CASE WHEN $1 = 'building' THEN COALESCE(started_at, $8) ELSE started_at END,
+		    completed_at = CASE WHEN $1 IN ` + finishedStatuses + ` THEN $8 ELSE completed_at END,
+		    updated_at = $8
+		WHERE id = $9 AND status NOT IN ` + finishedStatuses + `
 	`
-	args := []interface{}{status, image, errorMsg, logs, now}
-
-	// Set started_at for building status
-	if status == "building" {
-		query += `, started_at = $6`
-		args = append(args, now)
-	}
-
-	// Set completed_at for terminal statuses
-	if status == "success" || status == "failed" {
-		if status == "building" {
-			query += `, completed_at = $7 WHERE id = $8`
-			args = append(args, now, id)
-		} else {
-			query += `, completed_at = $6 WHERE id = $7`
-			args = append(args, now, id)
-		}
-	} else {
-		query += ` WHERE id = $6`
-		args = append(args, id)
-	}
 
-	_, err := r.db.Pool().Exec(ctx, query, args...)
+	result, err := r.db.Pool().Exec(ctx, query, status, strategy, image, digest, commit, errorMsg, logs, time.Now(), id)
 	if err != nil {
 		return fmt.Errorf("failed to update build job status: %w", err)
 	}
 
+	if result.RowsAffected() == 0 {
+		if _, err := r.Finished(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateDetection records the runtime and builder image the builder chose
+// for a build job, and what the runtime was detected from. Empty values
+// leave the stored ones unchanged, and a finished build is left alone.
+func (r *BuildJobRepository) UpdateDetection(ctx context.Context, id, runtime, detectedFrom, builderImage string) error {
+	query := `
+		UPDATE build_jobs
+		SET detected_runtime = COALESCE(NULLIF($1, ''), detected_runtime),
+		    detected_from = COALESCE(NULLIF($2, ''), detected_from),
+		    builder_image = COALESCE(NULLIF($3, ''), builder_image),
+		    updated_at = $4
+		WHERE id = $5 AND status NOT IN ` + finishedStatuses + `
+	`
+
+	if _, err := r.db.Pool().Exec(ctx, query, runtime, detectedFrom, builderImage, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to update build job detection: %w", err)
+	}
 	return nil
 }
 
+// UpdateQueue records the place of a build job in the builder's queue. It
+// only applies while the build waits, so a late update never moves a started
+// build back into the queue.
+func (r *BuildJobRepository) UpdateQueue(ctx context.Context, id string, position, waitSeconds int) error {
+	query := `
+		UPDATE build_jobs
+		SET status = 'queued', queue_position = $1, estimated_wait_seconds = $2, updated_at = $3
+		WHERE id = $4 AND (status = 'pending' OR (status = 'queued' AND queue_position > 0))
+	`
+
+	if _, err := r.db.Pool().Exec(ctx, query, position, waitSeconds, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to update build job queue position: %w", err)
+	}
+	return nil
+}
+
+// Finished reports whether a build job has reached a status it never leaves
+func (r *BuildJobRepository) Finished(ctx context.Context, id string) (bool, error) {
+	var finished bool
+	query := `SELECT status IN ` + finishedStatuses + ` FROM build_jobs WHERE id = $1`
+	err := r.db.Pool().QueryRow(ctx, query, id).Scan(&finished)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, fmt.Errorf("build job not found: %s", id)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get build job status: %w", err)
+	}
+	return finished, nil
+}
+
+// Cancel marks a build job cancelled, or returns ErrBuildFinished when it
+// already finished
+func (r *BuildJobRepository) Cancel(ctx context.Context, id string) (*BuildJob, error) {
+	query := `
+		UPDATE build_jobs
+		SET status = 'cancelled', error = 'cancelled by user', completed_at = $1, updated_at = $1
+		WHERE id = $2 AND status NOT IN ` + finishedStatuses + `
+		RETURNING ` + buildJobColumns
+
+	job, err := scanBuildJob(r.db.Pool().QueryRow(ctx, query, time.Now(), id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrBuildFinished
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel build job: %w", err)
+	}
+	return job, nil
+}
+
 // AppendLogs appends logs to a build job
 func (r *BuildJobRepository) AppendLogs(ctx context.Context, id, newLogs string) error {
 	query := `
@@ -247,3 +308,27 @@ func (r *BuildJobRepository) Delete(ctx context.Context, id string) error {
 
 	return nil
 }
+
+// scanBuildJob reads a row selected with buildJobColumns
+func scanBuildJob(row pgx.Row) (*BuildJob, error) {
+	job := &BuildJob{}
+	var sourceFilesJSON []byte
+	err := row.Scan(
+		&job.ID, &job.FunctionName, &job.UserID, &job.Namespace, &job.SourceType,
+		&job.Runtime, &job.SourceCode, &sourceFilesJSON, &job.SourceArchive, &job.ArtifactKey, &job.SourceDigest,
+		&job.GitURL, &job.GitRef, &job.GitPath, &job.GitCommit, &job.ImageRef, &job.TimeoutSecs,
+		&job.Status, &job.QueuePosition, &job.EstimatedWait, &job.BuildStrategy, &job.Strategy,
+		&job.DetectedRuntime, &job.DetectedFrom, &job.BuilderImage, &job.Image, &job.Digest, &job.Error, &job.Logs, &job.StartedAt, &job.CompletedAt,
+		&job.CreatedAt, &job.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sourceFilesJSON) > 0 {
+		if err := json.Unmarshal(sourceFilesJSON, &job.SourceFiles); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal source files: %w", err)
+		}
+	}
+	return job, nil
+}
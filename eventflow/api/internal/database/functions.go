@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/eventflow/api/internal/models"
@@ -19,76 +20,78 @@ func NewFunctionRepository(db *DB) *FunctionRepository {
 	return &FunctionRepository{db: db}
 }
 
-// Create inserts a new function
-func (r *FunctionRepository) Create(ctx context.Context, userID string, name string, namespace string, image string, replicas int32, env map[string]string, command []string, deploymentType string, gitURL string, gitBranch string, gitPath string) (*models.Function, error) {
-	var envJSON []byte
-	var err error
-	if len(env) > 0 {
-		envJSON, err = json.Marshal(env)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal env: %w", err)
-		}
-	}
-
-	var commandParam interface{}
-	if len(command) > 0 {
-		commandParam = command
-	} else {
-		commandParam = nil
-	}
+// functionColumns is the column list read by scanFunction
+const functionColumns = `
+	id, name, namespace, user_id, image, replicas, env, command, args, resources,
+	COALESCE(deployment_type, 'image'), COALESCE(git_url, ''), COALESCE(git_branch, ''), COALESCE(git_path, ''),
+	git_private, labels, annotations, COALESCE(description, ''), status, created_at, updated_at
+`
 
+// Create inserts a new function
+func (r *FunctionRepository) Create(ctx context.Context, fn *models.Function) (*models.Function, error) {
 	// Default deployment type to 'image' if not specified
-	if deploymentType == "" {
-		deploymentType = "image"
+	if fn.DeploymentType == "" {
+		fn.DeploymentType = "image"
 	}
 
 	// Default git branch to 'main' if not specified
-	if gitBranch == "" && deploymentType == "git" {
-		gitBranch = "main"
+	if fn.GitBranch == "" && fn.DeploymentType == "git" {
+		fn.GitBranch = "main"
 	}
 
 	// Default git path to './' if not specified
-	if gitPath == "" && deploymentType == "git" {
-		gitPath = "./"
+	if fn.GitPath == "" && fn.DeploymentType == "git" {
+		fn.GitPath = "./"
 	}
 
-	query := `
-		INSERT INTO functions (name, namespace, user_id, image, replicas, env, command, status, deployment_type, git_url, git_branch, git_path)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, 'pending', $8, $9, $10, $11)
-		RETURNING id, name, namespace, user_id, image, replicas, created_at, updated_at
-	`
-
-	var fn models.Function
-	var id uuid.UUID
+	envJSON, commandParam, argsParam, resourcesJSON, err := specParams(fn)
+	if err != nil {
+		return nil, err
+	}
+	labelsJSON, annotationsJSON, err := metadataParams(fn)
+	if err != nil {
+		return nil, err
+	}
 
-	err = r.db.pool.QueryRow(ctx, query, name, namespace, userID, image, replicas, envJSON, commandParam, deploymentType, gitURL, gitBranch, gitPath).
-		Scan(&id, &fn.Name, &fn.Namespace, &fn.UserID, &fn.Image, &fn.Replicas, &fn.CreatedAt, &fn.UpdatedAt)
+	tx, err := r.db.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
+	query := `
+		INSERT INTO functions (name, namespace, user_id, image, replicas, env, command, args, resources, status, deployment_type, git_url, git_branch, git_path,
+		                       git_private, labels, annotations, description)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'pending', $10, $11, $12, $13, $14, $15, $16, NULLIF($17, ''))
+		RETURNING ` + functionColumns
+
+	created, err := scanFunction(tx.QueryRow(ctx, query, fn.Name, fn.Namespace, fn.UserID, fn.Image, fn.Replicas,
+		envJSON, commandParam, argsParam, resourcesJSON, fn.DeploymentType, fn.GitURL, fn.GitBranch, fn.GitPath,
+		fn.GitPrivate, labelsJSON, annotationsJSON, fn.Description))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create function: %w", err)
 	}
 
-	fn.Env = env
-	fn.Command = command
-	fmt.Println(fn)
-	return &fn, nil
+	if err := recordRevision(ctx, tx, created, fn.UserID, "created"); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit function: %w", err)
+	}
+
+	return created, nil
 }
 
 // Get retrieves a function by name and user ID
 func (r *FunctionRepository) Get(ctx context.Context, userID string, name string, namespace string) (*models.Function, error) {
 	query := `
-		SELECT name, namespace, user_id, image, replicas, env, command, created_at, updated_at
+		SELECT ` + functionColumns + `
 		FROM functions
 		WHERE name = $1 AND namespace = $2 AND user_id = $3 AND deleted_at IS NULL
 	`
 
-	var fn models.Function
-	var envJSON []byte
-	var commandArray []string
-
-	err := r.db.pool.QueryRow(ctx, query, name, namespace, userID).
-		Scan(&fn.Name, &fn.Namespace, &fn.UserID, &fn.Image, &fn.Replicas, &envJSON, &commandArray, &fn.CreatedAt, &fn.UpdatedAt)
-
+	fn, err := scanFunction(r.db.pool.QueryRow(ctx, query, name, namespace, userID))
 	if err == pgx.ErrNoRows {
 		return nil, fmt.Errorf("function not found: %s", name)
 	}
@@ -96,63 +99,152 @@ func (r *FunctionRepository) Get(ctx context.Context, userID string, name string
 		return nil, fmt.Errorf("failed to get function: %w", err)
 	}
 
-	// Unmarshal env JSON
-	if len(envJSON) > 0 {
-		if err := json.Unmarshal(envJSON, &fn.Env); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal env: %w", err)
+	return fn, nil
+}
+
+// ListFunctionsOptions filters, sorts and paginates FunctionRepository.List
+type ListFunctionsOptions struct {
+	Limit          int
+	PageToken      string
+	Status         string // matched case-insensitively
+	DeploymentType string
+	Image          string // substring match
+	LabelSelector  string // Kubernetes label selector syntax
+	SortBy         string // name, created_at (default) or updated_at
+	Ascending      bool
+}
+
+// sortColumns maps the accepted sort keys to their columns
+var sortColumns = map[string]string{
+	"name":       "name",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// List retrieves a page of a user's functions. It returns the functions, the
+// token of the next page (empty on the last page) and the total number of
+// functions matching the filters.
+func (r *FunctionRepository) List(ctx context.Context, userID string, opts ListFunctionsOptions) ([]*models.Function, string, int, error) {
+	limit := clampLimit(opts.Limit)
+
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+	sortColumn, ok := sortColumns[sortBy]
+	if !ok {
+		return nil, "", 0, fmt.Errorf("invalid sort field %q: must be name, created_at or updated_at", sortBy)
+	}
+
+	where := []string{"user_id = $1", "deleted_at IS NULL"}
+	args := []interface{}{userID}
+	addArg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if opts.Status != "" {
+		where = append(where, "LOWER(status) = LOWER("+addArg(opts.Status)+")")
+	}
+	if opts.DeploymentType != "" {
+		where = append(where, "deployment_type = "+addArg(opts.DeploymentType))
+	}
+	if opts.Image != "" {
+		where = append(where, "image ILIKE '%' || "+addArg(escapeLike(opts.Image))+" || '%'")
+	}
+	if opts.LabelSelector != "" {
+		clauses, err := labelSelectorClauses(opts.LabelSelector, addArg)
+		if err != nil {
+			return nil, "", 0, err
 		}
+		where = append(where, clauses...)
 	}
 
-	// Assign command array
-	fn.Command = commandArray
+	// Total count ignores the cursor so it stays stable across pages
+	var total int
+	countQuery := `SELECT COUNT(*) FROM functions WHERE ` + strings.Join(where, " AND ")
+	if err := r.db.pool.QueryRow(ctx, countQuery, args...).Scan(&total); err != nil {
+		return nil, "", 0, fmt.Errorf("failed to count functions: %w", err)
+	}
 
-	return &fn, nil
-}
+	direction, comparison := "DESC", "<"
+	if opts.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+
+	if opts.PageToken != "" {
+		c, err := decodeCursor(opts.PageToken)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		var value interface{} = c.Value
+		if sortColumn != "name" {
+			t, err := time.Parse(time.RFC3339Nano, c.Value)
+			if err != nil {
+				return nil, "", 0, fmt.Errorf("invalid page token")
+			}
+			value = t
+		}
+		where = append(where, fmt.Sprintf("(%s, id::text) %s (%s, %s)", sortColumn, comparison, addArg(value), addArg(c.ID)))
+	}
 
-// List retrieves all functions for a user
-func (r *FunctionRepository) List(ctx context.Context, userID string) ([]*models.Function, error) {
 	query := `
-		SELECT name, namespace, user_id, image, replicas, env, command, created_at, updated_at
+		SELECT ` + functionColumns + `
 		FROM functions
-		WHERE user_id = $1 AND deleted_at IS NULL
-		ORDER BY created_at DESC
-	`
+		WHERE ` + strings.Join(where, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, id::text %s LIMIT %d", sortColumn, direction, direction, limit+1)
 
-	rows, err := r.db.pool.Query(ctx, query, userID)
+	rows, err := r.db.pool.Query(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list functions: %w", err)
+		return nil, "", 0, fmt.Errorf("failed to list functions: %w", err)
 	}
 	defer rows.Close()
 
-	var functions []*models.Function
+	functions := make([]*models.Function, 0, limit)
 	for rows.Next() {
-		var fn models.Function
-		var envJSON []byte
-		var commandArray []string
-
-		err := rows.Scan(&fn.Name, &fn.Namespace, &fn.UserID, &fn.Image, &fn.Replicas, &envJSON, &commandArray, &fn.CreatedAt, &fn.UpdatedAt)
+		fn, err := scanFunction(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan function: %w", err)
+			return nil, "", 0, fmt.Errorf("failed to scan function: %w", err)
 		}
 
-		// Unmarshal env JSON
-		if len(envJSON) > 0 {
-			if err := json.Unmarshal(envJSON, &fn.Env); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal env: %w", err)
-			}
-		}
+		functions = append(functions, fn)
+	}
 
-		// Assign command array
-		fn.Command = commandArray
+	if err := rows.Err(); err != nil {
+		return nil, "", 0, fmt.Errorf("error iterating functions: %w", err)
+	}
 
-		functions = append(functions, &fn)
+	var nextToken string
+	if len(functions) > limit {
+		functions = functions[:limit]
+		last := functions[limit-1]
+		switch sortColumn {
+		case "name":
+			nextToken = encodeCursor(last.Name, last.ID)
+		case "updated_at":
+			nextToken = encodeCursor(last.UpdatedAt.Format(time.RFC3339Nano), last.ID)
+		default:
+			nextToken = encodeCursor(last.CreatedAt.Format(time.RFC3339Nano), last.ID)
+		}
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating functions: %w", err)
+	return functions, nextToken, total, nil
+}
+
+// UpdateStatus records the observed status of a function
+func (r *FunctionRepository) UpdateStatus(ctx context.Context, namespace string, name string, status string) error {
+	query := `
+		UPDATE functions
+		SET status = $1
+		WHERE name = $2 AND namespace = $3 AND deleted_at IS NULL AND status IS DISTINCT FROM $1
+	`
+
+	_, err := r.db.pool.Exec(ctx, query, status, name, namespace)
+	if err != nil {
+		return fmt.Errorf("failed to update function status: %w", err)
 	}
 
-	return functions, nil
+	return nil
 }
 
 // Delete soft-deletes a function
@@ -175,46 +267,252 @@ func (r *FunctionRepository) Delete(ctx context.Context, name string, namespace
 	return nil
 }
 
-// Update modifies function configuration
-func (r *FunctionRepository) Update(ctx context.Context, name string, replicas int32) error {
+// Update replaces the spec (image, env, command, args, replicas, resources)
+// and metadata (labels, annotations, description) of a user's function and
+// records the spec as a new revision
+func (r *FunctionRepository) Update(ctx context.Context, userID string, namespace string, fn *models.Function, changeCause string) (*models.Function, error) {
+	envJSON, commandParam, argsParam, resourcesJSON, err := specParams(fn)
+	if err != nil {
+		return nil, err
+	}
+	labelsJSON, annotationsJSON, err := metadataParams(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE functions
+		SET image = $1, replicas = $2, env = $3, command = $4, args = $5, resources = $6,
+		    labels = $7, annotations = $8, description = NULLIF($9, ''), updated_at = NOW()
+		WHERE name = $10 AND namespace = $11 AND user_id = $12 AND deleted_at IS NULL
+		RETURNING ` + functionColumns
+
+	updated, err := scanFunction(tx.QueryRow(ctx, query, fn.Image, fn.Replicas, envJSON, commandParam, argsParam,
+		resourcesJSON, labelsJSON, annotationsJSON, fn.Description, fn.Name, namespace, userID))
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("function not found: %s", fn.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update function: %w", err)
+	}
+
+	if err := recordRevision(ctx, tx, updated, userID, changeCause); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit function update: %w", err)
+	}
+
+	return updated, nil
+}
+
+// UpdateMetadata replaces the labels, annotations and description of a
+// user's function. Metadata is not part of the spec, so no revision is recorded.
+func (r *FunctionRepository) UpdateMetadata(ctx context.Context, userID string, namespace string, fn *models.Function) (*models.Function, error) {
+	labelsJSON, annotationsJSON, err := metadataParams(fn)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		UPDATE functions
-		SET replicas = $1, updated_at = NOW()
-		WHERE name = $2 AND deleted_at IS NULL
+		SET labels = $1, annotations = $2, description = NULLIF($3, ''), updated_at = NOW()
+		WHERE name = $4 AND namespace = $5 AND user_id = $6 AND deleted_at IS NULL
+		RETURNING ` + functionColumns
+
+	updated, err := scanFunction(r.db.pool.QueryRow(ctx, query, labelsJSON, annotationsJSON, fn.Description,
+		fn.Name, namespace, userID))
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("function not found: %s", fn.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update function metadata: %w", err)
+	}
+
+	return updated, nil
+}
+
+// GetWithWebhookSecret retrieves a git function by namespace and name,
+// whoever owns it, along with the secret its push webhook is verified with.
+// The secret is "" until one is set.
+func (r *FunctionRepository) GetWithWebhookSecret(ctx context.Context, namespace string, name string) (*models.Function, string, error) {
+	query := `
+		SELECT ` + functionColumns + `, COALESCE(webhook_secret, '')
+		FROM functions
+		WHERE name = $1 AND namespace = $2 AND deployment_type = 'git' AND deleted_at IS NULL
 	`
 
-	result, err := r.db.pool.Exec(ctx, query, replicas, name)
+	var secret string
+	fn, err := scanFunction(r.db.pool.QueryRow(ctx, query, name, namespace), &secret)
+	if err == pgx.ErrNoRows {
+		return nil, "", fmt.Errorf("function not found: %s", name)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to update function: %w", err)
+		return nil, "", fmt.Errorf("failed to get function: %w", err)
 	}
 
-	if result.RowsAffected() == 0 {
-		return fmt.Errorf("function not found: %s", name)
+	return fn, secret, nil
+}
+
+// SetWebhookSecret stores the webhook secret of a user's git function and
+// returns the secret in effect. Unless replace is set, a secret stored
+// earlier is kept, so concurrent callers agree on one.
+func (r *FunctionRepository) SetWebhookSecret(ctx context.Context, userID string, namespace string, name string, secret string, replace bool) (string, error) {
+	query := `
+		UPDATE functions
+		SET webhook_secret = CASE WHEN $1 OR webhook_secret IS NULL THEN $2 ELSE webhook_secret END
+		WHERE name = $3 AND namespace = $4 AND user_id = $5 AND deployment_type = 'git' AND deleted_at IS NULL
+		RETURNING webhook_secret
+	`
+
+	var stored string
+	err := r.db.pool.QueryRow(ctx, query, replace, secret, name, namespace, userID).Scan(&stored)
+	if err == pgx.ErrNoRows {
+		return "", fmt.Errorf("function not found: %s", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to set webhook secret: %w", err)
 	}
 
-	return nil
+	return stored, nil
 }
 
-// RecordInvocation logs a function invocation
-func (r *FunctionRepository) RecordInvocation(ctx context.Context, functionName, eventID, eventType string, payload map[string]interface{}) error {
+// metadataParams converts the labels and annotations of a function into
+// query parameters. Both columns are NOT NULL, so empty maps are stored as {}.
+func metadataParams(fn *models.Function) (labelsJSON []byte, annotationsJSON []byte, err error) {
+	labels, annotations := fn.Labels, fn.Annotations
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	labelsJSON, err = json.Marshal(labels)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal labels: %w", err)
+	}
+	annotationsJSON, err = json.Marshal(annotations)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal annotations: %w", err)
+	}
+
+	return labelsJSON, annotationsJSON, nil
+}
+
+// specParams converts the spec fields of a function into query parameters
+func specParams(fn *models.Function) (envJSON []byte, command interface{}, args interface{}, resourcesJSON []byte, err error) {
+	if len(fn.Env) > 0 {
+		envJSON, err = json.Marshal(fn.Env)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to marshal env: %w", err)
+		}
+	}
+
+	if fn.Resources != nil {
+		resourcesJSON, err = json.Marshal(fn.Resources)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to marshal resources: %w", err)
+		}
+	}
+
+	if len(fn.Command) > 0 {
+		command = fn.Command
+	}
+	if len(fn.Args) > 0 {
+		args = fn.Args
+	}
+
+	return envJSON, command, args, resourcesJSON, nil
+}
+
+// scanFunction reads a row selected with functionColumns, followed by the
+// columns scanned into extra
+func scanFunction(row pgx.Row, extra ...interface{}) (*models.Function, error) {
+	var fn models.Function
+	var envJSON, resourcesJSON, labelsJSON, annotationsJSON []byte
+
+	dest := []interface{}{&fn.ID, &fn.Name, &fn.Namespace, &fn.UserID, &fn.Image, &fn.Replicas, &envJSON, &fn.Command, &fn.Args,
+		&resourcesJSON, &fn.DeploymentType, &fn.GitURL, &fn.GitBranch, &fn.GitPath, &fn.GitPrivate, &labelsJSON, &annotationsJSON,
+		&fn.Description, &fn.Status, &fn.CreatedAt, &fn.UpdatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal env JSON
+	if len(envJSON) > 0 {
+		if err := json.Unmarshal(envJSON, &fn.Env); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal env: %w", err)
+		}
+	}
+
+	// Unmarshal resources JSON
+	if len(resourcesJSON) > 0 {
+		if err := json.Unmarshal(resourcesJSON, &fn.Resources); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal resources: %w", err)
+		}
+	}
+
+	// Unmarshal labels and annotations JSON
+	if len(labelsJSON) > 0 {
+		if err := json.Unmarshal(labelsJSON, &fn.Labels); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal labels: %w", err)
+		}
+	}
+	if len(annotationsJSON) > 0 {
+		if err := json.Unmarshal(annotationsJSON, &fn.Annotations); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal annotations: %w", err)
+		}
+	}
+
+	return &fn, nil
+}
+
+// RecordInvocation logs a function invocation scoped to the function owner
+func (r *FunctionRepository) RecordInvocation(ctx context.Context, userID string, namespace string, inv *models.Invocation) error {
 	// Get function ID
 	var functionID uuid.UUID
-	err := r.db.pool.QueryRow(ctx, "SELECT id FROM functions WHERE name = $1 AND deleted_at IS NULL", functionName).Scan(&functionID)
+	err := r.db.pool.QueryRow(ctx,
+		"SELECT id FROM functions WHERE name = $1 AND namespace = $2 AND user_id = $3 AND deleted_at IS NULL",
+		inv.FunctionName, namespace, userID).Scan(&functionID)
 	if err != nil {
 		return fmt.Errorf("function not found: %w", err)
 	}
 
-	payloadJSON, _ := json.Marshal(payload)
+	if inv.Status == "" {
+		inv.Status = "pending"
+	}
+	if inv.StartedAt.IsZero() {
+		inv.StartedAt = time.Now()
+	}
+
+	var payload interface{}
+	if len(inv.Payload) > 0 {
+		payload = []byte(inv.Payload)
+	}
 
 	query := `
-		INSERT INTO invocations (function_id, event_id, event_type, payload, status)
-		VALUES ($1, $2, $3, $4, 'pending')
+		INSERT INTO invocations (function_id, event_id, event_type, payload, status, error, duration_ms, started_at, completed_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9)
+		RETURNING id
 	`
 
-	_, err = r.db.pool.Exec(ctx, query, functionID, eventID, eventType, payloadJSON)
+	var id uuid.UUID
+	err = r.db.pool.QueryRow(ctx, query, functionID, inv.EventID, inv.EventType, payload, inv.Status,
+		inv.Error, inv.DurationMs, inv.StartedAt, inv.CompletedAt).Scan(&id)
 	if err != nil {
 		return fmt.Errorf("failed to record invocation: %w", err)
 	}
 
+	inv.ID = id.String()
+	inv.Namespace = namespace
 	return nil
 }
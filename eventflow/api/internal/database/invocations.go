@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eventflow/api/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+const invocationColumns = `
+	i.id, f.name, f.namespace, COALESCE(i.event_id, ''), i.event_type, i.payload,
+	i.status, COALESCE(i.error, ''), i.duration_ms, i.started_at, i.completed_at
+`
+
+// GetInvocation retrieves a single invocation of a user's function
+func (r *FunctionRepository) GetInvocation(ctx context.Context, userID, namespace, functionName, id string) (*models.Invocation, error) {
+	query := `
+		SELECT ` + invocationColumns + `
+		FROM invocations i
+		JOIN functions f ON f.id = i.function_id
+		WHERE i.id::text = $1 AND f.name = $2 AND f.namespace = $3 AND f.user_id = $4 AND f.deleted_at IS NULL
+	`
+
+	inv, err := scanInvocation(r.db.pool.QueryRow(ctx, query, id, functionName, namespace, userID))
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("invocation not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invocation: %w", err)
+	}
+
+	return inv, nil
+}
+
+// ListInvocations returns a page of invocations for a user's function, newest first.
+// The returned token is empty when there are no more pages.
+func (r *FunctionRepository) ListInvocations(ctx context.Context, userID, namespace, functionName string, limit int, pageToken string) ([]*models.Invocation, string, error) {
+	limit = clampLimit(limit)
+
+	query := `
+		SELECT ` + invocationColumns + `
+		FROM invocations i
+		JOIN functions f ON f.id = i.function_id
+		WHERE f.name = $1 AND f.namespace = $2 AND f.user_id = $3 AND f.deleted_at IS NULL
+	`
+	args := []interface{}{functionName, namespace, userID}
+
+	if pageToken != "" {
+		c, err := decodeCursor(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		startedAt, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid page token")
+		}
+		query += ` AND (i.started_at, i.id::text) < ($4, $5)`
+		args = append(args, startedAt, c.ID)
+	}
+
+	query += fmt.Sprintf(` ORDER BY i.started_at DESC, i.id::text DESC LIMIT %d`, limit+1)
+
+	rows, err := r.db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list invocations: %w", err)
+	}
+	defer rows.Close()
+
+	invocations := make([]*models.Invocation, 0, limit)
+	for rows.Next() {
+		inv, err := scanInvocation(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan invocation: %w", err)
+		}
+		invocations = append(invocations, inv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error iterating invocations: %w", err)
+	}
+
+	var nextToken string
+	if len(invocations) > limit {
+		invocations = invocations[:limit]
+		last := invocations[limit-1]
+		nextToken = encodeCursor(last.StartedAt.Format(time.RFC3339Nano), last.ID)
+	}
+
+	return invocations, nextToken, nil
+}
+
+// UpdateInvocationStatus moves an invocation to a new status, stamping
+// completed_at when the status is terminal
+func (r *FunctionRepository) UpdateInvocationStatus(ctx context.Context, id, status, errorMsg string) error {
+	query := `
+		UPDATE invocations
+		SET status = $1,
+		    error = NULLIF($2, ''),
+		    completed_at = CASE WHEN $1 IN ('completed', 'failed') THEN NOW() ELSE completed_at END
+		WHERE id::text = $3
+	`
+
+	result, err := r.db.pool.Exec(ctx, query, status, errorMsg, id)
+	if err != nil {
+		return fmt.Errorf("failed to update invocation: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("invocation not found: %s", id)
+	}
+
+	return nil
+}
+
+func scanInvocation(row pgx.Row) (*models.Invocation, error) {
+	var inv models.Invocation
+	var payload []byte
+
+	err := row.Scan(&inv.ID, &inv.FunctionName, &inv.Namespace, &inv.EventID, &inv.EventType, &payload,
+		&inv.Status, &inv.Error, &inv.DurationMs, &inv.StartedAt, &inv.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) > 0 {
+		inv.Payload = payload
+	}
+	return &inv, nil
+}
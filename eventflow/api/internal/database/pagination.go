@@ -0,0 +1,51 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// DefaultPageSize is used when a list call does not specify a limit
+	DefaultPageSize = 20
+	// MaxPageSize caps the number of rows returned by a single list call
+	MaxPageSize = 100
+)
+
+// cursor marks the last row of a page: the value of the sort column and the row ID
+type cursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// encodeCursor returns an opaque page token for the given sort value and row ID
+func encodeCursor(value, id string) string {
+	data, _ := json.Marshal(cursor{Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a page token produced by encodeCursor
+func decodeCursor(token string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token")
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	return &c, nil
+}
+
+// clampLimit applies the default and maximum page sizes
+func clampLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/eventflow/api/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+const revisionColumns = `
+	rev.revision, rev.image, rev.replicas, rev.env, rev.command, rev.args, rev.resources,
+	rev.changed_by, COALESCE(rev.change_cause, ''), rev.created_at
+`
+
+// recordRevision stores the current spec of a function as its next revision.
+// It runs inside the transaction that changed the function, after the
+// functions row is locked, so revision numbers cannot collide.
+func recordRevision(ctx context.Context, tx pgx.Tx, fn *models.Function, changedBy, changeCause string) error {
+	envJSON, commandParam, argsParam, resourcesJSON, err := specParams(fn)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO function_revisions (function_id, revision, image, replicas, env, command, args, resources, changed_by, change_cause)
+		SELECT f.id,
+		       COALESCE((SELECT MAX(revision) FROM function_revisions WHERE function_id = f.id), 0) + 1,
+		       $1, $2, $3, $4, $5, $6, $7, NULLIF($8, '')
+		FROM functions f
+		WHERE f.name = $9 AND f.namespace = $10 AND f.user_id = $11 AND f.deleted_at IS NULL
+	`
+
+	_, err = tx.Exec(ctx, query, fn.Image, fn.Replicas, envJSON, commandParam, argsParam, resourcesJSON,
+		changedBy, changeCause, fn.Name, fn.Namespace, fn.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to record function revision: %w", err)
+	}
+
+	return nil
+}
+
+// ListRevisions returns the revision history of a user's function, newest first
+func (r *FunctionRepository) ListRevisions(ctx context.Context, userID, namespace, name string) ([]*models.FunctionRevision, error) {
+	query := `
+		SELECT ` + revisionColumns + `
+		FROM function_revisions rev
+		JOIN functions f ON f.id = rev.function_id
+		WHERE f.name = $1 AND f.namespace = $2 AND f.user_id = $3 AND f.deleted_at IS NULL
+		ORDER BY rev.revision DESC
+	`
+
+	rows, err := r.db.pool.Query(ctx, query, name, namespace, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []*models.FunctionRevision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating revisions: %w", err)
+	}
+
+	return revisions, nil
+}
+
+// GetRevision retrieves one revision of a user's function
+func (r *FunctionRepository) GetRevision(ctx context.Context, userID, namespace, name string, revision int) (*models.FunctionRevision, error) {
+	query := `
+		SELECT ` + revisionColumns + `
+		FROM function_revisions rev
+		JOIN functions f ON f.id = rev.function_id
+		WHERE f.name = $1 AND f.namespace = $2 AND f.user_id = $3 AND f.deleted_at IS NULL AND rev.revision = $4
+	`
+
+	rev, err := scanRevision(r.db.pool.QueryRow(ctx, query, name, namespace, userID, revision))
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("revision %d not found for function %s", revision, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revision: %w", err)
+	}
+
+	return rev, nil
+}
+
+func scanRevision(row pgx.Row) (*models.FunctionRevision, error) {
+	var rev models.FunctionRevision
+	var envJSON, resourcesJSON []byte
+
+	err := row.Scan(&rev.Revision, &rev.Image, &rev.Replicas, &envJSON, &rev.Command, &rev.Args, &resourcesJSON,
+		&rev.ChangedBy, &rev.ChangeCause, &rev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envJSON) > 0 {
+		if err := json.Unmarshal(envJSON, &rev.Env); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal env: %w", err)
+		}
+	}
+	if len(resourcesJSON) > 0 {
+		if err := json.Unmarshal(resourcesJSON, &rev.Resources); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal resources: %w", err)
+		}
+	}
+
+	return &rev, nil
+}
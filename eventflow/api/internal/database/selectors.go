@@ -0,0 +1,47 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// labelSelectorClauses translates a Kubernetes label selector into SQL
+// conditions on the functions.labels JSONB column. addArg registers a query
+// argument and returns its placeholder.
+func labelSelectorClauses(selector string, addArg func(interface{}) string) ([]string, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector: %w", err)
+	}
+
+	requirements, _ := parsed.Requirements()
+	clauses := make([]string, 0, len(requirements))
+	for _, req := range requirements {
+		key := addArg(req.Key())
+		values := req.Values().List()
+
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			clauses = append(clauses, fmt.Sprintf("labels->>%s = ANY(%s)", key, addArg(values)))
+		case selection.NotEquals, selection.NotIn:
+			// Like Kubernetes, a missing label satisfies != and notin
+			clauses = append(clauses, fmt.Sprintf("(labels->>%s IS NULL OR NOT labels->>%s = ANY(%s))", key, key, addArg(values)))
+		case selection.Exists:
+			clauses = append(clauses, fmt.Sprintf("labels ? %s", key))
+		case selection.DoesNotExist:
+			clauses = append(clauses, fmt.Sprintf("NOT labels ? %s", key))
+		default:
+			return nil, fmt.Errorf("unsupported label selector operator %q", req.Operator())
+		}
+	}
+
+	return clauses, nil
+}
+
+// escapeLike escapes the LIKE wildcards in a user-supplied substring
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
@@ -0,0 +1,192 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// buildLogSubject matches the eventflow.builds.logs.{buildID} subjects
+	// the builder publishes build output on
+	buildLogSubject = "eventflow.builds.logs.*"
+
+	// buildLogConsumer is the durable consumer that stores build output
+	buildLogConsumer = "eventflow-api-build-logs"
+
+	// buildLogBatch is how many lines are stored at once. The consumer allows
+	// no more than one batch in flight, so lines are stored in order.
+	buildLogBatch = 256
+
+	// buildLogWait is how long a fetch waits for new lines
+	buildLogWait = 2 * time.Second
+)
+
+// BuildLogLine is one line of build output. It mirrors the builder's LogLine.
+type BuildLogLine struct {
+	Version   int    `json:"version"`
+	BuildID   string `json:"build_id"`
+	Container string `json:"container"` // fetch, pack
+	Line      string `json:"line"`
+}
+
+// BuildLogAppender stores the output of a build job
+type BuildLogAppender interface {
+	AppendLogs(ctx context.Context, id, logs string) error
+}
+
+// BuildLogRecorder appends the output the builder publishes to build_jobs
+type BuildLogRecorder struct {
+	logs BuildLogAppender
+}
+
+func NewBuildLogRecorder(logs BuildLogAppender) *BuildLogRecorder {
+	return &BuildLogRecorder{
+		logs: logs,
+	}
+}
+
+// Start consumes build output in the background
+func (r *BuildLogRecorder) Start(p *Publisher) error {
+	sub, err := p.js.PullSubscribe(buildLogSubject, buildLogConsumer,
+		nats.BindStream(streamName),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.MaxAckPending(buildLogBatch),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to build logs: %w", err)
+	}
+
+	go r.run(sub)
+	return nil
+}
+
+// run stores fetched lines until the subscription is closed
+func (r *BuildLogRecorder) run(sub *nats.Subscription) {
+	for sub.IsValid() {
+		msgs, err := sub.Fetch(buildLogBatch, nats.MaxWait(buildLogWait))
+		if err != nil {
+			if err != nats.ErrTimeout {
+				log.Printf("Warning: failed to fetch build logs: %v", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		if err := r.Store(msgs); err != nil {
+			log.Printf("Error: %v", err)
+			for _, msg := range msgs {
+				msg.Nak()
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			msg.Ack()
+		}
+	}
+}
+
+// Store appends a batch of lines to their builds' logs, keeping their order
+func (r *BuildLogRecorder) Store(msgs []*nats.Msg) error {
+	var order []string
+	text := make(map[string]*strings.Builder)
+	for _, msg := range msgs {
+		var line BuildLogLine
+		if err := json.Unmarshal(msg.Data, &line); err != nil || line.Version != BuildProtocolVersion {
+			log.Printf("Warning: dropping invalid build log line on %s", msg.Subject)
+			continue
+		}
+		b, ok := text[line.BuildID]
+		if !ok {
+			b = &strings.Builder{}
+			text[line.BuildID] = b
+			order = append(order, line.BuildID)
+		}
+		b.WriteString(line.Line)
+		b.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), buildStatusTimeout)
+	defer cancel()
+
+	for _, buildID := range order {
+		if err := r.logs.AppendLogs(ctx, buildID, text[buildID].String()); err != nil {
+			return fmt.Errorf("failed to store logs of build %s: %w", buildID, err)
+		}
+	}
+	return nil
+}
+
+// BuildFollower delivers the output and status updates of one build, from
+// its first line on
+type BuildFollower struct {
+	Lines    <-chan BuildLogLine
+	Statuses <-chan BuildStatus
+
+	subs []*nats.Subscription
+	done chan struct{}
+	once sync.Once
+}
+
+// FollowBuild replays the output and status updates a build has published so
+// far, then keeps delivering new ones until Stop is called
+func (p *Publisher) FollowBuild(buildID string) (*BuildFollower, error) {
+	lines := make(chan BuildLogLine, buildLogBatch)
+	statuses := make(chan BuildStatus, 8)
+	f := &BuildFollower{Lines: lines, Statuses: statuses, done: make(chan struct{})}
+
+	logSub, err := p.js.Subscribe(strings.Replace(buildLogSubject, "*", buildID, 1), func(msg *nats.Msg) {
+		var line BuildLogLine
+		if err := json.Unmarshal(msg.Data, &line); err == nil && line.Version == BuildProtocolVersion {
+			select {
+			case lines <- line:
+			case <-f.done:
+			}
+		}
+	}, nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		return nil, fmt.Errorf("failed to follow build logs: %w", err)
+	}
+	f.subs = append(f.subs, logSub)
+
+	statusSub, err := p.js.Subscribe(strings.Replace(buildStatusSubject, "*", buildID, 1), func(msg *nats.Msg) {
+		var status BuildStatus
+		if err := json.Unmarshal(msg.Data, &status); err == nil && status.Version == BuildProtocolVersion {
+			select {
+			case statuses <- status:
+			case <-f.done:
+			}
+		}
+	}, nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		f.Stop()
+		return nil, fmt.Errorf("failed to follow build status: %w", err)
+	}
+	f.subs = append(f.subs, statusSub)
+
+	return f, nil
+}
+
+// Stop ends the delivery of lines and status updates
+func (f *BuildFollower) Stop() {
+	f.once.Do(func() {
+		close(f.done)
+		for _, sub := range f.subs {
+			sub.Unsubscribe()
+		}
+	})
+}
+
+// BuildJobStatus returns the build_jobs status a builder event moves a build
+// to
+func BuildJobStatus(event string) (string, bool) {
+	status, ok := buildJobStatuses[event]
+	return status, ok
+}
@@ -0,0 +1,135 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// buildStatusTimeout bounds the handling of one builder status update
+const buildStatusTimeout = 30 * time.Second
+
+// buildJobStatuses maps builder events onto build_jobs statuses
+var buildJobStatuses = map[string]string{
+	"queued":    "queued",
+	"started":   "queued",
+	"building":  "building",
+	"complete":  "success",
+	"failed":    "failed",
+	"cancelled": "cancelled",
+}
+
+// digestPattern matches the sha256 manifest digest a completed build reports
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// BuildJobUpdater stores the progress of a build job. Updates to a build
+// that already finished are dropped.
+type BuildJobUpdater interface {
+	UpdateStatus(ctx context.Context, id, status string, strategy, image, digest, commit, errorMsg, logs string) error
+	UpdateQueue(ctx context.Context, id string, position, waitSeconds int) error
+	UpdateDetection(ctx context.Context, id, runtime, detectedFrom, builderImage string) error
+	Finished(ctx context.Context, id string) (bool, error)
+}
+
+// DeployFunc deploys the image a build produced
+type DeployFunc func(ctx context.Context, buildID, image string) error
+
+// BuildStatusSubscriber drives build_jobs from the status updates the
+// builder publishes, and deploys the function when its build completes
+type BuildStatusSubscriber struct {
+	builds BuildJobUpdater
+	deploy DeployFunc
+}
+
+func NewBuildStatusSubscriber(builds BuildJobUpdater, deploy DeployFunc) *BuildStatusSubscriber {
+	return &BuildStatusSubscriber{
+		builds: builds,
+		deploy: deploy,
+	}
+}
+
+// Start subscribes to the builder's status updates
+func (s *BuildStatusSubscriber) Start(p *Publisher) error {
+	return p.SubscribeBuildStatus(s.Handle)
+}
+
+// Handle applies one status update. An error means the update was not
+// recorded and should be retried.
+func (s *BuildStatusSubscriber) Handle(status BuildStatus) error {
+	jobStatus, ok := buildJobStatuses[status.Event]
+	if !ok {
+		log.Printf("Warning: unknown event %q for build %s", status.Event, status.BuildID)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), buildStatusTimeout)
+	defer cancel()
+
+	// A cancelled build keeps its outcome, and its image is not deployed
+	finished, err := s.builds.Finished(ctx, status.BuildID)
+	if err != nil {
+		return fmt.Errorf("failed to look up build %s: %w", status.BuildID, err)
+	}
+	if finished {
+		log.Printf("Ignoring %s of finished build %s", status.Event, status.BuildID)
+		return nil
+	}
+
+	if status.Event == "queued" {
+		if err := s.builds.UpdateQueue(ctx, status.BuildID, status.QueuePosition, status.EstimatedWaitSeconds); err != nil {
+			return fmt.Errorf("failed to record queue position of build %s: %w", status.BuildID, err)
+		}
+		return nil
+	}
+
+	// A started build reports the runtime and builder image it builds with
+	if status.Runtime != "" || status.DetectedFrom != "" || status.BuilderImage != "" {
+		if err := s.builds.UpdateDetection(ctx, status.BuildID, status.Runtime, status.DetectedFrom, status.BuilderImage); err != nil {
+			return fmt.Errorf("failed to record detection of build %s: %w", status.BuildID, err)
+		}
+	}
+
+	var image, digest, errorMsg string
+	switch status.Event {
+	case "complete":
+		// Deploy by digest, so pods run exactly the image that was built even
+		// if its tag is pushed again
+		if !digestPattern.MatchString(status.Digest) {
+			jobStatus = "failed"
+			errorMsg = fmt.Sprintf("build reported an invalid image digest %q", status.Digest)
+			break
+		}
+		digest = status.Digest
+		image = PinnedImage(status.ImageRef, digest)
+		if s.deploy != nil {
+			if err := s.deploy(ctx, status.BuildID, image); err != nil {
+				log.Printf("Error: failed to deploy build %s: %v", status.BuildID, err)
+				jobStatus = "failed"
+				errorMsg = fmt.Sprintf("build succeeded but deploy failed: %v", err)
+			}
+		}
+	case "failed":
+		errorMsg = status.Message
+		if errorMsg == "" {
+			errorMsg = "build failed"
+		}
+	}
+
+	if err := s.builds.UpdateStatus(ctx, status.BuildID, jobStatus, status.Strategy, image, digest, status.Commit, errorMsg, ""); err != nil {
+		return fmt.Errorf("failed to record %s of build %s: %w", status.Event, status.BuildID, err)
+	}
+	return nil
+}
+
+// PinnedImage replaces the tag of imageRef with digest:
+// registry:5000/ns/name:tag becomes registry:5000/ns/name@sha256:...
+func PinnedImage(imageRef, digest string) string {
+	name, _, _ := strings.Cut(imageRef, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + "@" + digest
+}
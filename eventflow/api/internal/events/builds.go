@@ -0,0 +1,137 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+// BuildProtocolVersion is the version of the build request and status
+// messages exchanged with the builder worker. Messages of another version
+// are rejected by both sides.
+const BuildProtocolVersion = 1
+
+const (
+	// streamName is the JetStream stream holding every eventflow.> subject
+	streamName = "EVENTFLOW"
+
+	// buildRequestSubject is where the builder worker consumes build requests
+	buildRequestSubject = "eventflow.builds.requested"
+
+	// buildCancelSubject is prefixed to the build ID to ask the builder to
+	// drop a build. The stream keeps the request, so it also reaches a build
+	// that is still queued.
+	buildCancelSubject = "eventflow.builds.cancel."
+
+	// buildStatusSubject matches the eventflow.builds.status.{buildID}
+	// subjects the builder reports progress on
+	buildStatusSubject = "eventflow.builds.status.*"
+
+	// buildStatusConsumer is the durable consumer API replicas share, so each
+	// status update is handled once, even when it arrived during a restart
+	buildStatusConsumer = "eventflow-api-build-status"
+)
+
+// BuildRequest asks the builder worker to build and push an image. It
+// mirrors the builder's BuildReq.
+type BuildRequest struct {
+	Version       int               `json:"version"`
+	BuildID       string            `json:"build_id"`
+	Tenant        string            `json:"tenant,omitempty"`  // namespace of the function, for fair scheduling
+	SourceType    string            `json:"source_type"`       // git, code, tar
+	Source        string            `json:"source"`            // git URL, signed archive URL or inline code
+	Files         map[string]string `json:"files,omitempty"`   // inline source files by path
+	Archive       string            `json:"archive,omitempty"` // base64 .tar.gz of the inline source
+	SourcePath    string            `json:"source_path,omitempty"`
+	GitRef        string            `json:"git_ref,omitempty"`
+	GitAuthSecret string            `json:"git_auth_secret,omitempty"` // Secret in the builder's namespace with git credentials
+	ImageRef      string            `json:"image_ref"`
+	CacheRef      string            `json:"cache_ref,omitempty"` // repository build layers are cached in; no cache when empty
+	Runtime       string            `json:"runtime,omitempty"`
+	Prefer        string            `json:"prefer,omitempty"`          // build strategy; auto when empty
+	TimeoutSecs   int32             `json:"timeout_seconds,omitempty"` // build deadline; the builder's default when 0
+}
+
+// BuildStatus is a progress update from the builder worker. It mirrors the
+// builder's Status.
+type BuildStatus struct {
+	Version  int    `json:"version"`
+	BuildID  string `json:"build_id"`
+	Event    string `json:"event"` // queued, started, building, complete, failed, cancelled
+	Message  string `json:"message,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+	ImageRef string `json:"image_ref,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Commit   string `json:"commit,omitempty"` // commit a git build fetched
+
+	// How a started build builds: its runtime, detected from the source when
+	// the request left it to auto, and the CNB builder image it uses
+	Runtime      string `json:"runtime,omitempty"`
+	DetectedFrom string `json:"detected_from,omitempty"` // manifest or file extension the runtime was detected from
+	BuilderImage string `json:"builder_image,omitempty"`
+
+	// Place of a queued build in the builder's queue, and its estimated wait
+	QueuePosition        int `json:"queue_position,omitempty"`
+	EstimatedWaitSeconds int `json:"estimated_wait_seconds,omitempty"`
+}
+
+// RequestBuild hands a build to the builder worker
+func (p *Publisher) RequestBuild(req BuildRequest) error {
+	req.Version = BuildProtocolVersion
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal build request: %w", err)
+	}
+
+	if _, err := p.js.Publish(buildRequestSubject, data); err != nil {
+		return fmt.Errorf("failed to publish build request: %w", err)
+	}
+
+	return nil
+}
+
+// CancelBuild tells the builder worker to stop a build, whether it is
+// running or still queued
+func (p *Publisher) CancelBuild(buildID string) error {
+	if _, err := p.js.Publish(buildCancelSubject+buildID, nil); err != nil {
+		return fmt.Errorf("failed to publish build cancellation: %w", err)
+	}
+	return nil
+}
+
+// SubscribeBuildStatus calls handler for every status update the builder
+// publishes. Replicas share one durable consumer, so each update is handled
+// once; an update is redelivered when handler returns an error.
+func (p *Publisher) SubscribeBuildStatus(handler func(BuildStatus) error) error {
+	_, err := p.js.QueueSubscribe(buildStatusSubject, buildStatusConsumer, func(msg *nats.Msg) {
+		var status BuildStatus
+		if err := json.Unmarshal(msg.Data, &status); err != nil {
+			log.Printf("Warning: invalid build status on %s: %v", msg.Subject, err)
+			msg.Term()
+			return
+		}
+		if status.Version != BuildProtocolVersion {
+			log.Printf("Warning: build status on %s has unsupported protocol version %d", msg.Subject, status.Version)
+			msg.Term()
+			return
+		}
+		if err := handler(status); err != nil {
+			log.Printf("Error: failed to handle build status on %s: %v", msg.Subject, err)
+			msg.Nak()
+			return
+		}
+		msg.Ack()
+	},
+		nats.Durable(buildStatusConsumer),
+		nats.BindStream(streamName),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to build status: %w", err)
+	}
+
+	return nil
+}
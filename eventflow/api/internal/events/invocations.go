@@ -0,0 +1,28 @@
+package events
+
+import (
+	"encoding/base64"
+	"net/http"
+)
+
+// EventTypeInvoke is the event type of an asynchronous function invocation
+const EventTypeInvoke = "function.invoke"
+
+// InvocationPayload builds the payload of a function.invoke event. The
+// dispatcher replays method, query, headers and body against the function's
+// Service and reports the outcome on the invocation row.
+func InvocationPayload(invocationID, namespace, method, rawQuery string, header http.Header, body []byte) map[string]interface{} {
+	headers := make(map[string]interface{}, len(header))
+	for key, values := range header {
+		headers[key] = values
+	}
+
+	return map[string]interface{}{
+		"invocation_id": invocationID,
+		"namespace":     namespace,
+		"method":        method,
+		"query":         rawQuery,
+		"headers":       headers,
+		"body":          base64.StdEncoding.EncodeToString(body),
+	}
+}
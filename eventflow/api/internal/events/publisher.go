@@ -37,7 +37,7 @@ func NewPublisher(natsURL string) (*Publisher, error) {
 
 	// Ensure stream exists
 	_, err = js.AddStream(&nats.StreamConfig{
-		Name:     "EVENTFLOW",
+		Name:     streamName,
 		Subjects: []string{"eventflow.>"},
 		MaxAge:   24 * time.Hour,
 	})
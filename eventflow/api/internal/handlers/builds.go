@@ -1,22 +1,77 @@
 package handlers
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/eventflow/api/internal/artifacts"
 	"github.com/eventflow/api/internal/auth"
 	"github.com/eventflow/api/internal/database"
+	"github.com/eventflow/api/internal/events"
+	"github.com/eventflow/api/internal/k8s"
+	"github.com/eventflow/api/internal/metrics"
+	"github.com/eventflow/api/internal/models"
+	"github.com/eventflow/api/internal/registry"
+	"github.com/eventflow/api/internal/watch"
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
+// buildCheckInterval is how often a build log stream checks whether the build
+// finished
+const buildCheckInterval = 5 * time.Second
+
+// maxInlineSourceBytes bounds the source of a code function: it travels to
+// the builder in a single message
+const maxInlineSourceBytes = 512 * 1024
+
+// minBuildTimeout and maxBuildTimeout bound the build_timeout_seconds of a
+// function, in seconds; the builder caps deadlines at an hour as well
+const (
+	minBuildTimeout = 60
+	maxBuildTimeout = 3600
+)
+
+// buildStrategies are the build strategies a code or git function may ask for
+var buildStrategies = map[string]bool{
+	"auto":     true,
+	"cnb":      true,
+	"pack":     true,
+	"kaniko":   true,
+	"buildkit": true,
+}
+
 type BuildHandler struct {
-	buildRepo *database.BuildJobRepository
+	functionRepo *database.FunctionRepository
+	buildRepo    *database.BuildJobRepository
+	publisher    *events.Publisher
+	k8sClient    *k8s.Client
+	registry     *registry.Client // holds the build caches
+	signer       *artifacts.Signer
+	buildNS      string // namespace the builder runs build Jobs in
 }
 
-func NewBuildHandler(buildRepo *database.BuildJobRepository) *BuildHandler {
+func NewBuildHandler(functionRepo *database.FunctionRepository, buildRepo *database.BuildJobRepository,
+	publisher *events.Publisher, k8sClient *k8s.Client, registryClient *registry.Client, signer *artifacts.Signer,
+	buildNS string) *BuildHandler {
 	return &BuildHandler{
-		buildRepo: buildRepo,
+		functionRepo: functionRepo,
+		buildRepo:    buildRepo,
+		publisher:    publisher,
+		k8sClient:    k8sClient,
+		registry:     registryClient,
+		signer:       signer,
+		buildNS:      buildNS,
 	}
 }
 
@@ -113,66 +168,666 @@ func (h *BuildHandler) StreamBuildLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "streaming not supported", nil)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		respondError(w, http.StatusInternalServerError, "streaming not supported", err)
+		return
+	}
+
+	// A running build's output is replayed from the event bus and then
+	// pushed line by line; a finished build's is read from the database
+	var follower *events.BuildFollower
+	if !buildFinished(job.Status) && h.publisher != nil {
+		follower, err = h.publisher.FollowBuild(buildID)
+		if err != nil {
+			log.Printf("Warning: %v. Polling build %s instead.", err, buildID)
+		} else {
+			defer follower.Stop()
+		}
+	}
+
 	// Set headers for streaming
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		respondError(w, http.StatusInternalServerError, "streaming not supported", nil)
-		return
+	send := func(event map[string]string) bool {
+		data, _ := json.Marshal(event)
+		if _, err := w.Write([]byte("data: " + string(data) + "\n\n")); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
 	}
 
-	// Send initial logs
-	if job.Logs != "" {
-		data, _ := json.Marshal(map[string]string{
-			"type": "log",
-			"data": job.Logs,
-		})
-		w.Write([]byte("data: " + string(data) + "\n\n"))
-		flusher.Flush()
+	var lines <-chan events.BuildLogLine
+	var statuses <-chan events.BuildStatus
+	if follower != nil {
+		lines, statuses = follower.Lines, follower.Statuses
+	} else if job.Logs != "" {
+		if !send(map[string]string{"type": "log", "data": job.Logs}) {
+			return
+		}
 	}
 
-	// Poll for updates
-	ticker := time.NewTicker(1 * time.Second)
+	// The outcome is read from the database, where it is recorded once the
+	// build is deployed; the check speeds up when the builder reports the end
+	ticker := time.NewTicker(buildCheckInterval)
 	defer ticker.Stop()
+	if follower == nil {
+		ticker.Reset(time.Second)
+	}
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
 
 	lastStatus := job.Status
 	for {
+		if buildFinished(job.Status) {
+			// Lines still queued were published before the outcome
+			for drained := false; !drained; {
+				select {
+				case line := <-lines:
+					send(map[string]string{"type": "log", "container": line.Container, "data": line.Line})
+				default:
+					drained = true
+				}
+			}
+			send(map[string]string{"type": "status", "status": job.Status})
+			if job.Status == "success" && job.Image != "" {
+				send(map[string]string{"type": "complete", "image": job.Image})
+			}
+			return
+		}
+
 		select {
 		case <-r.Context().Done():
 			return
+
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case line := <-lines:
+			if !send(map[string]string{"type": "log", "container": line.Container, "data": line.Line}) {
+				return
+			}
+
+		case status := <-statuses:
+			jobStatus, ok := events.BuildJobStatus(status.Event)
+			if !ok {
+				continue
+			}
+			if status.QueuePosition > 0 {
+				if !send(map[string]string{
+					"type":                   "queue",
+					"queue_position":         strconv.Itoa(status.QueuePosition),
+					"estimated_wait_seconds": strconv.Itoa(status.EstimatedWaitSeconds),
+				}) {
+					return
+				}
+			}
+			if buildFinished(jobStatus) {
+				ticker.Reset(time.Second)
+				continue
+			}
+			if jobStatus != lastStatus {
+				if !send(map[string]string{"type": "status", "status": jobStatus}) {
+					return
+				}
+				lastStatus = jobStatus
+			}
+
 		case <-ticker.C:
-			job, err := h.buildRepo.Get(r.Context(), buildID)
+			current, err := h.buildRepo.Get(r.Context(), buildID)
 			if err != nil {
 				return
 			}
+			job = current
 
-			// Send status updates
-			if job.Status != lastStatus {
-				data, _ := json.Marshal(map[string]string{
-					"type":   "status",
-					"status": job.Status,
-				})
-				w.Write([]byte("data: " + string(data) + "\n\n"))
-				flusher.Flush()
+			// Without the event bus, progress only shows up here
+			if follower == nil && !buildFinished(job.Status) && job.Status != lastStatus {
+				if !send(map[string]string{"type": "status", "status": job.Status}) {
+					return
+				}
 				lastStatus = job.Status
 			}
+		}
+	}
+}
 
-			// Exit if terminal status
-			if job.Status == "success" || job.Status == "failed" {
-				if job.Status == "success" && job.Image != "" {
-					data, _ := json.Marshal(map[string]string{
-						"type":  "complete",
-						"image": job.Image,
-					})
-					w.Write([]byte("data: " + string(data) + "\n\n"))
-				}
-				flusher.Flush()
-				return
+// CancelBuild handles POST /v1/builds/{id}:cancel
+// The build is marked cancelled at once. Its builder Job is deleted along
+// with its pods, and a build still in the queue is dropped when the builder
+// reaches it.
+func (h *BuildHandler) CancelBuild(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	buildID := chi.URLParam(r, "id")
+
+	job, err := h.buildRepo.Get(r.Context(), buildID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "build job not found", err)
+		return
+	}
+
+	// Verify ownership
+	if job.UserID != claims.UserID {
+		respondError(w, http.StatusForbidden, "access denied", nil)
+		return
+	}
+
+	cancelled, err := h.buildRepo.Cancel(r.Context(), buildID)
+	if errors.Is(err, database.ErrBuildFinished) {
+		respondError(w, http.StatusConflict, "build already finished", err)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to cancel build", err)
+		return
+	}
+
+	// The request is published before the Job is deleted, so the builder
+	// reports the missing Job as a cancellation rather than a failure
+	if h.publisher != nil {
+		if err := h.publisher.CancelBuild(buildID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
+		if err := h.k8sClient.DeleteBuildJobs(r.Context(), h.buildNS, buildID); err != nil {
+			log.Printf("Warning: build %s: %v", buildID, err)
+		}
+	}
+
+	log.Printf("Cancelled build %s of %s/%s", buildID, job.Namespace, job.FunctionName)
+	respondJSON(w, http.StatusOK, cancelled)
+}
+
+// RetryBuild handles POST /v1/builds/{id}:retry
+// A failed or cancelled build is queued again as a new build with the same
+// source, runtime, strategy and timeout. A private repository is cloned with
+// the credentials kept for its function, or with git_auth from the body,
+// which replaces them.
+func (h *BuildHandler) RetryBuild(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	buildID := chi.URLParam(r, "id")
+
+	job, err := h.buildRepo.Get(r.Context(), buildID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "build job not found", err)
+		return
+	}
+
+	// Verify ownership
+	if job.UserID != claims.UserID {
+		respondError(w, http.StatusForbidden, "access denied", nil)
+		return
+	}
+
+	if job.Status != "failed" && job.Status != "cancelled" {
+		respondError(w, http.StatusConflict, fmt.Sprintf("build is %s; only failed or cancelled builds can be retried", job.Status), nil)
+		return
+	}
+
+	var req models.RetryBuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, "invalid request body", err)
+		return
+	}
+	if req.GitAuth != nil {
+		if job.SourceType != "git" {
+			respondError(w, http.StatusBadRequest, "git_auth only applies to git builds", nil)
+			return
+		}
+		if err := validateGitAuth(job.GitURL, req.GitAuth); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid git_auth", err)
+			return
+		}
+	}
+
+	retryID := uuid.New().String()
+	retry := &database.BuildJob{
+		ID:            retryID,
+		FunctionName:  job.FunctionName,
+		UserID:        job.UserID,
+		Namespace:     job.Namespace,
+		SourceType:    job.SourceType,
+		Runtime:       job.Runtime,
+		SourceCode:    job.SourceCode,
+		SourceFiles:   job.SourceFiles,
+		SourceArchive: job.SourceArchive,
+		ArtifactKey:   job.ArtifactKey,
+		SourceDigest:  job.SourceDigest,
+		GitURL:        job.GitURL,
+		GitRef:        job.GitRef,
+		GitPath:       job.GitPath,
+		ImageRef:      retagImage(job.ImageRef, retryID),
+		TimeoutSecs:   job.TimeoutSecs,
+		BuildStrategy: job.BuildStrategy,
+	}
+
+	// The strategy the failed build ran with is asked for again, so the
+	// retry does not depend on detection picking the same one
+	buildReq := events.BuildRequest{
+		Files:  job.SourceFiles,
+		Prefer: job.Strategy,
+	}
+	switch job.SourceType {
+	case "git":
+		buildReq.Source = job.GitURL
+	case "code":
+		buildReq.Source = job.SourceCode
+	case "tar":
+		buildReq.Source = h.signer.URL(job.ArtifactKey, sourceURLTTL)
+	}
+
+	if job.SourceType == "git" {
+		secret, status, err := h.retryGitAuth(r.Context(), job, retryID, req.GitAuth)
+		if err != nil {
+			respondError(w, status, "failed to store git credentials", err)
+			return
+		}
+		buildReq.GitAuthSecret = secret
+	}
+
+	retry, status, err := submitBuild(r.Context(), h.buildRepo, h.publisher, retry, buildReq)
+	if err != nil {
+		dropGitAuth(r.Context(), h.k8sClient, h.buildNS, retryID, buildReq.GitAuthSecret)
+		respondError(w, status, "failed to queue build", err)
+		return
+	}
+
+	log.Printf("Retrying build %s of %s/%s as %s", job.ID, job.Namespace, job.FunctionName, retry.ID)
+
+	statusURL := "/v1/builds/" + retry.ID
+	w.Header().Set("Location", statusURL)
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":       "Build queued",
+		"function_name": retry.FunctionName,
+		"build_id":      retry.ID,
+		"retry_of":      job.ID,
+		"status":        retry.Status,
+		"status_url":    statusURL,
+	})
+}
+
+// PurgeBuildCache handles DELETE /v1/functions/{name}/build-cache
+// The next build of the function starts from an empty cache. A build running
+// meanwhile may write its layers back.
+func (h *BuildHandler) PurgeBuildCache(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	function, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
+		return
+	}
+
+	deleted, err := h.registry.DeleteRepository(r.Context(), buildCacheRepository(function.Namespace, function.Name))
+	if err != nil {
+		respondError(w, http.StatusBadGateway, "failed to purge build cache", err)
+		return
+	}
+
+	log.Printf("Purged build cache of %s/%s (%d images)", function.Namespace, function.Name, deleted)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":        "Build cache purged",
+		"function_name":  function.Name,
+		"deleted_images": deleted,
+	})
+}
+
+// validateInlineSource checks the source of a code function: exactly one of
+// source_code, source_files and source_archive, within maxInlineSourceBytes.
+// A runtime of auto is detected from file names, which a single source_code
+// file does not have.
+func validateInlineSource(req models.CreateFunctionRequest) error {
+	given := 0
+	for _, set := range []bool{req.SourceCode != "", len(req.SourceFiles) > 0, req.SourceArchive != ""} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return fmt.Errorf("exactly one of source_code, source_files or source_archive is required")
+	}
+	if req.SourceCode != "" && req.Runtime == "auto" {
+		return fmt.Errorf("runtime auto needs source_files or source_archive to detect the runtime from")
+	}
+
+	size := 0
+	switch {
+	case req.SourceCode != "":
+		code, err := base64.StdEncoding.DecodeString(req.SourceCode)
+		if err != nil {
+			return fmt.Errorf("source_code must be base64 encoded: %w", err)
+		}
+		size = len(code)
+
+	case req.SourceArchive != "":
+		archive, err := base64.StdEncoding.DecodeString(req.SourceArchive)
+		if err != nil {
+			return fmt.Errorf("source_archive must be base64 encoded: %w", err)
+		}
+		if len(archive) < 2 || archive[0] != 0x1f || archive[1] != 0x8b {
+			return fmt.Errorf("source_archive must be a gzipped tar archive")
+		}
+		size = len(archive)
+
+	default:
+		for name, content := range req.SourceFiles {
+			if !validSourcePath(name) {
+				return fmt.Errorf("invalid source file name %q", name)
+			}
+			size += len(name) + len(content)
+		}
+	}
+
+	if size > maxInlineSourceBytes {
+		return fmt.Errorf("source is %d bytes, more than the %d allowed", size, maxInlineSourceBytes)
+	}
+	return nil
+}
+
+// validateGitAuth checks the credentials of a git function against its
+// repository URL: basic and token auth need an HTTP(S) URL, ssh auth an SSH
+// one
+func validateGitAuth(gitURL string, auth *models.GitAuth) error {
+	if auth == nil {
+		return nil
+	}
+
+	sshURL := strings.HasPrefix(gitURL, "ssh://") ||
+		(!strings.Contains(gitURL, "://") && strings.Contains(gitURL, "@") && strings.Contains(gitURL, ":"))
+	httpURL := strings.HasPrefix(gitURL, "https://") || strings.HasPrefix(gitURL, "http://")
+
+	switch auth.Type {
+	case "basic":
+		if auth.Username == "" || auth.Password == "" {
+			return fmt.Errorf("basic auth requires username and password")
+		}
+		if !httpURL {
+			return fmt.Errorf("basic auth requires an https:// repository URL")
+		}
+	case "token":
+		if auth.Password == "" {
+			return fmt.Errorf("token auth requires the token in password")
+		}
+		if !httpURL {
+			return fmt.Errorf("token auth requires an https:// repository URL")
+		}
+	case "ssh":
+		if !strings.Contains(auth.SSHKey, "PRIVATE KEY") {
+			return fmt.Errorf("ssh auth requires a PEM or OpenSSH private key in ssh_key")
+		}
+		if !sshURL {
+			return fmt.Errorf("ssh auth requires an ssh:// or user@host:path repository URL")
+		}
+	default:
+		return fmt.Errorf("type must be basic, token, or ssh")
+	}
+	return nil
+}
+
+// validSourcePath reports whether a source file name stays inside the source
+// root without naming the root itself
+func validSourcePath(name string) bool {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	return name != "" && !path.IsAbs(name) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// buildFinished reports whether a build_jobs status is terminal
+func buildFinished(status string) bool {
+	return status == "success" || status == "failed" || status == "cancelled"
+}
+
+// queueBuild records a build job for a code or git function and hands it to
+// the builder worker. It returns the HTTP status to report when it fails.
+func (h *FunctionHandler) queueBuild(ctx context.Context, function *models.Function, req models.CreateFunctionRequest) (*database.BuildJob, int, error) {
+	buildID := uuid.New().String()
+	job := &database.BuildJob{
+		ID:            buildID,
+		FunctionName:  function.Name,
+		UserID:        function.UserID,
+		Namespace:     function.Namespace,
+		SourceType:    function.DeploymentType,
+		Runtime:       req.Runtime,
+		GitURL:        function.GitURL,
+		GitRef:        function.GitBranch,
+		GitPath:       function.GitPath,
+		ImageRef:      buildImageRef(h.registry, function, buildID),
+		TimeoutSecs:   req.BuildTimeout,
+		BuildStrategy: req.BuildStrategy,
+	}
+	source := function.GitURL
+	if function.DeploymentType == "code" {
+		code, err := base64.StdEncoding.DecodeString(req.SourceCode)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("source_code must be base64 encoded: %w", err)
+		}
+		job.SourceCode = string(code)
+		job.SourceFiles = req.SourceFiles
+		job.SourceArchive = req.SourceArchive
+		source = job.SourceCode
+	}
+
+	var gitAuthSecret string
+	if function.DeploymentType == "git" && req.GitConfig != nil && req.GitConfig.Auth != nil {
+		// Kept for the builds that pushes and retries queue later
+		if status, err := storeFunctionGitAuth(ctx, h.k8sClient, h.buildNS, function, req.GitConfig.Auth); err != nil {
+			return nil, status, err
+		}
+		var status int
+		var err error
+		gitAuthSecret, status, err = storeGitAuth(ctx, h.k8sClient, h.buildNS, buildID, req.GitConfig.Auth)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+
+	job, status, err := submitBuild(ctx, h.buildRepo, h.publisher, job, events.BuildRequest{
+		Source:        source,
+		Files:         job.SourceFiles,
+		Prefer:        req.BuildStrategy,
+		GitAuthSecret: gitAuthSecret,
+	})
+	if err != nil {
+		dropGitAuth(ctx, h.k8sClient, h.buildNS, buildID, gitAuthSecret)
+	}
+	return job, status, err
+}
+
+// storeGitAuth hands the credentials of a private repository to the builder
+// in a Secret of its own, never through the event bus. It returns the
+// Secret's name, or the HTTP status to report when it fails.
+func storeGitAuth(ctx context.Context, k8sClient *k8s.Client, namespace, buildID string, auth *models.GitAuth) (string, int, error) {
+	if k8sClient == nil || !k8sClient.HasKubernetes() {
+		return "", http.StatusServiceUnavailable, fmt.Errorf("git credentials need Kubernetes")
+	}
+	secret, err := k8sClient.CreateGitAuthSecret(ctx, namespace, buildID, auth)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return secret, http.StatusOK, nil
+}
+
+// retryGitAuth hands a retry of a git build the credentials it clones with:
+// auth, which the function keeps from now on, or those the function kept.
+// It returns "" for a public repository.
+func (h *BuildHandler) retryGitAuth(ctx context.Context, job *database.BuildJob, retryID string, auth *models.GitAuth) (string, int, error) {
+	// A deleted function took its credentials with it
+	function, err := h.functionRepo.Get(ctx, job.UserID, job.FunctionName, job.Namespace)
+	private := err == nil && function.GitPrivate
+
+	switch {
+	case auth != nil:
+		if private {
+			if status, err := storeFunctionGitAuth(ctx, h.k8sClient, h.buildNS, function, auth); err != nil {
+				return "", status, err
 			}
 		}
+		return storeGitAuth(ctx, h.k8sClient, h.buildNS, retryID, auth)
+	case private:
+		return copyFunctionGitAuth(ctx, h.k8sClient, h.buildNS, retryID, function.Namespace, function.Name)
+	}
+	return "", http.StatusOK, nil
+}
+
+// storeFunctionGitAuth keeps the credentials of a function's private
+// repository in the builder's namespace. It returns the HTTP status to report
+// when it fails.
+func storeFunctionGitAuth(ctx context.Context, k8sClient *k8s.Client, namespace string, function *models.Function, auth *models.GitAuth) (int, error) {
+	if k8sClient == nil || !k8sClient.HasKubernetes() {
+		return http.StatusServiceUnavailable, fmt.Errorf("git credentials need Kubernetes")
+	}
+	if err := k8sClient.StoreFunctionGitAuth(ctx, namespace, function.Namespace, function.Name, auth); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// copyFunctionGitAuth hands the credentials kept for a function to one of its
+// builds, as storeGitAuth does with credentials from a request
+func copyFunctionGitAuth(ctx context.Context, k8sClient *k8s.Client, namespace, buildID, fnNamespace, fnName string) (string, int, error) {
+	if k8sClient == nil || !k8sClient.HasKubernetes() {
+		return "", http.StatusServiceUnavailable, fmt.Errorf("git credentials need Kubernetes")
+	}
+	auth, err := k8sClient.FunctionGitAuth(ctx, namespace, fnNamespace, fnName)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
 	}
+	return storeGitAuth(ctx, k8sClient, namespace, buildID, auth)
+}
+
+// dropGitAuth deletes the git credentials of a build that was never queued
+func dropGitAuth(ctx context.Context, k8sClient *k8s.Client, namespace, buildID, secret string) {
+	if secret == "" {
+		return
+	}
+	if err := k8sClient.DeleteSecret(ctx, namespace, secret); err != nil {
+		log.Printf("Warning: failed to delete git credentials of build %s: %v", buildID, err)
+	}
+}
+
+// buildImageRef is where a build of a function pushes its image
+func buildImageRef(registry string, function *models.Function, buildID string) string {
+	return fmt.Sprintf("%s/%s/%s:%s", registry, function.Namespace, function.Name, buildID[:8])
+}
+
+// retagImage points the image reference of a build at the tag of another
+// build: registry:5000/ns/name:1a2b3c4d becomes registry:5000/ns/name:{id8}
+func retagImage(imageRef, buildID string) string {
+	name := imageRef
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + ":" + buildID[:8]
+}
+
+// buildCacheRepository is the repository, in the build registry, that the
+// builds of a function cache their layers in
+func buildCacheRepository(namespace, name string) string {
+	return fmt.Sprintf("%s/%s/cache", namespace, name)
+}
+
+// submitBuild records a build job and hands it to the builder worker. The
+// request's job fields are filled in from the job. It returns the HTTP
+// status to report when it fails.
+func submitBuild(ctx context.Context, buildRepo *database.BuildJobRepository, publisher *events.Publisher,
+	job *database.BuildJob, req events.BuildRequest) (*database.BuildJob, int, error) {
+	if publisher == nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("event bus not configured")
+	}
+
+	job, err := buildRepo.Create(ctx, job)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	req.BuildID = job.ID
+	req.Tenant = job.Namespace
+	req.SourceType = job.SourceType
+	req.SourcePath = job.GitPath
+	req.GitRef = job.GitRef
+	req.ImageRef = job.ImageRef
+	req.Runtime = job.Runtime
+	req.Archive = job.SourceArchive
+	req.TimeoutSecs = job.TimeoutSecs
+	if registryHost, _, ok := strings.Cut(job.ImageRef, "/"); ok {
+		req.CacheRef = registryHost + "/" + buildCacheRepository(job.Namespace, job.FunctionName)
+	}
+	if err := publisher.RequestBuild(req); err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+
+	return job, http.StatusAccepted, nil
+}
+
+// DeployBuild deploys the image a build produced: the image is written to
+// the function's row (as a new revision) and the Function CR is created, or
+// patched when the function was deployed before.
+func (h *FunctionHandler) DeployBuild(ctx context.Context, buildID, image string) error {
+	job, err := h.buildRepo.Get(ctx, buildID)
+	if err != nil {
+		return err
+	}
+
+	function, err := h.functionRepo.Get(ctx, job.UserID, job.FunctionName, job.Namespace)
+	if err != nil {
+		return err
+	}
+
+	previous := *function
+	function.Image = job.ImageRef
+	if image != "" {
+		function.Image = image
+	}
+
+	updated, err := h.functionRepo.Update(ctx, job.UserID, job.Namespace, function, "built by build "+job.ID)
+	if err != nil {
+		return err
+	}
+
+	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
+		err := h.k8sClient.CreateFunctionCR(ctx, updated)
+		if k8s.IsAlreadyExists(err) {
+			err = h.k8sClient.UpdateFunctionCR(ctx, &previous, updated)
+		} else if err == nil {
+			metrics.ActiveFunctions.WithLabelValues(updated.Namespace).Inc()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Deployed build %s of %s/%s as %s", job.ID, updated.Namespace, updated.Name, updated.Image)
+	h.watchHub.Publish(watch.Event{Type: watch.Modified, Namespace: updated.Namespace, Name: updated.Name})
+	return nil
 }
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/eventflow/api/internal/auth"
 	"github.com/eventflow/api/internal/database"
@@ -12,20 +16,46 @@ import (
 	"github.com/eventflow/api/internal/k8s"
 	"github.com/eventflow/api/internal/metrics"
 	"github.com/eventflow/api/internal/models"
+	"github.com/eventflow/api/internal/watch"
 	"github.com/go-chi/chi/v5"
+	"k8s.io/apimachinery/pkg/api/resource"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metavalidation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
+// Replica bounds enforced by the Function CRD
+const (
+	minReplicas = 1
+	maxReplicas = 10
+)
+
+// maxDescriptionLength bounds the free-text description of a function
+const maxDescriptionLength = 1024
+
+// reservedLabelPrefix is kept for labels and annotations set by EventFlow itself
+const reservedLabelPrefix = "eventflow.io/"
+
 type FunctionHandler struct {
 	k8sClient    *k8s.Client
 	publisher    *events.Publisher
 	functionRepo *database.FunctionRepository
+	buildRepo    *database.BuildJobRepository
+	watchHub     *watch.Hub
+	registry     string // where built function images are pushed
+	buildNS      string // where the builder runs build Jobs
 }
 
-func NewFunctionHandler(k8sClient *k8s.Client, publisher *events.Publisher, functionRepo *database.FunctionRepository) *FunctionHandler {
+func NewFunctionHandler(k8sClient *k8s.Client, publisher *events.Publisher, functionRepo *database.FunctionRepository,
+	buildRepo *database.BuildJobRepository, watchHub *watch.Hub, registry, buildNS string) *FunctionHandler {
 	return &FunctionHandler{
 		k8sClient:    k8sClient,
 		publisher:    publisher,
 		functionRepo: functionRepo,
+		buildRepo:    buildRepo,
+		watchHub:     watchHub,
+		registry:     registry,
+		buildNS:      buildNS,
 	}
 }
 
@@ -59,7 +89,7 @@ func (h *FunctionHandler) CreateFunction(w http.ResponseWriter, r *http.Request)
 		// Auto-detect based on provided fields
 		if req.GitConfig != nil && req.GitConfig.URL != "" {
 			deploymentType = "git"
-		} else if req.SourceCode != "" {
+		} else if req.SourceCode != "" || len(req.SourceFiles) > 0 || req.SourceArchive != "" {
 			deploymentType = "code"
 		} else if req.Image != "" {
 			deploymentType = "image"
@@ -77,8 +107,12 @@ func (h *FunctionHandler) CreateFunction(w http.ResponseWriter, r *http.Request)
 			return
 		}
 	case "code":
-		if req.SourceCode == "" || req.Runtime == "" {
-			respondError(w, http.StatusBadRequest, "source_code and runtime are required for deployment_type=code", nil)
+		if req.Runtime == "" {
+			respondError(w, http.StatusBadRequest, "runtime is required for deployment_type=code", nil)
+			return
+		}
+		if err := validateInlineSource(req); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid source", err)
 			return
 		}
 	case "git":
@@ -86,11 +120,38 @@ func (h *FunctionHandler) CreateFunction(w http.ResponseWriter, r *http.Request)
 			respondError(w, http.StatusBadRequest, "git_config.url is required for deployment_type=git", nil)
 			return
 		}
+		if err := validateGitAuth(req.GitConfig.URL, req.GitConfig.Auth); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid git_config.auth", err)
+			return
+		}
 	default:
 		respondError(w, http.StatusBadRequest, "invalid deployment_type. Must be: git, code, or image", nil)
 		return
 	}
 
+	if req.BuildStrategy != "" {
+		if deploymentType == "image" {
+			respondError(w, http.StatusBadRequest, "build_strategy only applies to deployment_type=code or git", nil)
+			return
+		}
+		if !buildStrategies[req.BuildStrategy] {
+			respondError(w, http.StatusBadRequest, "invalid build_strategy. Must be: auto, cnb, pack, kaniko, or buildkit", nil)
+			return
+		}
+	}
+
+	if req.BuildTimeout != 0 {
+		if deploymentType == "image" {
+			respondError(w, http.StatusBadRequest, "build_timeout_seconds only applies to deployment_type=code or git", nil)
+			return
+		}
+		if req.BuildTimeout < minBuildTimeout || req.BuildTimeout > maxBuildTimeout {
+			respondError(w, http.StatusBadRequest,
+				fmt.Sprintf("build_timeout_seconds must be between %d and %d", minBuildTimeout, maxBuildTimeout), nil)
+			return
+		}
+	}
+
 	// Auto-generate namespace from user ID
 	req.Namespace = claims.Namespace // tenant-{userID}
 
@@ -98,6 +159,15 @@ func (h *FunctionHandler) CreateFunction(w http.ResponseWriter, r *http.Request)
 		req.Replicas = 1
 	}
 
+	if err := validateFunctionSpec(req.Replicas, req.Resources); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid function spec", err)
+		return
+	}
+	if err := validateFunctionMetadata(req.Labels, req.Annotations, req.Description); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid function metadata", err)
+		return
+	}
+
 	// Ensure tenant namespace exists
 	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
 		if err := h.k8sClient.EnsureNamespace(r.Context(), req.Namespace); err != nil {
@@ -121,25 +191,44 @@ func (h *FunctionHandler) CreateFunction(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Save to database first
-	function, err := h.functionRepo.Create(r.Context(), claims.UserID, req.Name, req.Namespace, req.Image, req.Replicas, req.Env, req.Command, deploymentType, gitURL, gitBranch, gitPath)
+	function, err := h.functionRepo.Create(r.Context(), &models.Function{
+		Name:           req.Name,
+		Namespace:      req.Namespace,
+		UserID:         claims.UserID,
+		Image:          req.Image,
+		Command:        req.Command,
+		Args:           req.Args,
+		Env:            req.Env,
+		Replicas:       req.Replicas,
+		Resources:      req.Resources,
+		DeploymentType: deploymentType,
+		GitURL:         gitURL,
+		GitBranch:      gitBranch,
+		GitPath:        gitPath,
+		GitPrivate:     deploymentType == "git" && req.GitConfig.Auth != nil,
+		Labels:         req.Labels,
+		Annotations:    req.Annotations,
+		Description:    req.Description,
+	})
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "failed to create function in database", err)
 		return
 	}
+	h.watchHub.Publish(watch.Event{Type: watch.Added, Namespace: function.Namespace, Name: function.Name})
 
 	// Handle deployment based on type
 	switch deploymentType {
 	case "image":
 		// Direct deployment with existing image
 		if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
-			err = h.k8sClient.CreateFunctionCR(r.Context(), req)
+			err = h.k8sClient.CreateFunctionCR(r.Context(), function)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, "failed to create function in Kubernetes", err)
 				return
 			}
 			metrics.ActiveFunctions.WithLabelValues(req.Namespace).Inc()
 		}
-		
+
 		// Return immediate success
 		status := models.FunctionStatus{
 			Name:              function.Name,
@@ -150,24 +239,38 @@ func (h *FunctionHandler) CreateFunction(w http.ResponseWriter, r *http.Request)
 			ReadyReplicas:     0,
 			UpdatedReplicas:   0,
 			Status:            "Pending",
+			Labels:            function.Labels,
+			Annotations:       function.Annotations,
+			Description:       function.Description,
 			CreatedAt:         function.CreatedAt,
 		}
 		respondJSON(w, http.StatusCreated, status)
-		
+
 	case "code", "git":
-		// Queue build job (will be handled by builder worker via NATS events)
-		// TODO: Create build job and publish NATS event
-		// For now, return accepted status
+		// Queue build job; the function is deployed when the build completes
+		job, status, err := h.queueBuild(r.Context(), function, req)
+		if err != nil {
+			respondError(w, status, "failed to queue build", err)
+			return
+		}
+
+		statusURL := "/v1/builds/" + job.ID
+		w.Header().Set("Location", statusURL)
 		respondJSON(w, http.StatusAccepted, map[string]interface{}{
 			"message":         "Build queued",
 			"function_name":   req.Name,
 			"deployment_type": deploymentType,
-			"status":          "pending",
+			"build_id":        job.ID,
+			"status":          job.Status,
+			"status_url":      statusURL,
 		})
 	}
 }
 
 // ListFunctions handles GET /v1/functions
+// Supports limit/page_token pagination, status, deployment_type, image and
+// label_selector filters, and sort (name, created_at, updated_at) with order.
+// With ?watch=true it streams changes instead (see watchFunctions).
 func (h *FunctionHandler) ListFunctions(w http.ResponseWriter, r *http.Request) {
 	// Extract user from JWT token
 	claims, ok := auth.GetUserFromContext(r.Context())
@@ -176,72 +279,127 @@ func (h *FunctionHandler) ListFunctions(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if IsWatchRequest(r) {
+		h.watchFunctions(w, r, claims, "")
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid limit", err)
+		return
+	}
+
+	query := r.URL.Query()
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		respondError(w, http.StatusBadRequest, "order must be asc or desc", nil)
+		return
+	}
+
 	// Get functions from database (scoped to user)
-	functions, err := h.functionRepo.List(r.Context(), claims.UserID)
+	functions, nextPageToken, total, err := h.functionRepo.List(r.Context(), claims.UserID, database.ListFunctionsOptions{
+		Limit:          limit,
+		PageToken:      query.Get("page_token"),
+		Status:         query.Get("status"),
+		DeploymentType: query.Get("deployment_type"),
+		Image:          query.Get("image"),
+		LabelSelector:  query.Get("label_selector"),
+		SortBy:         query.Get("sort"),
+		Ascending:      order == "asc",
+	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list functions", err)
+		respondError(w, http.StatusBadRequest, "failed to list functions", err)
 		return
 	}
 
-	// If Kubernetes is available, enrich with deployment status
-	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
-		statusList := make([]models.FunctionStatus, 0, len(functions))
-
-		for _, fn := range functions {
-			status := models.FunctionStatus{
-				Name:              fn.Name,
-				Namespace:         fn.Namespace,
-				Image:             fn.Image,
-				Replicas:          fn.Replicas,
-				AvailableReplicas: 0,
-				ReadyReplicas:     0,
-				UpdatedReplicas:   0,
-				Status:            "Pending",
-				CreatedAt:         fn.CreatedAt,
-			}
+	statusList := make([]models.FunctionStatus, 0, len(functions))
+	for _, fn := range functions {
+		statusList = append(statusList, h.functionStatus(fn))
+	}
 
-			// Try to get deployment status from Kubernetes
-			deployment, err := h.k8sClient.GetDeployment(r.Context(), fn.Namespace, fn.Name)
-			if err == nil && deployment != nil {
-				status.AvailableReplicas = deployment.Status.AvailableReplicas
-				status.ReadyReplicas = deployment.Status.ReadyReplicas
-				status.UpdatedReplicas = deployment.Status.UpdatedReplicas
-
-				// Determine status
-				if deployment.Status.ReadyReplicas == fn.Replicas {
-					status.Status = "Running"
-				} else if deployment.Status.UnavailableReplicas > 0 {
-					status.Status = "Failed"
-				}
-			}
+	respondJSON(w, http.StatusOK, models.FunctionList{
+		Functions:     statusList,
+		NextPageToken: nextPageToken,
+		TotalCount:    total,
+	})
+}
 
-			statusList = append(statusList, status)
-		}
+// GetFunction handles GET /v1/functions/{name}
+func (h *FunctionHandler) GetFunction(w http.ResponseWriter, r *http.Request) {
+	// Extract user from JWT token
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
 
-		respondJSON(w, http.StatusOK, statusList)
+	name := chi.URLParam(r, "name")
+
+	// Get from database (scoped to user and their namespace)
+	function, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
 		return
 	}
 
-	// No Kubernetes - return basic function info as status
-	statusList := make([]models.FunctionStatus, 0, len(functions))
-	for _, fn := range functions {
-		statusList = append(statusList, models.FunctionStatus{
+	respondJSON(w, http.StatusOK, h.functionStatus(function))
+}
+
+// functionStatus enriches a stored function with the state the operator
+// reports, read from the Kubernetes status cache
+func (h *FunctionHandler) functionStatus(fn *models.Function) models.FunctionStatus {
+	// No Kubernetes - return basic function info
+	if h.k8sClient == nil || !h.k8sClient.HasKubernetes() {
+		return models.FunctionStatus{
 			Name:              fn.Name,
+			Namespace:         fn.Namespace,
 			Image:             fn.Image,
 			Replicas:          fn.Replicas,
 			AvailableReplicas: fn.Replicas, // Assume available in demo mode
 			ReadyReplicas:     fn.Replicas,
 			UpdatedReplicas:   fn.Replicas,
 			Status:            "Running", // Demo mode - always running
+			Labels:            fn.Labels,
+			Annotations:       fn.Annotations,
+			Description:       fn.Description,
 			CreatedAt:         fn.CreatedAt,
-		})
+		}
 	}
 
-	respondJSON(w, http.StatusOK, statusList)
+	status := models.FunctionStatus{
+		Name:              fn.Name,
+		Namespace:         fn.Namespace,
+		Image:             fn.Image,
+		Replicas:          fn.Replicas,
+		AvailableReplicas: 0,
+		ReadyReplicas:     0,
+		UpdatedReplicas:   0,
+		Status:            "Pending",
+		Labels:            fn.Labels,
+		Annotations:       fn.Annotations,
+		Description:       fn.Description,
+		CreatedAt:         fn.CreatedAt,
+	}
+
+	// No Function CR yet (still building or undeployed) stays Pending
+	if state, ok := h.k8sClient.FunctionState(fn.Namespace, fn.Name); ok {
+		status.Status = state.Phase
+		status.Conditions = state.Conditions
+		status.AvailableReplicas = state.AvailableReplicas
+		status.ReadyReplicas = state.ReadyReplicas
+		status.UpdatedReplicas = state.UpdatedReplicas
+	}
+
+	return status
 }
 
-// GetFunction handles GET /v1/functions/{name}
-func (h *FunctionHandler) GetFunction(w http.ResponseWriter, r *http.Request) {
+// UpdateFunction handles PUT and PATCH /v1/functions/{name}
+// PUT replaces the function spec, PATCH only changes the fields present in the body.
+func (h *FunctionHandler) UpdateFunction(w http.ResponseWriter, r *http.Request) {
+	// Ensure request body is closed to prevent file descriptor leaks
+	defer r.Body.Close()
+
 	// Extract user from JWT token
 	claims, ok := auth.GetUserFromContext(r.Context())
 	if !ok {
@@ -251,75 +409,118 @@ func (h *FunctionHandler) GetFunction(w http.ResponseWriter, r *http.Request) {
 
 	name := chi.URLParam(r, "name")
 
+	var req models.UpdateFunctionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body", err)
+		return
+	}
+
 	// Get from database (scoped to user and their namespace)
-	function, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+	current, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
 	if err != nil {
 		respondError(w, http.StatusNotFound, "function not found", err)
 		return
 	}
 
-	// If Kubernetes is available, enrich with deployment status
-	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
-		status := models.FunctionStatus{
-			Name:              function.Name,
-			Namespace:         function.Namespace,
-			Image:             function.Image,
-			Replicas:          function.Replicas,
-			AvailableReplicas: 0,
-			ReadyReplicas:     0,
-			UpdatedReplicas:   0,
-			Status:            "Pending",
-			CreatedAt:         function.CreatedAt,
+	function := *current
+	if r.Method == http.MethodPut {
+		// Built functions keep the image of their last build
+		if req.Image == nil && current.DeploymentType == "image" {
+			respondError(w, http.StatusBadRequest, "image is required", nil)
+			return
+		}
+		function.Command = req.Command
+		function.Args = req.Args
+		function.Env = req.Env
+		function.Resources = req.Resources
+		function.Replicas = 1
+		function.Labels = req.Labels
+		function.Annotations = req.Annotations
+		function.Description = ""
+	} else {
+		if req.Command != nil {
+			function.Command = req.Command
+		}
+		if req.Args != nil {
+			function.Args = req.Args
+		}
+		if req.Env != nil {
+			function.Env = req.Env
+		}
+		if req.Resources != nil {
+			function.Resources = req.Resources
+		}
+		if req.Labels != nil {
+			function.Labels = req.Labels
+		}
+		if req.Annotations != nil {
+			function.Annotations = req.Annotations
 		}
+	}
+	if req.Description != nil {
+		function.Description = *req.Description
+	}
+	if req.Image != nil {
+		function.Image = *req.Image
+	}
+	if req.Replicas != nil {
+		function.Replicas = *req.Replicas
+	}
 
-		// Try to get deployment status from Kubernetes
-		deployment, err := h.k8sClient.GetDeployment(r.Context(), function.Namespace, name)
-		if err == nil && deployment != nil {
-			status.AvailableReplicas = deployment.Status.AvailableReplicas
-			status.ReadyReplicas = deployment.Status.ReadyReplicas
-			status.UpdatedReplicas = deployment.Status.UpdatedReplicas
+	// A built function has no image until its first build completes
+	if function.Image == "" && (function.DeploymentType == "image" || req.Image != nil) {
+		respondError(w, http.StatusBadRequest, "image must not be empty", nil)
+		return
+	}
+	if err := validateFunctionSpec(function.Replicas, function.Resources); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid function spec", err)
+		return
+	}
+	if err := validateFunctionMetadata(function.Labels, function.Annotations, function.Description); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid function metadata", err)
+		return
+	}
 
-			// Determine status
-			if deployment.Status.ReadyReplicas == function.Replicas {
-				status.Status = "Running"
-			} else if deployment.Status.UnavailableReplicas > 0 {
-				status.Status = "Failed"
-			}
+	if sameSpec(current, &function) {
+		// Nothing to roll out and no revision to record
+		if sameMetadata(current, &function) {
+			respondJSON(w, http.StatusOK, current)
+			return
 		}
 
-		respondJSON(w, http.StatusOK, status)
+		updated, status, err := h.applyMetadata(r.Context(), claims, current, &function)
+		if err != nil {
+			respondError(w, status, "failed to update function", err)
+			return
+		}
+		respondJSON(w, http.StatusOK, updated)
 		return
 	}
 
-	// No Kubernetes - return basic function info
-	status := models.FunctionStatus{
-		Name:              function.Name,
-		Image:             function.Image,
-		Replicas:          function.Replicas,
-		AvailableReplicas: function.Replicas,
-		ReadyReplicas:     function.Replicas,
-		UpdatedReplicas:   function.Replicas,
-		Status:            "Running", // Demo mode - always running
-		CreatedAt:         function.CreatedAt,
+	updated, status, err := h.applySpec(r.Context(), claims, current, &function, "updated via "+r.Method)
+	if err != nil {
+		respondError(w, status, "failed to update function", err)
+		return
 	}
 
-	respondJSON(w, http.StatusOK, status)
+	respondJSON(w, http.StatusOK, updated)
 }
 
-// InvokeFunction handles POST /v1/functions/{name}/invoke
+// InvokeFunction handles POST /v1/functions/{name}:invoke
+// The request is proxied to the function's Service and the function's
+// status code, headers and body are returned unchanged. With
+// "Prefer: respond-async" or ?async=true the invocation is queued instead.
 func (h *FunctionHandler) InvokeFunction(w http.ResponseWriter, r *http.Request) {
 	// Ensure request body is closed to prevent file descriptor leaks
 	defer r.Body.Close()
 
-	// This is a placeholder for an alternative function invocation method
-
 	// Extract user from JWT token
 	claims, ok := auth.GetUserFromContext(r.Context())
 	if !ok {
 		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
 		return
 	}
-	// Get function name from payload
+
 	functionName := chi.URLParam(r, "name")
 
 	// Check if function exists in database (scoped to user)
@@ -329,27 +530,82 @@ func (h *FunctionHandler) InvokeFunction(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Ensure tenant namespace exists
-	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
-		if err := h.k8sClient.EnsureNamespace(r.Context(), claims.Namespace); err != nil {
-			respondError(w, http.StatusInternalServerError, "failed to create tenant namespace", err)
-			return
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxInvokeBodySize+1))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "failed to read request body", err)
+		return
+	}
+	if len(body) > maxInvokeBodySize {
+		respondError(w, http.StatusRequestEntityTooLarge, "request body too large", nil)
+		return
+	}
+
+	if wantsAsync(r) {
+		h.invokeAsync(w, r, claims, function, body)
+		return
+	}
+
+	// Synchronous invocations may outlive the server's default write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(k8s.InvokeTimeout + 5*time.Second))
+
+	invocation := &models.Invocation{
+		FunctionName: function.Name,
+		EventType:    "http.invoke",
+		Payload:      invocationPayload(body),
+		Status:       "running",
+		StartedAt:    time.Now(),
+	}
+
+	resp, err := h.k8sClient.InvokeFunction(r.Context(), function.Namespace, function.Name,
+		r.Method, "/", forwardQuery(r), forwardHeaders(r.Header), bytes.NewReader(body))
+
+	var respBody []byte
+	if err == nil {
+		defer resp.Body.Close()
+		respBody, err = io.ReadAll(resp.Body)
+	}
+
+	duration := time.Since(invocation.StartedAt)
+	metrics.FunctionInvocations.WithLabelValues(function.Name, function.Namespace).Inc()
+	metrics.FunctionDuration.WithLabelValues(function.Name, function.Namespace).Observe(duration.Seconds())
+
+	completedAt := time.Now()
+	durationMs := duration.Milliseconds()
+	invocation.CompletedAt = &completedAt
+	invocation.DurationMs = &durationMs
+	switch {
+	case err != nil:
+		invocation.Status = "failed"
+		invocation.Error = err.Error()
+	case resp.StatusCode >= http.StatusInternalServerError:
+		invocation.Status = "failed"
+		invocation.Error = fmt.Sprintf("function returned %s", resp.Status)
+	default:
+		invocation.Status = "completed"
+	}
+
+	if recordErr := h.functionRepo.RecordInvocation(r.Context(), claims.UserID, claims.Namespace, invocation); recordErr != nil {
+		log.Printf("Warning: failed to record invocation for %s: %v", function.Name, recordErr)
+	}
+
+	if err != nil {
+		respondError(w, http.StatusBadGateway, "failed to invoke function", err)
+		return
+	}
+
+	for key, values := range resp.Header {
+		if isHopByHopHeader(key) {
+			continue
 		}
-		var functionRequest models.CreateFunctionRequest
-		functionRequest.Name = function.Name
-		functionRequest.Namespace = function.Namespace
-		functionRequest.Image = function.Image
-		functionRequest.Replicas = function.Replicas
-		functionRequest.Env = function.Env
-		functionRequest.Command = function.Command
-		// Create Function CR in Kubernetes if available
-		err = h.k8sClient.CreateFunctionCR(r.Context(), functionRequest)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, "failed to create function in database", err)
-			return
+		for _, value := range values {
+			w.Header().Add(key, value)
 		}
-		metrics.ActiveFunctions.WithLabelValues(function.Namespace).Inc()
 	}
+	if invocation.ID != "" {
+		w.Header().Set("X-Invocation-Id", invocation.ID)
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
 }
 
 // DeleteFunction handles DELETE /v1/functions/{name}
@@ -369,6 +625,7 @@ func (h *FunctionHandler) DeleteFunction(w http.ResponseWriter, r *http.Request)
 		respondError(w, http.StatusInternalServerError, "failed to delete function from database", err)
 		return
 	}
+	h.watchHub.Publish(watch.Event{Type: watch.Deleted, Namespace: claims.Namespace, Name: name})
 
 	// Delete from Kubernetes if available
 	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
@@ -379,6 +636,10 @@ func (h *FunctionHandler) DeleteFunction(w http.ResponseWriter, r *http.Request)
 		}
 
 		metrics.ActiveFunctions.WithLabelValues(name).Dec()
+
+		if err := h.k8sClient.DeleteFunctionGitAuth(r.Context(), h.buildNS, claims.Namespace, name); err != nil {
+			log.Printf("Warning: failed to delete git credentials of %s/%s: %v", claims.Namespace, name, err)
+		}
 	}
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
@@ -462,6 +723,56 @@ func (h *FunctionHandler) UndeployFunction(w http.ResponseWriter, r *http.Reques
 
 }
 
+// validateFunctionSpec checks the fields the operator and the Function CRD enforce
+func validateFunctionSpec(replicas int32, resources *models.ResourceRequirements) error {
+	if replicas < minReplicas || replicas > maxReplicas {
+		return fmt.Errorf("replicas must be between %d and %d", minReplicas, maxReplicas)
+	}
+	if resources != nil {
+		quantities := map[string]string{
+			"cpu_request":    resources.CPURequest,
+			"memory_request": resources.MemoryRequest,
+			"cpu_limit":      resources.CPULimit,
+			"memory_limit":   resources.MemoryLimit,
+		}
+		for field, value := range quantities {
+			if value == "" {
+				continue
+			}
+			if _, err := resource.ParseQuantity(value); err != nil {
+				return fmt.Errorf("resources.%s: %v", field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateFunctionMetadata checks labels and annotations against the
+// Kubernetes rules, since both are copied onto the Function CR, and keeps
+// users away from the labels EventFlow sets itself
+func validateFunctionMetadata(labels, annotations map[string]string, description string) error {
+	if errs := metavalidation.ValidateLabels(labels, field.NewPath("labels")); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	if errs := apivalidation.ValidateAnnotations(annotations, field.NewPath("annotations")); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	for key := range labels {
+		if _, ok := k8s.SystemLabels[key]; ok || strings.HasPrefix(key, reservedLabelPrefix) {
+			return fmt.Errorf("labels: %q is reserved", key)
+		}
+	}
+	for key := range annotations {
+		if strings.HasPrefix(key, reservedLabelPrefix) {
+			return fmt.Errorf("annotations: %q is reserved", key)
+		}
+	}
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	return nil
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/eventflow/api/internal/auth"
+	"github.com/eventflow/api/internal/database"
+	"github.com/eventflow/api/internal/events"
+	"github.com/eventflow/api/internal/k8s"
+	"github.com/eventflow/api/internal/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// maxWebhookBytes bounds the push payloads git hosts deliver
+const maxWebhookBytes = 5 << 20
+
+// payloadCommitLimit is the most commits GitHub, GitLab and Gitea list in a
+// push payload; a push listing that many may have touched files it does not
+// list
+const payloadCommitLimit = 20
+
+// deletedCommit is the "after" commit of a push that deleted its branch
+const deletedCommit = "0000000000000000000000000000000000000000"
+
+// HookHandler serves the webhooks git hosts call when a git function's
+// repository is pushed to
+type HookHandler struct {
+	functionRepo *database.FunctionRepository
+	buildRepo    *database.BuildJobRepository
+	publisher    *events.Publisher
+	k8sClient    *k8s.Client
+	registry     string // registry the builder pushes function images to
+	buildNS      string // where the builder runs build Jobs
+	publicURL    string // where git hosts reach the API
+}
+
+func NewHookHandler(functionRepo *database.FunctionRepository, buildRepo *database.BuildJobRepository,
+	publisher *events.Publisher, k8sClient *k8s.Client, registry, buildNS, publicURL string) *HookHandler {
+	return &HookHandler{
+		functionRepo: functionRepo,
+		buildRepo:    buildRepo,
+		publisher:    publisher,
+		k8sClient:    k8sClient,
+		registry:     registry,
+		buildNS:      buildNS,
+		publicURL:    strings.TrimSuffix(publicURL, "/"),
+	}
+}
+
+// gitPush is the part of a GitHub, GitLab or Gitea push payload that decides
+// whether a function is rebuilt
+type gitPush struct {
+	Ref          string      `json:"ref"`
+	After        string      `json:"after"`
+	Deleted      bool        `json:"deleted"` // GitHub only; the others send a zero "after"
+	Commits      []gitCommit `json:"commits"`
+	TotalCommits int         `json:"total_commits_count"` // GitLab only
+}
+
+type gitCommit struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// GitPush handles POST /v1/hooks/git/{tenant}/{function}
+// The route is public: a delivery is authenticated by the function's
+// webhook secret, as an HMAC signature (GitHub, Gitea) or a token (GitLab).
+// A push to the function's branch that touches its path queues a build,
+// which is deployed when it succeeds.
+func (h *HookHandler) GitPush(w http.ResponseWriter, r *http.Request) {
+	namespace := chi.URLParam(r, "tenant")
+	name := chi.URLParam(r, "function")
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, "payload too large", nil)
+			return
+		}
+		respondError(w, http.StatusBadRequest, "failed to read payload", err)
+		return
+	}
+
+	// Functions that do not exist and those without a webhook look alike
+	function, secret, err := h.functionRepo.GetWithWebhookSecret(r.Context(), namespace, name)
+	if err != nil || secret == "" {
+		respondError(w, http.StatusNotFound, "webhook not found", nil)
+		return
+	}
+
+	host, event, err := verifyGitHook(r, body, secret)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "webhook not verified", err)
+		return
+	}
+
+	if event != "push" && event != "Push Hook" {
+		respondJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("ignored %s event", event)})
+		return
+	}
+
+	var push gitPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid push payload", err)
+		return
+	}
+
+	if reason := skipPush(function, push); reason != "" {
+		respondJSON(w, http.StatusOK, map[string]string{"message": "push ignored: " + reason})
+		return
+	}
+
+	job, status, err := h.queueRebuild(r.Context(), function)
+	if err != nil {
+		respondError(w, status, "failed to queue build", err)
+		return
+	}
+
+	log.Printf("Push of %s to %s/%s on %s queued build %s", push.After, namespace, name, host, job.ID)
+
+	statusURL := "/v1/builds/" + job.ID
+	w.Header().Set("Location", statusURL)
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":       "Build queued",
+		"function_name": job.FunctionName,
+		"build_id":      job.ID,
+		"commit":        push.After,
+		"status":        job.Status,
+		"status_url":    statusURL,
+	})
+}
+
+// GetWebhook handles GET /v1/functions/{name}/webhook
+func (h *HookHandler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	function, ok := h.webhookFunction(w, r)
+	if !ok {
+		return
+	}
+
+	_, secret, err := h.functionRepo.GetWithWebhookSecret(r.Context(), function.Namespace, function.Name)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to get webhook secret", err)
+		return
+	}
+	if secret == "" {
+		respondError(w, http.StatusNotFound, "webhook not created; POST /v1/functions/"+function.Name+"/webhook creates it", nil)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, h.webhook(function, secret))
+}
+
+// CreateWebhook handles POST /v1/functions/{name}/webhook
+// A function that has a webhook keeps its secret.
+func (h *HookHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	h.storeWebhook(w, r, false)
+}
+
+// RotateWebhook handles POST /v1/functions/{name}/webhook:rotate
+// Deliveries signed with the previous secret are rejected from now on.
+func (h *HookHandler) RotateWebhook(w http.ResponseWriter, r *http.Request) {
+	h.storeWebhook(w, r, true)
+}
+
+// storeWebhook stores a new secret for a git function's webhook when it has
+// none or rotate is set, and responds with the webhook
+func (h *HookHandler) storeWebhook(w http.ResponseWriter, r *http.Request, rotate bool) {
+	function, ok := h.webhookFunction(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to generate webhook secret", err)
+		return
+	}
+	stored, err := h.functionRepo.SetWebhookSecret(r.Context(), function.UserID, function.Namespace, function.Name, secret, rotate)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to store webhook secret", err)
+		return
+	}
+
+	status := http.StatusOK
+	if stored == secret {
+		status = http.StatusCreated
+	}
+	respondJSON(w, status, h.webhook(function, stored))
+}
+
+// webhookFunction looks up the function a webhook request is about. It
+// responds with the error and returns false when the function cannot have a
+// push webhook.
+func (h *HookHandler) webhookFunction(w http.ResponseWriter, r *http.Request) (*models.Function, bool) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return nil, false
+	}
+
+	name := chi.URLParam(r, "name")
+
+	function, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
+		return nil, false
+	}
+	if function.DeploymentType != "git" {
+		respondError(w, http.StatusBadRequest, "only git functions have a push webhook", nil)
+		return nil, false
+	}
+	return function, true
+}
+
+// webhook describes the webhook of a git function
+func (h *HookHandler) webhook(function *models.Function, secret string) models.FunctionWebhook {
+	return models.FunctionWebhook{
+		URL:    fmt.Sprintf("%s/v1/hooks/git/%s/%s", h.publicURL, function.Namespace, function.Name),
+		Secret: secret,
+		Branch: function.GitBranch,
+		Path:   function.GitPath,
+	}
+}
+
+// queueRebuild queues a build of a git function's branch with the runtime,
+// requested strategy and timeout of its last build. A private repository is cloned
+// with the credentials kept for the function.
+func (h *HookHandler) queueRebuild(ctx context.Context, function *models.Function) (*database.BuildJob, int, error) {
+	buildID := uuid.New().String()
+	job := &database.BuildJob{
+		ID:           buildID,
+		FunctionName: function.Name,
+		UserID:       function.UserID,
+		Namespace:    function.Namespace,
+		SourceType:   "git",
+		GitURL:       function.GitURL,
+		GitRef:       function.GitBranch,
+		GitPath:      function.GitPath,
+		ImageRef:     buildImageRef(h.registry, function, buildID),
+	}
+	req := events.BuildRequest{Source: function.GitURL}
+
+	builds, err := h.buildRepo.GetByFunction(ctx, function.Name, function.Namespace)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(builds) > 0 {
+		last := builds[0]
+		job.Runtime = last.Runtime
+		job.TimeoutSecs = last.TimeoutSecs
+		// The strategy asked for, not the one used: a push may bring a
+		// Dockerfile that changes what auto picks
+		job.BuildStrategy = last.BuildStrategy
+		req.Prefer = last.BuildStrategy
+	}
+
+	if function.GitPrivate {
+		secret, status, err := copyFunctionGitAuth(ctx, h.k8sClient, h.buildNS, buildID, function.Namespace, function.Name)
+		if err != nil {
+			return nil, status, err
+		}
+		req.GitAuthSecret = secret
+	}
+
+	job, status, err := submitBuild(ctx, h.buildRepo, h.publisher, job, req)
+	if err != nil {
+		dropGitAuth(ctx, h.k8sClient, h.buildNS, buildID, req.GitAuthSecret)
+	}
+	return job, status, err
+}
+
+// verifyGitHook checks that a webhook delivery was signed with the
+// function's secret. It returns the git host it came from and its event.
+func verifyGitHook(r *http.Request, body []byte, secret string) (host, event string, err error) {
+	switch {
+	case r.Header.Get("X-Gitea-Event") != "":
+		// Gitea sends GitHub's headers as well, so it is recognized first
+		return "gitea", r.Header.Get("X-Gitea-Event"), verifySignature(body, secret, r.Header.Get("X-Gitea-Signature"))
+
+	case r.Header.Get("X-GitHub-Event") != "":
+		signature, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !found {
+			return "", "", errors.New("missing X-Hub-Signature-256 header")
+		}
+		return "github", r.Header.Get("X-GitHub-Event"), verifySignature(body, secret, signature)
+
+	case r.Header.Get("X-Gitlab-Event") != "":
+		// GitLab does not sign deliveries; it sends the secret as a token
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+			return "", "", errors.New("invalid token")
+		}
+		return "gitlab", r.Header.Get("X-Gitlab-Event"), nil
+	}
+	return "", "", errors.New("not a GitHub, GitLab or Gitea delivery")
+}
+
+// verifySignature checks a hex HMAC-SHA256 signature of a payload
+func verifySignature(body []byte, secret, signature string) error {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// skipPush returns why a push does not rebuild a function, or "" when it does
+func skipPush(function *models.Function, push gitPush) string {
+	if push.Ref != "refs/heads/"+function.GitBranch {
+		return fmt.Sprintf("%s is not branch %s", push.Ref, function.GitBranch)
+	}
+	if push.Deleted || push.After == deletedCommit {
+		return "the branch was deleted"
+	}
+
+	dir := strings.Trim(path.Clean("/"+function.GitPath), "/")
+	if dir == "" {
+		return ""
+	}
+	// A push without commits moved the branch, and one listing the most
+	// commits a payload holds may have touched the path in a commit left out
+	if len(push.Commits) == 0 || len(push.Commits) >= payloadCommitLimit || push.TotalCommits > len(push.Commits) {
+		return ""
+	}
+	for _, commit := range push.Commits {
+		for _, files := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range files {
+				if file == dir || strings.HasPrefix(file, dir+"/") {
+					return ""
+				}
+			}
+		}
+	}
+	return "nothing under " + dir + " changed"
+}
+
+// newWebhookSecret returns a random secret for a function's webhook
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eventflow/api/internal/models"
+)
+
+const testWebhookSecret = "s3cret"
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyGitHook(t *testing.T) {
+	body := `{"ref":"refs/heads/main"}`
+	good := sign(body, testWebhookSecret)
+	bad := sign(body, "other")
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		host    string
+		event   string
+		wantErr bool
+	}{
+		{
+			name:    "github",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + good},
+			host:    "github",
+			event:   "push",
+		},
+		{
+			name:    "github uppercase signature",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + strings.ToUpper(good)},
+			host:    "github",
+			event:   "push",
+		},
+		{
+			name:    "github wrong secret",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + bad},
+			wantErr: true,
+		},
+		{
+			name:    "github missing signature",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			wantErr: true,
+		},
+		{
+			name:    "github sha1 signature only",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature": "sha1=" + good},
+			wantErr: true,
+		},
+		{
+			name:    "github signature without prefix",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": good},
+			wantErr: true,
+		},
+		{
+			// Gitea also sends GitHub's headers; its own signature decides
+			name: "gitea",
+			headers: map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": good,
+				"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + bad},
+			host:  "gitea",
+			event: "push",
+		},
+		{
+			name:    "gitea wrong secret",
+			headers: map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": bad},
+			wantErr: true,
+		},
+		{
+			name:    "gitea missing signature",
+			headers: map[string]string{"X-Gitea-Event": "push"},
+			wantErr: true,
+		},
+		{
+			name:    "gitlab",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": testWebhookSecret},
+			host:    "gitlab",
+			event:   "Push Hook",
+		},
+		{
+			name:    "gitlab wrong token",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "other"},
+			wantErr: true,
+		},
+		{
+			name:    "gitlab missing token",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook"},
+			wantErr: true,
+		},
+		{
+			name:    "gitlab signature instead of token",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": good},
+			wantErr: true,
+		},
+		{
+			name:    "unknown host",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + good},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/hooks/git/tenant-alice/hello", strings.NewReader(body))
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			host, event, err := verifyGitHook(r, []byte(body), testWebhookSecret)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("verifyGitHook() = %q, %q, want an error", host, event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyGitHook() error = %v", err)
+			}
+			if host != tt.host || event != tt.event {
+				t.Errorf("verifyGitHook() = %q, %q, want %q, %q", host, event, tt.host, tt.event)
+			}
+		})
+	}
+}
+
+func TestVerifyGitHookRejectsAlteredBody(t *testing.T) {
+	body := `{"ref":"refs/heads/main"}`
+	r := httptest.NewRequest("POST", "/v1/hooks/git/tenant-alice/hello", nil)
+	r.Header.Set("X-GitHub-Event", "push")
+	r.Header.Set("X-Hub-Signature-256", "sha256="+sign(body, testWebhookSecret))
+
+	if _, _, err := verifyGitHook(r, []byte(`{"ref":"refs/heads/prod"}`), testWebhookSecret); err == nil {
+		t.Error("verifyGitHook() accepted a body the signature was not made for")
+	}
+}
+
+func TestSkipPush(t *testing.T) {
+	commits := func(files ...string) []gitCommit {
+		return []gitCommit{{Modified: files}}
+	}
+	manyCommits := make([]gitCommit, payloadCommitLimit)
+	for i := range manyCommits {
+		manyCommits[i] = gitCommit{Modified: []string{fmt.Sprintf("docs/%d.md", i)}}
+	}
+	after := "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678"
+
+	tests := []struct {
+		name  string
+		path  string
+		push  gitPush
+		built bool
+	}{
+		{
+			name:  "branch, no path",
+			path:  "./",
+			push:  gitPush{Ref: "refs/heads/main", After: after, Commits: commits("README.md")},
+			built: true,
+		},
+		{
+			name: "other branch",
+			path: "./",
+			push: gitPush{Ref: "refs/heads/feature", After: after, Commits: commits("README.md")},
+		},
+		{
+			name: "tag of the branch name",
+			path: "./",
+			push: gitPush{Ref: "refs/tags/main", After: after},
+		},
+		{
+			name: "github branch deletion",
+			path: "./",
+			push: gitPush{Ref: "refs/heads/main", After: deletedCommit, Deleted: true},
+		},
+		{
+			name: "gitlab branch deletion",
+			path: "./",
+			push: gitPush{Ref: "refs/heads/main", After: deletedCommit},
+		},
+		{
+			name:  "file under path",
+			path:  "services/hello",
+			push:  gitPush{Ref: "refs/heads/main", After: after, Commits: commits("services/hello/main.go")},
+			built: true,
+		},
+		{
+			name:  "path added",
+			path:  "./services/hello/",
+			push:  gitPush{Ref: "refs/heads/main", After: after, Commits: []gitCommit{{Added: []string{"services/hello/go.mod"}}}},
+			built: true,
+		},
+		{
+			name:  "file removed from path",
+			path:  "services/hello",
+			push:  gitPush{Ref: "refs/heads/main", After: after, Commits: []gitCommit{{Removed: []string{"services/hello/old.go"}}}},
+			built: true,
+		},
+		{
+			name: "files outside path",
+			path: "services/hello",
+			push: gitPush{Ref: "refs/heads/main", After: after, Commits: commits("services/other/main.go", "README.md")},
+		},
+		{
+			name: "sibling with the path as prefix",
+			path: "services/hello",
+			push: gitPush{Ref: "refs/heads/main", After: after, Commits: commits("services/hello-v2/main.go")},
+		},
+		{
+			name:  "no commits listed",
+			path:  "services/hello",
+			push:  gitPush{Ref: "refs/heads/main", After: after},
+			built: true,
+		},
+		{
+			name:  "payload truncated at the commit limit",
+			path:  "services/hello",
+			push:  gitPush{Ref: "refs/heads/main", After: after, Commits: manyCommits},
+			built: true,
+		},
+		{
+			name:  "gitlab total beyond the listed commits",
+			path:  "services/hello",
+			push:  gitPush{Ref: "refs/heads/main", After: after, Commits: commits("README.md"), TotalCommits: 30},
+			built: true,
+		},
+		{
+			name: "below the commit limit",
+			path: "services/hello",
+			push: gitPush{Ref: "refs/heads/main", After: after, Commits: manyCommits[:payloadCommitLimit-1]},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			function := &models.Function{Name: "hello", GitBranch: "main", GitPath: tt.path}
+			reason := skipPush(function, tt.push)
+			if tt.built && reason != "" {
+				t.Errorf("skipPush() = %q, want the push built", reason)
+			}
+			if !tt.built && reason == "" {
+				t.Error("skipPush() built the push, want it skipped")
+			}
+		})
+	}
+}
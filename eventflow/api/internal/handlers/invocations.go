@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eventflow/api/internal/auth"
+	"github.com/eventflow/api/internal/events"
+	"github.com/eventflow/api/internal/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// maxInvokeBodySize caps the payload accepted by an invocation (6 MiB)
+const maxInvokeBodySize = 6 << 20
+
+// hopByHopHeaders are connection-scoped and must not be proxied
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+func isHopByHopHeader(key string) bool {
+	return hopByHopHeaders[http.CanonicalHeaderKey(key)]
+}
+
+// forwardHeaders copies the caller's headers for the function, dropping
+// hop-by-hop headers and the caller's EventFlow credentials
+func forwardHeaders(header http.Header) http.Header {
+	forwarded := make(http.Header, len(header))
+	for key, values := range header {
+		if isHopByHopHeader(key) || strings.EqualFold(key, "Authorization") || strings.EqualFold(key, "Cookie") {
+			continue
+		}
+		forwarded[key] = append([]string(nil), values...)
+	}
+	return forwarded
+}
+
+// invocationPayload returns the body as JSON for the invocations table,
+// or nil when the body is empty or not valid JSON
+func invocationPayload(body []byte) json.RawMessage {
+	if len(body) == 0 || !json.Valid(body) {
+		return nil
+	}
+	return json.RawMessage(body)
+}
+
+// wantsAsync reports whether the caller asked for an asynchronous invocation
+func wantsAsync(r *http.Request) bool {
+	if async, err := strconv.ParseBool(r.URL.Query().Get("async")); err == nil {
+		return async
+	}
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardQuery returns the caller's query string without EventFlow's own parameters
+func forwardQuery(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("async") {
+		return r.URL.RawQuery
+	}
+	query.Del("async")
+	return query.Encode()
+}
+
+// invokeAsync records a pending invocation, queues it on JetStream for the
+// dispatcher and answers 202 with the invocation ID
+func (h *FunctionHandler) invokeAsync(w http.ResponseWriter, r *http.Request, claims *auth.Claims, function *models.Function, body []byte) {
+	if h.publisher == nil {
+		respondError(w, http.StatusServiceUnavailable, "asynchronous invocation requires NATS", nil)
+		return
+	}
+
+	invocation := &models.Invocation{
+		FunctionName: function.Name,
+		EventType:    events.EventTypeInvoke,
+		Payload:      invocationPayload(body),
+		Status:       "pending",
+		StartedAt:    time.Now(),
+	}
+	if err := h.functionRepo.RecordInvocation(r.Context(), claims.UserID, claims.Namespace, invocation); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to record invocation", err)
+		return
+	}
+
+	payload := events.InvocationPayload(invocation.ID, function.Namespace, r.Method, forwardQuery(r), forwardHeaders(r.Header), body)
+	if err := h.publisher.PublishWithMetadata(events.EventTypeInvoke, function.Name, function.Image, function.Command, payload); err != nil {
+		if updateErr := h.functionRepo.UpdateInvocationStatus(r.Context(), invocation.ID, "failed", err.Error()); updateErr != nil {
+			log.Printf("Warning: failed to mark invocation %s as failed: %v", invocation.ID, updateErr)
+		}
+		respondError(w, http.StatusServiceUnavailable, "failed to queue invocation", err)
+		return
+	}
+
+	location := fmt.Sprintf("/v1/functions/%s/invocations/%s", function.Name, invocation.ID)
+	w.Header().Set("Location", location)
+	w.Header().Set("Preference-Applied", "respond-async")
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"invocation_id": invocation.ID,
+		"status":        invocation.Status,
+		"status_url":    location,
+	})
+}
+
+// GetInvocation handles GET /v1/functions/{name}/invocations/{id}
+func (h *FunctionHandler) GetInvocation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	id := chi.URLParam(r, "id")
+
+	invocation, err := h.functionRepo.GetInvocation(r.Context(), claims.UserID, claims.Namespace, name, id)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "invocation not found", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, invocation)
+}
+
+// ListInvocations handles GET /v1/functions/{name}/invocations
+func (h *FunctionHandler) ListInvocations(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid limit", err)
+		return
+	}
+
+	invocations, nextPageToken, err := h.functionRepo.ListInvocations(r.Context(), claims.UserID, claims.Namespace, name, limit, r.URL.Query().Get("page_token"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "failed to list invocations", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.InvocationList{
+		Invocations:   invocations,
+		NextPageToken: nextPageToken,
+	})
+}
+
+// parseLimit reads the optional ?limit= query parameter
+func parseLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("limit must be a non-negative integer")
+	}
+	return limit, nil
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/eventflow/api/internal/auth"
+	"github.com/eventflow/api/internal/k8s"
+	"github.com/eventflow/api/internal/models"
+	"github.com/eventflow/api/internal/watch"
+	"github.com/go-chi/chi/v5"
+)
+
+// ListRevisions handles GET /v1/functions/{name}/revisions
+func (h *FunctionHandler) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+
+	if _, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace); err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
+		return
+	}
+
+	revisions, err := h.functionRepo.ListRevisions(r.Context(), claims.UserID, claims.Namespace, name)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to list revisions", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, revisions)
+}
+
+// RollbackFunction handles POST /v1/functions/{name}:rollback?revision=N
+// The revision's spec is re-applied and recorded as a new revision.
+func (h *FunctionHandler) RollbackFunction(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+
+	revisionNumber, err := strconv.Atoi(r.URL.Query().Get("revision"))
+	if err != nil || revisionNumber < 1 {
+		respondError(w, http.StatusBadRequest, "revision must be a positive integer", nil)
+		return
+	}
+
+	function, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
+		return
+	}
+
+	revision, err := h.functionRepo.GetRevision(r.Context(), claims.UserID, claims.Namespace, name, revisionNumber)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "revision not found", err)
+		return
+	}
+
+	// Revisions recorded before a built function's first build have no image
+	if revision.Image == "" {
+		respondError(w, http.StatusBadRequest, "revision has no image to roll back to", nil)
+		return
+	}
+
+	previous := *function
+	function.Image = revision.Image
+	function.Command = revision.Command
+	function.Args = revision.Args
+	function.Env = revision.Env
+	function.Replicas = revision.Replicas
+	function.Resources = revision.Resources
+
+	updated, status, err := h.applySpec(r.Context(), claims, &previous, function, fmt.Sprintf("rollback to revision %d", revisionNumber))
+	if err != nil {
+		respondError(w, status, "failed to roll back function", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, updated)
+}
+
+// applySpec persists a function's new spec and metadata (recording a
+// revision) and patches the Function CR so the operator rolls the Deployment.
+// previous is the function before the change. It returns the HTTP status to
+// report when it fails.
+func (h *FunctionHandler) applySpec(ctx context.Context, claims *auth.Claims, previous, function *models.Function, changeCause string) (*models.Function, int, error) {
+	updated, err := h.functionRepo.Update(ctx, claims.UserID, claims.Namespace, function, changeCause)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database: %w", err)
+	}
+
+	// A missing CR means the function is undeployed or still building; the
+	// next deploy picks up the new spec from the database.
+	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
+		if err := h.k8sClient.UpdateFunctionCR(ctx, previous, updated); err != nil && !k8s.IsNotFound(err) {
+			return nil, http.StatusInternalServerError, fmt.Errorf("kubernetes: %w", err)
+		}
+	}
+
+	h.watchHub.Publish(watch.Event{Type: watch.Modified, Namespace: updated.Namespace, Name: updated.Name})
+	return updated, http.StatusOK, nil
+}
+
+// applyMetadata persists a function's new labels, annotations and description
+// without recording a revision, and copies the labels and annotations onto the
+// Function CR. It returns the HTTP status to report when it fails.
+func (h *FunctionHandler) applyMetadata(ctx context.Context, claims *auth.Claims, previous, function *models.Function) (*models.Function, int, error) {
+	updated, err := h.functionRepo.UpdateMetadata(ctx, claims.UserID, claims.Namespace, function)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database: %w", err)
+	}
+
+	if h.k8sClient != nil && h.k8sClient.HasKubernetes() {
+		if err := h.k8sClient.UpdateFunctionCR(ctx, previous, updated); err != nil && !k8s.IsNotFound(err) {
+			return nil, http.StatusInternalServerError, fmt.Errorf("kubernetes: %w", err)
+		}
+	}
+
+	h.watchHub.Publish(watch.Event{Type: watch.Modified, Namespace: updated.Namespace, Name: updated.Name})
+	return updated, http.StatusOK, nil
+}
+
+// sameMetadata reports whether two functions have the same labels,
+// annotations and description
+func sameMetadata(a, b *models.Function) bool {
+	return a.Description == b.Description &&
+		sameValues(a.Labels, b.Labels, len(a.Labels), len(b.Labels)) &&
+		sameValues(a.Annotations, b.Annotations, len(a.Annotations), len(b.Annotations))
+}
+
+// sameSpec reports whether two functions have the same deployable spec
+func sameSpec(a, b *models.Function) bool {
+	return a.Image == b.Image &&
+		a.Replicas == b.Replicas &&
+		sameValues(a.Command, b.Command, len(a.Command), len(b.Command)) &&
+		sameValues(a.Args, b.Args, len(a.Args), len(b.Args)) &&
+		sameValues(a.Env, b.Env, len(a.Env), len(b.Env)) &&
+		reflect.DeepEqual(a.Resources, b.Resources)
+}
+
+// sameValues compares two slices or maps, treating nil and empty as equal
+func sameValues(a, b interface{}, lenA, lenB int) bool {
+	if lenA == 0 && lenB == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eventflow/api/internal/artifacts"
+	"github.com/eventflow/api/internal/auth"
+	"github.com/eventflow/api/internal/database"
+	"github.com/eventflow/api/internal/events"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// maxSourceUploadBytes bounds an uploaded source archive
+const maxSourceUploadBytes = 100 * 1024 * 1024
+
+// sourceTransferTimeout bounds receiving an uploaded archive and sending one
+// to a build Job: the largest archive at 256 KiB/s. Both outlive the server's
+// read and write timeouts.
+const sourceTransferTimeout = maxSourceUploadBytes / (256 * 1024) * time.Second
+
+// sourceURLTTL is how long the URL a build downloads its source from stays
+// valid. It outlives the time a build may wait in the queue.
+const sourceURLTTL = 24 * time.Hour
+
+// sourceFormats maps the magic bytes of the accepted archive formats to the
+// extension they are stored with
+var sourceFormats = []struct {
+	magic     []byte
+	extension string
+}{
+	{[]byte{0x1f, 0x8b}, "tar.gz"},
+	{[]byte("PK\x03\x04"), "zip"},
+}
+
+type SourceHandler struct {
+	functionRepo *database.FunctionRepository
+	buildRepo    *database.BuildJobRepository
+	publisher    *events.Publisher
+	artifacts    artifacts.Store
+	signer       *artifacts.Signer
+	registry     string // where built function images are pushed
+}
+
+func NewSourceHandler(functionRepo *database.FunctionRepository, buildRepo *database.BuildJobRepository,
+	publisher *events.Publisher, store artifacts.Store, signer *artifacts.Signer, registry string) *SourceHandler {
+	return &SourceHandler{
+		functionRepo: functionRepo,
+		buildRepo:    buildRepo,
+		publisher:    publisher,
+		artifacts:    store,
+		signer:       signer,
+		registry:     registry,
+	}
+}
+
+// UploadSource handles POST /v1/functions/{name}/source
+// The body is a .tar.gz or .zip archive, sent as is or as the "file" field of
+// a multipart form. The archive is stored by its SHA-256 and built, and the
+// function is deployed when the build completes. The runtime, build_strategy
+// and path query parameters pick the runtime, strategy and directory to
+// build.
+func (h *SourceHandler) UploadSource(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	if h.artifacts == nil {
+		respondError(w, http.StatusServiceUnavailable, "artifact store not configured", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	function, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
+		return
+	}
+
+	query := r.URL.Query()
+	strategy := query.Get("build_strategy")
+	if strategy != "" && !buildStrategies[strategy] {
+		respondError(w, http.StatusBadRequest, "invalid build_strategy. Must be: auto, cnb, pack, kaniko, or buildkit", nil)
+		return
+	}
+	sourcePath := query.Get("path")
+	if sourcePath == "" || sourcePath == "." {
+		sourcePath = "./"
+	}
+	if sourcePath != "./" && !validSourcePath(sourcePath) {
+		respondError(w, http.StatusBadRequest, "invalid path", fmt.Errorf("path %q is outside the source", sourcePath))
+		return
+	}
+
+	// Large archives take longer than the server's timeouts to arrive
+	deadline := time.Now().Add(sourceTransferTimeout)
+	rc := http.NewResponseController(w)
+	if err := errors.Join(rc.SetReadDeadline(deadline), rc.SetWriteDeadline(deadline)); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to extend upload deadline", err)
+		return
+	}
+
+	body, err := sourceBody(w, r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid upload", err)
+		return
+	}
+
+	// Spool the archive to disk, hashing it on the way
+	tmp, err := os.CreateTemp("", "source-*")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to store source", err)
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("source archive exceeds %d bytes", maxSourceUploadBytes), nil)
+			return
+		}
+		respondError(w, http.StatusBadRequest, "failed to read upload", err)
+		return
+	}
+
+	header := make([]byte, 4)
+	n, _ := tmp.ReadAt(header, 0)
+	extension := sourceFormat(header[:n])
+	if extension == "" {
+		respondError(w, http.StatusBadRequest, "source must be a .tar.gz or .zip archive", nil)
+		return
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	key := fmt.Sprintf("sources/%s/%s/%s.%s", function.Namespace, function.Name, digest, extension)
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to store source", err)
+		return
+	}
+	if err := h.artifacts.Put(r.Context(), key, tmp, size); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to store source", err)
+		return
+	}
+
+	runtime := query.Get("runtime")
+	if runtime == "" {
+		runtime = h.lastRuntime(r, function.Name, function.Namespace)
+	}
+
+	buildID := uuid.New().String()
+	job, status, err := submitBuild(r.Context(), h.buildRepo, h.publisher, &database.BuildJob{
+		ID:            buildID,
+		FunctionName:  function.Name,
+		UserID:        function.UserID,
+		Namespace:     function.Namespace,
+		SourceType:    "tar",
+		Runtime:       runtime,
+		GitPath:       sourcePath,
+		ArtifactKey:   key,
+		SourceDigest:  "sha256:" + digest,
+		ImageRef:      buildImageRef(h.registry, function, buildID),
+		BuildStrategy: strategy,
+	}, events.BuildRequest{
+		Source: h.signer.URL(key, sourceURLTTL),
+		Prefer: strategy,
+	})
+	if err != nil {
+		respondError(w, status, "failed to queue build", err)
+		return
+	}
+
+	log.Printf("Stored source %s of %s/%s (%d bytes) for build %s", job.SourceDigest, function.Namespace, function.Name, size, job.ID)
+
+	statusURL := "/v1/builds/" + job.ID
+	w.Header().Set("Location", statusURL)
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":       "Build queued",
+		"function_name": function.Name,
+		"build_id":      job.ID,
+		"status":        job.Status,
+		"status_url":    statusURL,
+		"source_digest": job.SourceDigest,
+	})
+}
+
+// ServeArtifact handles GET /internal/artifacts/*
+// Build Jobs download their source here; the URL's signature stands in for
+// credentials.
+func (h *SourceHandler) ServeArtifact(w http.ResponseWriter, r *http.Request) {
+	if h.artifacts == nil {
+		respondError(w, http.StatusServiceUnavailable, "artifact store not configured", nil)
+		return
+	}
+
+	key := chi.URLParam(r, "*")
+	query := r.URL.Query()
+	if err := h.signer.Verify(key, query.Get("expires"), query.Get("signature")); err != nil {
+		respondError(w, http.StatusForbidden, "access denied", err)
+		return
+	}
+
+	artifact, err := h.artifacts.Open(r.Context(), key)
+	if errors.Is(err, artifacts.ErrNotFound) {
+		respondError(w, http.StatusNotFound, "artifact not found", nil)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to open artifact", err)
+		return
+	}
+	defer artifact.Close()
+
+	// The archive takes longer than the server's write timeout to send
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(sourceTransferTimeout)); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to extend download deadline", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, artifact); err != nil {
+		log.Printf("Warning: failed to send artifact %s: %v", key, err)
+	}
+}
+
+// IsSourceTransfer reports whether r uploads a source archive or downloads
+// one for a build, which must not be cut short by request timeouts
+func IsSourceTransfer(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost:
+		return strings.HasPrefix(r.URL.Path, "/v1/functions/") && strings.HasSuffix(r.URL.Path, "/source")
+	case http.MethodGet:
+		return strings.HasPrefix(r.URL.Path, artifacts.URLPrefix)
+	}
+	return false
+}
+
+// sourceBody returns the uploaded archive: the "file" part of a multipart
+// form, or else the request body, limited to maxSourceUploadBytes
+func sourceBody(w http.ResponseWriter, r *http.Request) (io.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSourceUploadBytes)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.Body, nil
+	}
+
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("multipart form has no file field")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// sourceFormat returns the extension of the archive format an upload starts
+// with, or "" when it is not an accepted archive
+func sourceFormat(header []byte) string {
+	for _, format := range sourceFormats {
+		if bytes.HasPrefix(header, format.magic) {
+			return format.extension
+		}
+	}
+	return ""
+}
+
+// lastRuntime returns the runtime of a function's latest build that named
+// one, so uploads need not repeat it
+func (h *SourceHandler) lastRuntime(r *http.Request, name, namespace string) string {
+	jobs, err := h.buildRepo.GetByFunction(r.Context(), name, namespace)
+	if err != nil {
+		return ""
+	}
+	for _, job := range jobs {
+		if job.Runtime != "" {
+			return job.Runtime
+		}
+	}
+	return ""
+}
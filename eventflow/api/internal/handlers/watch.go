@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eventflow/api/internal/auth"
+	"github.com/eventflow/api/internal/database"
+	"github.com/eventflow/api/internal/models"
+	"github.com/eventflow/api/internal/watch"
+	"github.com/go-chi/chi/v5"
+)
+
+// watchHeartbeat is how often an idle watch stream sends a comment line so
+// proxies and load balancers keep it open
+const watchHeartbeat = 30 * time.Second
+
+// IsWatchRequest reports whether r opens a watch or build log stream, which
+// must not be cut short by request timeouts
+func IsWatchRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	return r.URL.Query().Get("watch") == "true" ||
+		strings.HasSuffix(r.URL.Path, "/watch") ||
+		strings.HasSuffix(r.URL.Path, "/logs/stream")
+}
+
+// watchEvent is one Server-Sent Event of a watch stream
+type watchEvent struct {
+	Type   watch.EventType       `json:"type"`
+	Object models.FunctionStatus `json:"object"`
+}
+
+// WatchFunction handles GET /v1/functions/{name}/watch
+func (h *FunctionHandler) WatchFunction(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "user not authenticated", nil)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+
+	if _, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace); err != nil {
+		respondError(w, http.StatusNotFound, "function not found", err)
+		return
+	}
+
+	h.watchFunctions(w, r, claims, name)
+}
+
+// watchFunctions streams ADDED, MODIFIED and DELETED events for the user's
+// functions (or only the named one) as Server-Sent Events. The stream starts
+// with an ADDED event per existing function, then sends the full status each
+// time it changes in the cluster or the database.
+func (h *FunctionHandler) watchFunctions(w http.ResponseWriter, r *http.Request, claims *auth.Claims, name string) {
+	if h.watchHub == nil {
+		respondError(w, http.StatusServiceUnavailable, "watch not available", nil)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "streaming not supported", nil)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		respondError(w, http.StatusInternalServerError, "streaming not supported", err)
+		return
+	}
+
+	// Subscribe before the snapshot so no change is missed in between
+	events, unsubscribe := h.watchHub.Subscribe(claims.Namespace)
+	defer unsubscribe()
+
+	var snapshot []*models.Function
+	if name != "" {
+		fn, err := h.functionRepo.Get(r.Context(), claims.UserID, name, claims.Namespace)
+		if err != nil {
+			respondError(w, http.StatusNotFound, "function not found", err)
+			return
+		}
+		snapshot = append(snapshot, fn)
+	} else {
+		opts := database.ListFunctionsOptions{Limit: database.MaxPageSize, SortBy: "name", Ascending: true}
+		for {
+			page, next, _, err := h.functionRepo.List(r.Context(), claims.UserID, opts)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, "failed to list functions", err)
+				return
+			}
+			snapshot = append(snapshot, page...)
+			if next == "" {
+				break
+			}
+			opts.PageToken = next
+		}
+	}
+
+	// Set headers for streaming
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Last status sent per function, so repeated cluster events that don't
+	// change what the client sees are not resent
+	sent := make(map[string][]byte)
+	send := func(eventType watch.EventType, status models.FunctionStatus) bool {
+		data, err := json.Marshal(watchEvent{Type: eventType, Object: status})
+		if err != nil {
+			return true
+		}
+		if previous, ok := sent[status.Name]; ok && bytes.Equal(previous, data) {
+			return true
+		}
+		sent[status.Name] = data
+		if _, err := w.Write([]byte("data: " + string(data) + "\n\n")); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for _, fn := range snapshot {
+		if !send(watch.Added, h.functionStatus(fn)) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case event, ok := <-events:
+			if !ok {
+				// Fell too far behind; the client reconnects for a new snapshot
+				return
+			}
+			if name != "" && event.Name != name {
+				continue
+			}
+
+			if event.Type == watch.Deleted {
+				if !send(watch.Deleted, models.FunctionStatus{Name: event.Name, Namespace: event.Namespace}) {
+					return
+				}
+				delete(sent, event.Name)
+				if name != "" {
+					return
+				}
+				continue
+			}
+
+			// Cluster events carry no owner; reading through the user's
+			// scope keeps other tenants' functions out of the stream
+			fn, err := h.functionRepo.Get(r.Context(), claims.UserID, event.Name, claims.Namespace)
+			if err != nil {
+				continue
+			}
+			eventType := event.Type
+			if _, seen := sent[fn.Name]; !seen {
+				eventType = watch.Added
+			}
+			if !send(eventType, h.functionStatus(fn)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/eventflow/api/internal/models"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// cacheResync is how often the informers replay their whole cache
+const cacheResync = 10 * time.Minute
+
+// cacheSyncTimeout bounds the initial list of Function CRs and Deployments
+const cacheSyncTimeout = 30 * time.Second
+
+// functionSelector matches the Deployments the operator creates for functions
+const functionSelector = "app=eventflow-function"
+
+// FunctionState is the observed state of a function, as reported by the
+// operator on the Function CR and by the function's Deployment
+type FunctionState struct {
+	Phase             string // Pending, Running, Failed
+	Conditions        []models.Condition
+	Replicas          int32
+	ReadyReplicas     int32
+	AvailableReplicas int32
+	UpdatedReplicas   int32
+}
+
+// StatusHandlers are notified of changes seen by the status cache
+type StatusHandlers struct {
+	// OnPhaseChange is called for every new phase the operator reports
+	OnPhaseChange func(namespace, name, phase string)
+	// OnChange is called whenever a function's CR or Deployment changes
+	OnChange func(namespace, name string)
+}
+
+// statusCache keeps Function CRs and their Deployments in memory so status
+// lookups don't hit the API server
+type statusCache struct {
+	functions   cache.GenericLister
+	deployments appslisters.DeploymentLister
+}
+
+// StartStatusCache starts informers for Function CRs and their Deployments
+// and waits for them to sync. It must be called before the client is shared.
+// It is a no-op in demo mode.
+func (c *Client) StartStatusCache(ctx context.Context, handlers StatusHandlers) error {
+	if c.clientset == nil || c.dynamicClient == nil {
+		return nil
+	}
+
+	dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(c.dynamicClient, cacheResync)
+	functionInformer := dynamicFactory.ForResource(functionGVR)
+
+	deploymentFactory := informers.NewSharedInformerFactoryWithOptions(c.clientset, cacheResync,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = functionSelector
+		}))
+	deploymentInformer := deploymentFactory.Apps().V1().Deployments()
+
+	_, err := functionInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			fn, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			if phase := functionPhase(fn); phase != "" && handlers.OnPhaseChange != nil {
+				handlers.OnPhaseChange(fn.GetNamespace(), fn.GetName(), phase)
+			}
+			notifyChange(handlers, fn.GetNamespace(), fn.GetName())
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldFn, ok := oldObj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			newFn, ok := newObj.(*unstructured.Unstructured)
+			if !ok || oldFn.GetResourceVersion() == newFn.GetResourceVersion() {
+				return // periodic resync
+			}
+			if phase := functionPhase(newFn); phase != "" && phase != functionPhase(oldFn) && handlers.OnPhaseChange != nil {
+				handlers.OnPhaseChange(newFn.GetNamespace(), newFn.GetName(), phase)
+			}
+			notifyChange(handlers, newFn.GetNamespace(), newFn.GetName())
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				if namespace, name, err := cache.SplitMetaNamespaceKey(key); err == nil {
+					notifyChange(handlers, namespace, name)
+				}
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch Function CRs: %w", err)
+	}
+
+	// Deployment status carries the replica counts
+	_, err = deploymentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			notifyDeploymentChange(handlers, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldDeployment, ok := oldObj.(*appsv1.Deployment)
+			if !ok {
+				return
+			}
+			newDeployment, ok := newObj.(*appsv1.Deployment)
+			if !ok || oldDeployment.ResourceVersion == newDeployment.ResourceVersion {
+				return // periodic resync
+			}
+			notifyDeploymentChange(handlers, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			notifyDeploymentChange(handlers, obj)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch Deployments: %w", err)
+	}
+
+	dynamicFactory.Start(ctx.Done())
+	deploymentFactory.Start(ctx.Done())
+
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), functionInformer.Informer().HasSynced, deploymentInformer.Informer().HasSynced) {
+		return fmt.Errorf("status cache did not sync within %s", cacheSyncTimeout)
+	}
+
+	c.cache = &statusCache{
+		functions:   functionInformer.Lister(),
+		deployments: deploymentInformer.Lister(),
+	}
+
+	log.Printf("✅ Kubernetes status cache synced")
+	return nil
+}
+
+// FunctionState returns the cached state of a function. It reports false when
+// the cache is not running or the function has no Function CR.
+func (c *Client) FunctionState(namespace, name string) (*FunctionState, bool) {
+	if c.cache == nil {
+		return nil, false
+	}
+
+	obj, err := c.cache.functions.ByNamespace(namespace).Get(name)
+	if err != nil {
+		return nil, false
+	}
+	fn, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, false
+	}
+
+	state := &FunctionState{
+		Phase: functionPhase(fn),
+	}
+	if state.Phase == "" {
+		state.Phase = "Pending"
+	}
+
+	var status struct {
+		Conditions []metav1.Condition `json:"conditions"`
+	}
+	if raw, ok := fn.Object["status"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err == nil {
+			for _, cond := range status.Conditions {
+				state.Conditions = append(state.Conditions, models.Condition{
+					Type:               cond.Type,
+					Status:             string(cond.Status),
+					Reason:             cond.Reason,
+					Message:            cond.Message,
+					LastTransitionTime: cond.LastTransitionTime.Time,
+				})
+			}
+		}
+	}
+
+	deployment, err := c.cache.deployments.Deployments(namespace).Get(deploymentName(name))
+	if err == nil {
+		state.Replicas = deployment.Status.Replicas
+		state.ReadyReplicas = deployment.Status.ReadyReplicas
+		state.AvailableReplicas = deployment.Status.AvailableReplicas
+		state.UpdatedReplicas = deployment.Status.UpdatedReplicas
+	}
+
+	return state, true
+}
+
+// notifyChange calls handlers.OnChange if it is set
+func notifyChange(handlers StatusHandlers, namespace, name string) {
+	if handlers.OnChange != nil {
+		handlers.OnChange(namespace, name)
+	}
+}
+
+// notifyDeploymentChange reports a change of a function's Deployment as a
+// change of the function, named by the Deployment's "function" label
+func notifyDeploymentChange(handlers StatusHandlers, obj interface{}) {
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	if name := deployment.Labels["function"]; name != "" {
+		notifyChange(handlers, deployment.Namespace, name)
+	}
+}
+
+// functionPhase reads status.phase from a Function CR
+func functionPhase(fn *unstructured.Unstructured) string {
+	phase, _, _ := unstructured.NestedString(fn.Object, "status", "phase")
+	return phase
+}
+
+// deploymentName is the name of the Deployment the operator creates for a function
+func deploymentName(function string) string {
+	return "fn-" + function
+}
@@ -2,11 +2,15 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/eventflow/api/internal/models"
@@ -18,15 +22,21 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// InvokeTimeout bounds a synchronous call to a function's Service
+const InvokeTimeout = 30 * time.Second
+
 type Client struct {
 	clientset     *kubernetes.Clientset
 	dynamicClient dynamic.Interface
+	httpClient    *http.Client
+	cache         *statusCache
 }
 
 // NewClient creates a new Kubernetes client
@@ -82,6 +92,9 @@ func NewClient() (*Client, error) {
 	return &Client{
 		clientset:     clientset,
 		dynamicClient: dynamicClient,
+		httpClient: &http.Client{
+			Timeout: InvokeTimeout,
+		},
 	}, nil
 }
 
@@ -187,7 +200,7 @@ func (c *Client) GetDeployment(ctx context.Context, namespace, name string) (*ap
 	if c.clientset == nil {
 		return nil, fmt.Errorf("demo mode: deployment %s not found", name)
 	}
-	return c.clientset.AppsV1().Deployments(namespace).Get(ctx, fmt.Sprintf("fn-%s", name), metav1.GetOptions{})
+	return c.clientset.AppsV1().Deployments(namespace).Get(ctx, deploymentName(name), metav1.GetOptions{})
 }
 
 // ListDeployments lists all function deployments
@@ -270,6 +283,155 @@ func (c *Client) CreateJob(ctx context.Context, namespace, name, image string, c
 	return err
 }
 
+// CreateGitAuthSecret stores the git credentials of a build as a Secret in
+// the builder's namespace, where the build Job mounts it. The builder deletes
+// the Secret once the Job is done with it.
+func (c *Client) CreateGitAuthSecret(ctx context.Context, namespace, buildID string, auth *models.GitAuth) (string, error) {
+	if c.clientset == nil {
+		return "", fmt.Errorf("demo mode: git credentials need Kubernetes")
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("build-%s-git-auth", buildID[:8]),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":      "builder",
+				"build-id": buildID,
+			},
+		},
+	}
+	secret.Type, secret.Data = gitAuthData(auth)
+
+	created, err := c.clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to store git credentials: %w", err)
+	}
+	return created.Name, nil
+}
+
+// StoreFunctionGitAuth keeps the git credentials of a function as a Secret in
+// the builder's namespace, replacing those it had, so the builds queued
+// after its first one can clone the repository too
+func (c *Client) StoreFunctionGitAuth(ctx context.Context, namespace, fnNamespace, fnName string, auth *models.GitAuth) error {
+	if c.clientset == nil {
+		return fmt.Errorf("demo mode: git credentials need Kubernetes")
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      functionGitAuthSecretName(fnNamespace, fnName),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"managed-by": "eventflow-api",
+				"tenant":     fnNamespace,
+				"function":   fnName,
+			},
+		},
+	}
+	secret.Type, secret.Data = gitAuthData(auth)
+
+	secrets := c.clientset.CoreV1().Secrets(namespace)
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store git credentials of function %s/%s: %w", fnNamespace, fnName, err)
+	}
+	return nil
+}
+
+// FunctionGitAuth returns the git credentials kept for a function
+func (c *Client) FunctionGitAuth(ctx context.Context, namespace, fnNamespace, fnName string) (*models.GitAuth, error) {
+	if c.clientset == nil {
+		return nil, fmt.Errorf("demo mode: git credentials need Kubernetes")
+	}
+
+	secret, err := c.clientset.CoreV1().Secrets(namespace).Get(ctx, functionGitAuthSecretName(fnNamespace, fnName), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read git credentials of function %s/%s: %w", fnNamespace, fnName, err)
+	}
+
+	if secret.Type == corev1.SecretTypeSSHAuth {
+		return &models.GitAuth{
+			Type:       "ssh",
+			SSHKey:     string(secret.Data[corev1.SSHAuthPrivateKey]),
+			KnownHosts: string(secret.Data["known_hosts"]),
+		}, nil
+	}
+	return &models.GitAuth{
+		Type:     "basic",
+		Username: string(secret.Data[corev1.BasicAuthUsernameKey]),
+		Password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+	}, nil
+}
+
+// DeleteFunctionGitAuth deletes the git credentials kept for a function
+func (c *Client) DeleteFunctionGitAuth(ctx context.Context, namespace, fnNamespace, fnName string) error {
+	return c.DeleteSecret(ctx, namespace, functionGitAuthSecretName(fnNamespace, fnName))
+}
+
+// functionGitAuthSecretName names the Secret of a function's git credentials.
+// Namespaces hold no dots, so no two functions share one.
+func functionGitAuthSecretName(fnNamespace, fnName string) string {
+	return fmt.Sprintf("fn-%s.%s-git-auth", fnNamespace, fnName)
+}
+
+// gitAuthData lays git credentials out as the Secret the builder mounts
+func gitAuthData(auth *models.GitAuth) (corev1.SecretType, map[string][]byte) {
+	if auth.Type == "ssh" {
+		key := auth.SSHKey
+		if !strings.HasSuffix(key, "\n") {
+			key += "\n"
+		}
+		return corev1.SecretTypeSSHAuth, map[string][]byte{
+			corev1.SSHAuthPrivateKey: []byte(key),
+			"known_hosts":            []byte(auth.KnownHosts),
+		}
+	}
+
+	// A token is sent as the password; the username is ignored by most
+	// hosts but must not be empty
+	username := auth.Username
+	if username == "" {
+		username = "x-access-token"
+	}
+	return corev1.SecretTypeBasicAuth, map[string][]byte{
+		corev1.BasicAuthUsernameKey: []byte(username),
+		corev1.BasicAuthPasswordKey: []byte(auth.Password),
+	}
+}
+
+// DeleteSecret deletes a Secret; a missing Secret is not an error
+func (c *Client) DeleteSecret(ctx context.Context, namespace, name string) error {
+	if c.clientset == nil {
+		return nil
+	}
+	err := c.clientset.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteBuildJobs deletes the builder Jobs of a build, and their pods before
+// them, so no build container outlives a cancelled build
+func (c *Client) DeleteBuildJobs(ctx context.Context, namespace, buildID string) error {
+	if c.clientset == nil {
+		return nil
+	}
+	foreground := metav1.DeletePropagationForeground
+	err := c.clientset.BatchV1().Jobs(namespace).DeleteCollection(ctx,
+		metav1.DeleteOptions{PropagationPolicy: &foreground},
+		metav1.ListOptions{LabelSelector: "app=builder,build-id=" + buildID},
+	)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete build jobs: %w", err)
+	}
+	return nil
+}
+
 // GetPodLogs retrieves logs from pods of a function
 func (c *Client) GetPodLogs(ctx context.Context, namespace, name string, follow bool) (io.ReadCloser, error) {
 	if c.clientset == nil {
@@ -376,44 +538,49 @@ func (c *Client) createResourceQuota(ctx context.Context, namespace string) erro
 	return nil
 }
 
-// InvokeFunction makes an HTTP request to the function's service
-func (c *Client) InvokeFunction(ctx context.Context, namespace, name string, method string, path string, body io.Reader) (*corev1.Pod, []byte, error) {
+// InvokeFunction forwards an HTTP request to the function's fn-{name} Service
+// and returns the function's response. The caller must close the response body.
+func (c *Client) InvokeFunction(ctx context.Context, namespace, name, method, path, rawQuery string, header http.Header, body io.Reader) (*http.Response, error) {
 	if c.clientset == nil {
-		return nil, []byte(`{"message":"demo mode - function invoked","name":"` + name + `"}`), nil
+		demoBody := `{"message":"demo mode - function invoked","name":"` + name + `"}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(demoBody)),
+		}, nil
 	}
 
-	// Get pods for the function
-	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("function=%s", name),
-	})
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to list pods: %w", err)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
 	}
-
-	if len(pods.Items) == 0 {
-		return nil, nil, fmt.Errorf("no pods found for function %s", name)
+	target := url.URL{
+		Scheme:   "http",
+		Host:     FunctionServiceHost(namespace, name),
+		Path:     path,
+		RawQuery: rawQuery,
 	}
 
-	// Find a ready pod
-	var readyPod *corev1.Pod
-	for i := range pods.Items {
-		pod := &pods.Items[i]
-		for _, condition := range pod.Status.Conditions {
-			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
-				readyPod = pod
-				break
-			}
-		}
-		if readyPod != nil {
-			break
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build invocation request: %w", err)
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
 		}
 	}
 
-	if readyPod == nil {
-		return nil, nil, fmt.Errorf("no ready pods found for function %s", name)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke function %s: %w", name, err)
 	}
 
-	return readyPod, []byte(`{"message":"function invoked via pod","pod":"` + readyPod.Name + `"}`), nil
+	return resp, nil
+}
+
+// FunctionServiceHost returns the in-cluster DNS name of a function's Service
+func FunctionServiceHost(namespace, name string) string {
+	return fmt.Sprintf("fn-%s.%s.svc.cluster.local", name, namespace)
 }
 
 func (c *Client) GetDynamicClient(ctx context.Context, req models.CreateFunctionRequest) (dynamic.Interface, error) {
@@ -423,25 +590,24 @@ func (c *Client) GetDynamicClient(ctx context.Context, req models.CreateFunction
 	return c.dynamicClient, nil
 }
 
-func (c *Client) CreateFunctionCR(ctx context.Context, req models.CreateFunctionRequest) error {
+// functionGVR identifies the Function custom resource served by the operator
+var functionGVR = schema.GroupVersionResource{
+	Group:    "eventflow.eventflow.io",
+	Version:  "v1alpha1",
+	Resource: "functions",
+}
+
+// CreateFunctionCR creates the Function CR the operator deploys a function from
+func (c *Client) CreateFunctionCR(ctx context.Context, fn *models.Function) error {
 	if c.dynamicClient == nil {
 		return fmt.Errorf("dynamic client is not initialized")
 	}
 
-	functionGVR := schema.GroupVersionResource{
-		Group:    "eventflow.eventflow.io",
-		Version:  "v1alpha1",
-		Resource: "functions",
-	}
-	spec := map[string]interface{}{
-		"image":    req.Image,
-		"replicas": req.Replicas,
-	}
-	if len(req.Command) > 0 {
-		spec["command"] = req.Command
-	}
-	if len(req.Env) > 0 {
-		spec["env"] = req.Env
+	spec := functionSpec(fn.Image, fn.Replicas, fn.Env, fn.Command, fn.Args, fn.Resources)
+	for key, value := range spec {
+		if value == nil {
+			delete(spec, key)
+		}
 	}
 
 	function := &unstructured.Unstructured{
@@ -449,18 +615,18 @@ func (c *Client) CreateFunctionCR(ctx context.Context, req models.CreateFunction
 			"apiVersion": functionGVR.GroupVersion().String(),
 			"kind":       "Function",
 			"metadata": map[string]interface{}{
-				"name":      req.Name,
-				"namespace": req.Namespace,
-			},
-			"labels": map[string]interface{}{
-				"app":        "eventflow",
-				"managed-by": "eventflow-api",
+				"name":      fn.Name,
+				"namespace": fn.Namespace,
 			},
 			"spec": spec,
 		},
 	}
+	function.SetLabels(functionLabels(fn.Labels))
+	if len(fn.Annotations) > 0 {
+		function.SetAnnotations(fn.Annotations)
+	}
 
-	_, err := c.dynamicClient.Resource(functionGVR).Namespace(req.Namespace).Create(ctx, function, metav1.CreateOptions{})
+	_, err := c.dynamicClient.Resource(functionGVR).Namespace(fn.Namespace).Create(ctx, function, metav1.CreateOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to create Function CR: %w", err)
 	}
@@ -468,14 +634,110 @@ func (c *Client) CreateFunctionCR(ctx context.Context, req models.CreateFunction
 	return nil
 }
 
-func (c *Client) DeleteFunctionCR(ctx context.Context, name, namespace string, userID string) error {
+// UpdateFunctionCR patches the spec, labels and annotations of an existing
+// Function CR so the operator rolls the function's Deployment. previous is the
+// function as last applied; its labels and annotations that fn no longer has
+// are removed from the CR.
+func (c *Client) UpdateFunctionCR(ctx context.Context, previous, fn *models.Function) error {
 	if c.dynamicClient == nil {
 		return fmt.Errorf("dynamic client is not initialized")
 	}
-	functionGVR := schema.GroupVersionResource{
-		Group:    "eventflow.eventflow.io",
-		Version:  "v1alpha1",
-		Resource: "functions",
+
+	// Fields left empty are sent as null, which removes them from the spec
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      metadataPatch(previous.Labels, functionLabels(fn.Labels)),
+			"annotations": metadataPatch(previous.Annotations, fn.Annotations),
+		},
+		"spec": functionSpec(fn.Image, fn.Replicas, fn.Env, fn.Command, fn.Args, fn.Resources),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal Function CR patch: %w", err)
+	}
+
+	_, err = c.dynamicClient.Resource(functionGVR).Namespace(fn.Namespace).Patch(ctx, fn.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch Function CR: %w", err)
+	}
+
+	return nil
+}
+
+// SystemLabels are set by the API on every Function CR. Users cannot set them.
+var SystemLabels = map[string]string{
+	"app":        "eventflow",
+	"managed-by": "eventflow-api",
+}
+
+// functionLabels merges the user's labels with SystemLabels
+func functionLabels(userLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(userLabels)+len(SystemLabels))
+	for key, value := range userLabels {
+		labels[key] = value
+	}
+	for key, value := range SystemLabels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// metadataPatch builds a merge patch that sets desired and removes the keys
+// of previous that desired no longer has
+func metadataPatch(previous, desired map[string]string) map[string]interface{} {
+	patch := make(map[string]interface{}, len(previous)+len(desired))
+	for key := range previous {
+		patch[key] = nil
+	}
+	for key, value := range desired {
+		patch[key] = value
+	}
+	return patch
+}
+
+// functionSpec builds the Function CR spec. Optional fields that are not set
+// are nil so the map can double as a JSON merge patch.
+func functionSpec(image string, replicas int32, env map[string]string, command, args []string, resources *models.ResourceRequirements) map[string]interface{} {
+	spec := map[string]interface{}{
+		"image":     image,
+		"replicas":  replicas,
+		"command":   nil,
+		"args":      nil,
+		"env":       nil,
+		"resources": nil,
+	}
+	if len(command) > 0 {
+		spec["command"] = command
+	}
+	if len(args) > 0 {
+		spec["args"] = args
+	}
+	if len(env) > 0 {
+		spec["env"] = env
+	}
+	if resources != nil {
+		spec["resources"] = map[string]interface{}{
+			"cpuRequest":    resources.CPURequest,
+			"memoryRequest": resources.MemoryRequest,
+			"cpuLimit":      resources.CPULimit,
+			"memoryLimit":   resources.MemoryLimit,
+		}
+	}
+	return spec
+}
+
+// IsNotFound reports whether err is a Kubernetes NotFound error
+func IsNotFound(err error) bool {
+	return errors.IsNotFound(err)
+}
+
+// IsAlreadyExists reports whether err is a Kubernetes AlreadyExists error
+func IsAlreadyExists(err error) bool {
+	return errors.IsAlreadyExists(err)
+}
+
+func (c *Client) DeleteFunctionCR(ctx context.Context, name, namespace string, userID string) error {
+	if c.dynamicClient == nil {
+		return fmt.Errorf("dynamic client is not initialized")
 	}
 
 	err := c.dynamicClient.Resource(functionGVR).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
@@ -1,36 +1,93 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Function struct {
-	Name      string            `json:"name"`
-	Namespace string            `json:"namespace"`
-	UserID    string            `json:"user_id"`
-	Image     string            `json:"image"`
-	Command   []string          `json:"command,omitempty"`
-	Env       map[string]string `json:"env,omitempty"`
-	Replicas  int32             `json:"replicas"`
-	CreatedAt time.Time         `json:"created_at"`
-	UpdatedAt time.Time         `json:"updated_at"`
+	ID             string                `json:"id"`
+	Name           string                `json:"name"`
+	Namespace      string                `json:"namespace"`
+	UserID         string                `json:"user_id"`
+	Image          string                `json:"image"`
+	Command        []string              `json:"command,omitempty"`
+	Args           []string              `json:"args,omitempty"`
+	Env            map[string]string     `json:"env,omitempty"`
+	Replicas       int32                 `json:"replicas"`
+	Resources      *ResourceRequirements `json:"resources,omitempty"`
+	DeploymentType string                `json:"deployment_type,omitempty"` // git, code, image
+	GitURL         string                `json:"git_url,omitempty"`
+	GitBranch      string                `json:"git_branch,omitempty"`
+	GitPath        string                `json:"git_path,omitempty"`
+	GitPrivate     bool                  `json:"git_private,omitempty"` // cloned with git_config.auth, kept in a Secret of the builder namespace
+	Labels         map[string]string     `json:"labels,omitempty"`
+	Annotations    map[string]string     `json:"annotations,omitempty"`
+	Description    string                `json:"description,omitempty"`
+	Status         string                `json:"status"`
+	CreatedAt      time.Time             `json:"created_at"`
+	UpdatedAt      time.Time             `json:"updated_at"`
+}
+
+// ResourceRequirements mirrors the Function CR's spec.resources
+type ResourceRequirements struct {
+	CPURequest    string `json:"cpu_request,omitempty"`    // e.g. "100m"
+	MemoryRequest string `json:"memory_request,omitempty"` // e.g. "128Mi"
+	CPULimit      string `json:"cpu_limit,omitempty"`      // e.g. "200m"
+	MemoryLimit   string `json:"memory_limit,omitempty"`   // e.g. "256Mi"
 }
 
 type FunctionStatus struct {
-	Name              string    `json:"name"`
-	Namespace         string    `json:"namespace"`
-	Image             string    `json:"image"`
-	Replicas          int32     `json:"replicas"`
-	AvailableReplicas int32     `json:"available_replicas"`
-	ReadyReplicas     int32     `json:"ready_replicas"`
-	UpdatedReplicas   int32     `json:"updated_replicas"`
-	Status            string    `json:"status"` // Running, Pending, Failed
-	CreatedAt         time.Time `json:"created_at"`
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	Image             string            `json:"image"`
+	Replicas          int32             `json:"replicas"`
+	AvailableReplicas int32             `json:"available_replicas"`
+	ReadyReplicas     int32             `json:"ready_replicas"`
+	UpdatedReplicas   int32             `json:"updated_replicas"`
+	Status            string            `json:"status"` // Running, Pending, Failed
+	Conditions        []Condition       `json:"conditions,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	Description       string            `json:"description,omitempty"`
+	CreatedAt         time.Time         `json:"created_at"`
+}
+
+// Condition is a condition the operator reports on a Function CR
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"` // True, False, Unknown
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"last_transition_time"`
+}
+
+// FunctionRevision is an immutable snapshot of a function's spec
+type FunctionRevision struct {
+	Revision    int                   `json:"revision"`
+	Image       string                `json:"image"`
+	Command     []string              `json:"command,omitempty"`
+	Args        []string              `json:"args,omitempty"`
+	Env         map[string]string     `json:"env,omitempty"`
+	Replicas    int32                 `json:"replicas"`
+	Resources   *ResourceRequirements `json:"resources,omitempty"`
+	ChangedBy   string                `json:"changed_by"`
+	ChangeCause string                `json:"change_cause,omitempty"`
+	CreatedAt   time.Time             `json:"created_at"`
+}
+
+// FunctionList is a page of functions returned by GET /v1/functions
+type FunctionList struct {
+	Functions     []FunctionStatus `json:"functions"`
+	NextPageToken string           `json:"next_page_token,omitempty"`
+	TotalCount    int              `json:"total_count"`
 }
 
 type GitConfig struct {
-	URL      string   `json:"url"`
-	Branch   string   `json:"branch,omitempty"`   // default: main
-	Path     string   `json:"path,omitempty"`     // subdirectory path, default: ./
-	Auth     *GitAuth `json:"auth,omitempty"`     // authentication for private repos
+	URL    string   `json:"url"`
+	Branch string   `json:"branch,omitempty"` // default: main
+	Path   string   `json:"path,omitempty"`   // subdirectory path, default: ./
+	Auth   *GitAuth `json:"auth,omitempty"`   // authentication for private repos
 }
 
 type GitAuth struct {
@@ -38,33 +95,95 @@ type GitAuth struct {
 	Username string `json:"username,omitempty"` // for basic auth
 	Password string `json:"password,omitempty"` // for basic auth or token
 	SSHKey   string `json:"ssh_key,omitempty"`  // for ssh auth
+
+	// KnownHosts are the SSH host keys trusted for ssh auth, in known_hosts
+	// format, besides those the builder trusts by default
+	KnownHosts string `json:"known_hosts,omitempty"`
 }
 
 type CreateFunctionRequest struct {
-	Name           string            `json:"name"`
-	Namespace      string            `json:"namespace"`
-	DeploymentType string            `json:"deployment_type,omitempty"` // git, code, image (default: image)
-	Image          string            `json:"image,omitempty"`            // for deployment_type=image
-	Runtime        string            `json:"runtime,omitempty"`          // python, nodejs, go, auto
-	SourceCode     string            `json:"source_code,omitempty"`      // Base64 encoded (deployment_type=code)
-	GitConfig      *GitConfig        `json:"git_config,omitempty"`       // for deployment_type=git
-	Command        []string          `json:"command,omitempty"`
-	Env            map[string]string `json:"env,omitempty"`
-	Replicas       int32             `json:"replicas"`
+	Name           string                `json:"name"`
+	Namespace      string                `json:"namespace"`
+	DeploymentType string                `json:"deployment_type,omitempty"`       // git, code, image (default: image)
+	Image          string                `json:"image,omitempty"`                 // for deployment_type=image
+	Runtime        string                `json:"runtime,omitempty"`               // python, nodejs, go, auto
+	SourceCode     string                `json:"source_code,omitempty"`           // Base64 encoded (deployment_type=code)
+	SourceFiles    map[string]string     `json:"source_files,omitempty"`          // Path to content (deployment_type=code)
+	SourceArchive  string                `json:"source_archive,omitempty"`        // Base64 encoded .tar.gz (deployment_type=code)
+	GitConfig      *GitConfig            `json:"git_config,omitempty"`            // for deployment_type=git
+	BuildStrategy  string                `json:"build_strategy,omitempty"`        // auto (default), cnb, pack, kaniko, buildkit
+	BuildTimeout   int32                 `json:"build_timeout_seconds,omitempty"` // deadline of the build; 600 when unset
+	Command        []string              `json:"command,omitempty"`
+	Args           []string              `json:"args,omitempty"`
+	Env            map[string]string     `json:"env,omitempty"`
+	Replicas       int32                 `json:"replicas"`
+	Resources      *ResourceRequirements `json:"resources,omitempty"`
+	Labels         map[string]string     `json:"labels,omitempty"`
+	Annotations    map[string]string     `json:"annotations,omitempty"`
+	Description    string                `json:"description,omitempty"`
+}
+
+// UpdateFunctionRequest is the body of PUT and PATCH /v1/functions/{name}.
+// PATCH changes only the fields that are present; PUT replaces the whole spec.
+type UpdateFunctionRequest struct {
+	Image     *string               `json:"image,omitempty"`
+	Command   []string              `json:"command,omitempty"`
+	Args      []string              `json:"args,omitempty"`
+	Env       map[string]string     `json:"env,omitempty"`
+	Replicas  *int32                `json:"replicas,omitempty"`
+	Resources *ResourceRequirements `json:"resources,omitempty"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Description *string           `json:"description,omitempty"`
 }
 
 type InvokeFunctionRequest struct {
 	Payload map[string]interface{} `json:"payload,omitempty"`
 }
 
+type Invocation struct {
+	ID           string          `json:"id"`
+	FunctionName string          `json:"function_name"`
+	Namespace    string          `json:"namespace"`
+	EventID      string          `json:"event_id,omitempty"`
+	EventType    string          `json:"event_type"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+	Status       string          `json:"status"` // pending, running, completed, failed
+	Error        string          `json:"error,omitempty"`
+	DurationMs   *int64          `json:"duration_ms,omitempty"`
+	StartedAt    time.Time       `json:"started_at"`
+	CompletedAt  *time.Time      `json:"completed_at,omitempty"`
+}
+
+type InvocationList struct {
+	Invocations   []*Invocation `json:"invocations"`
+	NextPageToken string        `json:"next_page_token,omitempty"`
+}
+
 type BuildStatus struct {
-	Status    string    `json:"status"` // pending, building, success, failed
+	Status    string    `json:"status"` // pending, building, success, failed, cancelled
 	Image     string    `json:"image,omitempty"`
 	Error     string    `json:"error,omitempty"`
 	StartedAt time.Time `json:"started_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// RetryBuildRequest is the optional body of POST /v1/builds/{id}:retry.
+// Git credentials are never stored, so a private repository needs them again.
+type RetryBuildRequest struct {
+	GitAuth *GitAuth `json:"git_auth,omitempty"`
+}
+
+// FunctionWebhook is where a git host delivers the pushes that rebuild a git
+// function, and the secret that signs them
+type FunctionWebhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	Branch string `json:"branch"` // pushes to other branches are ignored
+	Path   string `json:"path"`   // pushes that touch nothing under it are ignored
+}
+
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Message string `json:"message"`
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds each request to the registry
+const requestTimeout = 30 * time.Second
+
+// manifestTypes are the manifest media types a registry may store; a tag is
+// resolved to its digest with all of them accepted
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Client talks to the Docker Registry HTTP API V2 of the registry function
+// images are built into. The registry must allow deletes
+// (REGISTRY_STORAGE_DELETE_ENABLED); the space is reclaimed by its garbage
+// collector.
+type Client struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// DeleteRepository deletes every tagged manifest of a repository and returns
+// how many were deleted. A repository that does not exist has none.
+func (c *Client) DeleteRepository(ctx context.Context, repository string) (int, error) {
+	tags, err := c.tags(ctx, repository)
+	if err != nil {
+		return 0, err
+	}
+
+	// Tags of one manifest share its digest, which is deleted once
+	deleted := map[string]bool{}
+	for _, tag := range tags {
+		digest, err := c.digest(ctx, repository, tag)
+		if err != nil {
+			return len(deleted), err
+		}
+		if digest == "" || deleted[digest] {
+			continue
+		}
+		if err := c.deleteManifest(ctx, repository, digest); err != nil {
+			return len(deleted), err
+		}
+		deleted[digest] = true
+	}
+	return len(deleted), nil
+}
+
+func (c *Client) tags(ctx context.Context, repository string) ([]string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v2/"+repository+"/tags/list", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags of %s: %w", repository, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to list tags of %s: %s", repository, resp.Status)
+	}
+
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode tags of %s: %w", repository, err)
+	}
+	return list.Tags, nil
+}
+
+// digest returns the digest the tag points to, or "" when it is gone
+func (c *Client) digest(ctx context.Context, repository, tag string) (string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestTypes, ", ")}}
+	resp, err := c.do(ctx, http.MethodHead, "/v2/"+repository+"/manifests/"+tag, header)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s:%s: %w", repository, tag, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("Docker-Content-Digest"), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("failed to resolve %s:%s: %s", repository, tag, resp.Status)
+	}
+}
+
+func (c *Client) deleteManifest(ctx context.Context, repository, digest string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/v2/"+repository+"/manifests/"+digest, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s@%s: %w", repository, digest, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("failed to delete %s@%s: %s", repository, digest, resp.Status)
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Drain what is left so the connection is reused
+	if method != http.MethodGet {
+		io.Copy(io.Discard, resp.Body)
+	}
+	return resp, nil
+}
@@ -3,16 +3,20 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/eventflow/api/internal/artifacts"
 	"github.com/eventflow/api/internal/auth"
 	"github.com/eventflow/api/internal/config"
 	"github.com/eventflow/api/internal/database"
 	"github.com/eventflow/api/internal/events"
 	"github.com/eventflow/api/internal/handlers"
 	"github.com/eventflow/api/internal/k8s"
+	"github.com/eventflow/api/internal/registry"
+	"github.com/eventflow/api/internal/watch"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -26,9 +30,11 @@ type Server struct {
 	auth      *auth.Authenticator
 	router    *chi.Mux
 	publisher *events.Publisher
+	artifacts artifacts.Store
+	watchHub  *watch.Hub
 }
 
-func New(cfg *config.Config, k8sClient *k8s.Client, db *database.DB) *Server {
+func New(cfg *config.Config, k8sClient *k8s.Client, db *database.DB, watchHub *watch.Hub) *Server {
 	// Initialize NATS publisher (optional)
 	var publisher *events.Publisher
 	natsURL := os.Getenv("NATS_URL")
@@ -39,6 +45,12 @@ func New(cfg *config.Config, k8sClient *k8s.Client, db *database.DB) *Server {
 		}
 	}
 
+	// Initialize the artifact store holding uploaded sources (optional)
+	store, err := artifacts.NewStore(cfg)
+	if err != nil {
+		log.Printf("Warning: %v. Source uploads are disabled.", err)
+	}
+
 	s := &Server{
 		config:    cfg,
 		k8sClient: k8sClient,
@@ -46,6 +58,8 @@ func New(cfg *config.Config, k8sClient *k8s.Client, db *database.DB) *Server {
 		auth:      auth.NewAuthenticator(cfg.JWTSecret),
 		router:    chi.NewRouter(),
 		publisher: publisher,
+		artifacts: store,
+		watchHub:  watchHub,
 	}
 
 	s.setupMiddleware()
@@ -59,14 +73,14 @@ func (s *Server) setupMiddleware() {
 	s.router.Use(middleware.RealIP)
 	s.router.Use(middleware.Logger)
 	s.router.Use(middleware.Recoverer)
-	s.router.Use(middleware.Timeout(60 * time.Second))
+	s.router.Use(timeoutUnlessWatch(60 * time.Second))
 
 	// CORS
 	s.router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:5173"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Prefer"},
+		ExposedHeaders:   []string{"Link", "Location", "X-Invocation-Id"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -75,13 +89,39 @@ func (s *Server) setupMiddleware() {
 func (s *Server) setupRoutes() {
 	// Initialize function repository
 	functionRepo := database.NewFunctionRepository(s.db)
-	functionHandler := handlers.NewFunctionHandler(s.k8sClient, s.publisher, functionRepo)
+	buildRepo := database.NewBuildJobRepository(s.db)
+	functionHandler := handlers.NewFunctionHandler(s.k8sClient, s.publisher, functionRepo, buildRepo, s.watchHub,
+		s.config.BuildRegistry, s.config.BuildNamespace)
+	signer := artifacts.NewSigner(s.config.ArtifactSigningKey, s.config.ArtifactURLBase)
+	buildHandler := handlers.NewBuildHandler(functionRepo, buildRepo, s.publisher, s.k8sClient,
+		registry.NewClient(s.config.BuildRegistryURL), signer, s.config.BuildNamespace)
+	sourceHandler := handlers.NewSourceHandler(functionRepo, buildRepo, s.publisher, s.artifacts, signer, s.config.BuildRegistry)
+	hookHandler := handlers.NewHookHandler(functionRepo, buildRepo, s.publisher, s.k8sClient,
+		s.config.BuildRegistry, s.config.BuildNamespace, s.config.PublicURL)
+
+	// Track builds and deploy code and git functions once their build completes
+	if s.publisher != nil {
+		buildStatus := events.NewBuildStatusSubscriber(buildRepo, functionHandler.DeployBuild)
+		if err := buildStatus.Start(s.publisher); err != nil {
+			log.Printf("Warning: %v. Build status will not be tracked.", err)
+		}
+		buildLogs := events.NewBuildLogRecorder(buildRepo)
+		if err := buildLogs.Start(s.publisher); err != nil {
+			log.Printf("Warning: %v. Build logs will not be stored.", err)
+		}
+	}
 
 	// Public routes
 	s.router.Get("/healthz", s.healthHandler)
 	s.router.Get("/readyz", s.readyHandler)
 	s.router.Get("/metrics", promhttp.Handler().ServeHTTP)
 
+	// Build Jobs download uploaded sources here, authorized by a signed URL
+	s.router.Get(artifacts.URLPrefix+"*", sourceHandler.ServeArtifact)
+
+	// Git hosts deliver pushes here, authorized by the function's webhook secret
+	s.router.Post("/v1/hooks/git/{tenant}/{function}", hookHandler.GitPush)
+
 	// Dev auth endpoint (generate tokens for testing)
 	s.router.Post("/auth/token", s.generateTokenHandler)
 
@@ -93,14 +133,51 @@ func (s *Server) setupRoutes() {
 			r.Get("/", functionHandler.ListFunctions)
 			r.Post("/", functionHandler.CreateFunction)
 			r.Get("/{name}", functionHandler.GetFunction)
+			r.Put("/{name}", functionHandler.UpdateFunction)
+			r.Patch("/{name}", functionHandler.UpdateFunction)
 			r.Delete("/{name}", functionHandler.DeleteFunction)
 			r.Post("/{name}:invoke", functionHandler.InvokeFunction)
+			r.Post("/{name}:rollback", functionHandler.RollbackFunction)
+			r.Get("/{name}/revisions", functionHandler.ListRevisions)
+			r.Get("/{name}/watch", functionHandler.WatchFunction)
+			r.Get("/{name}/invocations", functionHandler.ListInvocations)
+			r.Get("/{name}/invocations/{id}", functionHandler.GetInvocation)
 			r.Post("/{name}/undeploy", functionHandler.UndeployFunction)
 			r.Get("/{name}/logs", functionHandler.GetFunctionLogs)
+			r.Get("/{name}/builds", buildHandler.GetFunctionBuilds)
+			r.Delete("/{name}/build-cache", buildHandler.PurgeBuildCache)
+			r.Post("/{name}/source", sourceHandler.UploadSource)
+			r.Get("/{name}/webhook", hookHandler.GetWebhook)
+			r.Post("/{name}/webhook", hookHandler.CreateWebhook)
+			r.Post("/{name}/webhook:rotate", hookHandler.RotateWebhook)
+		})
+
+		r.Route("/builds", func(r chi.Router) {
+			r.Get("/{id}", buildHandler.GetBuildJob)
+			r.Get("/{id}/logs", buildHandler.GetBuildLogs)
+			r.Get("/{id}/logs/stream", buildHandler.StreamBuildLogs)
+			r.Post("/{id}:cancel", buildHandler.CancelBuild)
+			r.Post("/{id}:retry", buildHandler.RetryBuild)
 		})
 	})
 }
 
+// timeoutUnlessWatch applies middleware.Timeout to every request except
+// watch and log streams, which stay open until the client disconnects, and
+// source archive transfers, which set deadlines of their own
+func timeoutUnlessWatch(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withTimeout := middleware.Timeout(timeout)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handlers.IsWatchRequest(r) || handlers.IsSourceTransfer(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withTimeout.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
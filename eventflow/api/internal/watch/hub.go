@@ -0,0 +1,91 @@
+package watch
+
+import "sync"
+
+// EventType is the kind of change a watch Event reports
+type EventType string
+
+const (
+	Added    EventType = "ADDED"
+	Modified EventType = "MODIFIED"
+	Deleted  EventType = "DELETED"
+)
+
+// subscriberBuffer is how many events a slow subscriber may fall behind
+// before it is dropped
+const subscriberBuffer = 64
+
+// Event reports that a function changed. It only identifies the function;
+// watchers read the current state themselves so they see a consistent view.
+type Event struct {
+	Type      EventType
+	Namespace string
+	Name      string
+}
+
+type subscriber struct {
+	namespace string
+	events    chan Event
+}
+
+// Hub fans function change events out to the watchers of each namespace
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Subscribe returns the events of a namespace and a function that ends the
+// subscription. The channel is closed when the subscription ends, including
+// when the subscriber falls too far behind.
+func (h *Hub) Subscribe(namespace string) (<-chan Event, func()) {
+	sub := &subscriber{
+		namespace: namespace,
+		events:    make(chan Event, subscriberBuffer),
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub.events, func() { h.remove(sub) }
+}
+
+// Publish delivers an event to the namespace's subscribers without blocking
+func (h *Hub) Publish(event Event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		if sub.namespace != event.Namespace {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// Drop the subscriber rather than an event; it reconnects
+			// and starts from a fresh snapshot
+			delete(h.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+func (h *Hub) remove(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
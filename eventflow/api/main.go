@@ -15,6 +15,7 @@ import (
 	"github.com/eventflow/api/internal/k8s"
 	"github.com/eventflow/api/internal/metrics"
 	"github.com/eventflow/api/internal/server"
+	"github.com/eventflow/api/internal/watch"
 )
 
 func main() {
@@ -44,11 +45,35 @@ func main() {
 		log.Fatalf("Failed to initialize Kubernetes client: %v", err)
 	}
 
+	// Function changes are pushed to watchers through the hub
+	watchHub := watch.NewHub()
+
+	// Serve function status from an informer cache. The operator's phase is
+	// also copied to the functions table so list filters see it.
+	statusHandlers := k8s.StatusHandlers{
+		OnChange: func(namespace, name string) {
+			watchHub.Publish(watch.Event{Type: watch.Modified, Namespace: namespace, Name: name})
+		},
+	}
+	if db != nil {
+		functionRepo := database.NewFunctionRepository(db)
+		statusHandlers.OnPhaseChange = func(namespace, name, phase string) {
+			if err := functionRepo.UpdateStatus(ctx, namespace, name, phase); err != nil {
+				log.Printf("Warning: failed to store status of %s/%s: %v", namespace, name, err)
+			}
+		}
+	}
+	cacheCtx, stopCache := context.WithCancel(ctx)
+	defer stopCache()
+	if err := k8sClient.StartStatusCache(cacheCtx, statusHandlers); err != nil {
+		log.Printf("Warning: %v. Functions will report Pending until restart.", err)
+	}
+
 	// Initialize metrics
 	metrics.Init()
 
 	// Create HTTP server
-	srv := server.New(cfg, k8sClient, db)
+	srv := server.New(cfg, k8sClient, db, watchHub)
 
 	// Start server
 	httpServer := &http.Server{
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ============================================================================
+// Source Detection
+// ============================================================================
+
+// runtimeAuto asks the worker to detect a build's runtime from its source
+const runtimeAuto = "auto"
+
+// runtimeManifests map the manifest files at the top of the directory a
+// build builds from to the runtime they belong to, in the order they decide
+var runtimeManifests = []struct {
+	file    string
+	runtime string
+}{
+	{"go.mod", "go"},
+	{"package.json", "node"},
+	{"requirements.txt", "python"},
+	{"pyproject.toml", "python"},
+	{"Pipfile", "python"},
+	{"setup.py", "python"},
+	{"pom.xml", "java"},
+	{"build.gradle", "java"},
+	{"build.gradle.kts", "java"},
+}
+
+// runtimeExtensions map source file extensions to runtimes, for sources
+// without a manifest
+var runtimeExtensions = map[string]string{
+	".go":   "go",
+	".js":   "node",
+	".mjs":  "node",
+	".cjs":  "node",
+	".ts":   "node",
+	".py":   "python",
+	".java": "java",
+}
+
+// detection is how a build builds, as decided from its request and source
+type detection struct {
+	Runtime      string // the request's runtime, or the one detected
+	DetectedFrom string // manifest or file extension the runtime was detected from
+	Dockerfile   bool   // the source has a Dockerfile
+	Strategy     string
+	BuilderImage string // CNB builder image, for the strategies that use one
+}
+
+// autoRuntime reports whether a build's runtime is left to detection
+func autoRuntime(runtime string) bool {
+	return runtime == "" || runtime == runtimeAuto
+}
+
+// sourceListing is what detection looks at in the directory a build builds
+// from: the files at its top, and how many source files below it have each
+// of the runtimeExtensions
+type sourceListing struct {
+	top        map[string]bool
+	extensions map[string]int
+}
+
+// inspectSource decides the runtime, strategy and builder image of a build.
+// The runtime is detected when the request leaves it to auto, and the
+// strategy is the one the request prefers or, without a preference, a
+// Dockerfile strategy when the source has a Dockerfile and CNB otherwise.
+// The source is only listed when there is something to detect; a source
+// that cannot be listed builds with the defaults. files is the inline
+// source of a code build.
+func inspectSource(ctx context.Context, tracker *jobTracker, req BuildReq, files map[string][]byte) (detection, error) {
+	d := detection{Runtime: req.Runtime}
+
+	prefer := strategyAuto
+	if req.Prefer != nil && *req.Prefer != "" {
+		prefer = *req.Prefer
+	}
+	if _, ok := buildStrategies[prefer]; !ok && prefer != strategyAuto {
+		return d, fmt.Errorf("unknown build strategy %q", prefer)
+	}
+
+	if prefer == strategyAuto || autoRuntime(req.Runtime) {
+		listing, err := listSource(ctx, tracker, req, files)
+		if err != nil {
+			log.Printf("Could not inspect the source of build %s: %v", req.BuildID, err)
+		}
+		d.Dockerfile = listing.top["Dockerfile"]
+		if autoRuntime(req.Runtime) {
+			d.Runtime, d.DetectedFrom = detectRuntime(listing)
+		}
+	}
+
+	switch {
+	case prefer != strategyAuto:
+		d.Strategy = prefer
+	case d.Dockerfile:
+		d.Strategy = getEnvOrDefault(dockerfileStrategyEnv, strategyKaniko)
+		if d.Strategy != strategyKaniko && d.Strategy != strategyBuildKit {
+			return d, fmt.Errorf("invalid %s: %q", dockerfileStrategyEnv, d.Strategy)
+		}
+	default:
+		d.Strategy = strategyCloudNativeBuildpacks
+	}
+
+	if buildsWithBuildpacks(d.Strategy) {
+		d.BuilderImage = cnbBuilderImage(d.Runtime)
+	}
+	return d, nil
+}
+
+// buildsWithBuildpacks reports whether a strategy builds with a CNB builder
+func buildsWithBuildpacks(strategy string) bool {
+	return strategy == strategyCloudNativeBuildpacks || strategy == strategyPack
+}
+
+// detectRuntime returns the runtime of a source from the listing of the
+// directory it builds from: the first manifest found at its top or, without
+// one, the runtime most of its source files are written in. It returns ""
+// when neither tells.
+func detectRuntime(listing sourceListing) (runtime, detectedFrom string) {
+	for _, manifest := range runtimeManifests {
+		if listing.top[manifest.file] {
+			return manifest.runtime, manifest.file
+		}
+	}
+
+	exts := make([]string, 0, len(listing.extensions))
+	for ext := range listing.extensions {
+		if runtimeExtensions[ext] != "" {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if listing.extensions[exts[i]] != listing.extensions[exts[j]] {
+			return listing.extensions[exts[i]] > listing.extensions[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+	if len(exts) == 0 {
+		return "", ""
+	}
+	return runtimeExtensions[exts[0]], "*" + exts[0]
+}
+
+// manifestNames lists the manifest files runtimes are detected from
+func manifestNames() []string {
+	names := make([]string, len(runtimeManifests))
+	for i, manifest := range runtimeManifests {
+		names[i] = manifest.file
+	}
+	return names
+}
+
+// listSource lists the directory a build builds from. Inline source is
+// listed by the worker; a git repository or uploaded archive is only ever
+// fetched inside a detect Job.
+func listSource(ctx context.Context, tracker *jobTracker, req BuildReq, files map[string][]byte) (sourceListing, error) {
+	if req.SourceType != "code" {
+		return runDetectJob(ctx, tracker, req)
+	}
+
+	dir := sourceSubdir(req)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if dir == "" {
+			names = append(names, name)
+		} else if rel, found := strings.CutPrefix(name, dir+"/"); found {
+			names = append(names, rel)
+		}
+	}
+	return listNames(names), nil
+}
+
+// listNames makes the listing of a directory from the names of its files,
+// relative to it
+func listNames(names []string) sourceListing {
+	listing := sourceListing{top: map[string]bool{}, extensions: map[string]int{}}
+	for _, name := range names {
+		if !strings.Contains(name, "/") {
+			listing.top[name] = true
+		}
+		if ext := path.Ext(name); runtimeExtensions[ext] != "" {
+			listing.extensions[ext]++
+		}
+	}
+	return listing
+}
+
+// parseListing reads the listing a detect container reports: a line per
+// file at the top of the directory, and a "*.ext count" line per extension
+func parseListing(message string) sourceListing {
+	listing := sourceListing{top: map[string]bool{}, extensions: map[string]int{}}
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line)
+		if pattern, count, found := strings.Cut(line, " "); found && strings.HasPrefix(pattern, "*.") {
+			if n, err := strconv.Atoi(count); err == nil {
+				listing.extensions[strings.TrimPrefix(pattern, "*")] = n
+			}
+			continue
+		}
+		if line != "" {
+			listing.top[line] = true
+		}
+	}
+	return listing
+}
+
+// sourceSubdir is the directory a build builds from, relative to the root of
+// its source; "" for the root itself
+func sourceSubdir(req BuildReq) string {
+	return strings.TrimPrefix(strings.TrimPrefix(sourceDir(req), "/workspace"), "/")
+}
+
+// ============================================================================
+// Detect Jobs
+// ============================================================================
+
+// runDetectJob lists a git or tar build's source in a detect Job and waits
+// for its listing. The Job is deleted once it has reported.
+func runDetectJob(ctx context.Context, tracker *jobTracker, req BuildReq) (sourceListing, error) {
+	job := createDetectJob(tracker.namespace, req)
+	_, err := tracker.clientset.BatchV1().Jobs(tracker.namespace).Create(ctx, job, meta.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return sourceListing{}, fmt.Errorf("failed to create detect job: %w", err)
+	}
+	defer deleteBuildJob(ctx, tracker.clientset, tracker.namespace, job.Name)
+
+	err = tracker.waitForJobCompletion(ctx, job.Name, detectTimeout+deadlineGrace)
+	message := terminationMessage(ctx, tracker.clientset, tracker.namespace, job.Name, detectContainerName)
+	if err != nil {
+		return sourceListing{}, fmt.Errorf("%w: %s", err, message)
+	}
+	return parseListing(message), nil
+}
+
+// createDetectJob creates the spec of a Job that lists a build's source. Like
+// the build Job's fetch container, it mounts the git credentials; like the
+// build Job, it runs without a ServiceAccount token.
+func createDetectJob(namespace string, req BuildReq) *batchv1.Job {
+	ttl := int32(jobTTLSeconds)
+	backoff := int32(jobBackoffLimit)
+	deadline := int64(detectTimeout.Seconds())
+
+	job := &batchv1.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      detectJobName(req),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":      "builder",
+				"build-id": req.BuildID,
+				stageLabel: stageDetect,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: &ttl,
+			BackoffLimit:            &backoff,
+			ActiveDeadlineSeconds:   &deadline,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					AutomountServiceAccountToken: boolPtr(false),
+					RestartPolicy:                corev1.RestartPolicyNever,
+					Containers:                   []corev1.Container{detectContainer(req)},
+				},
+			},
+		},
+	}
+
+	if req.GitAuthSecret != "" {
+		job.Spec.Template.Spec.Volumes = gitAuthVolumes(req)
+	}
+	return job
+}
+
+// detectJobName is the name of a build's detect Job
+func detectJobName(req BuildReq) string {
+	return fmt.Sprintf("detect-%s", req.BuildID[:8])
+}
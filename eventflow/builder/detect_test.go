@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectRuntime(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        []string
+		runtime      string
+		detectedFrom string
+	}{
+		{"go module", []string{"go.mod", "main.go"}, "go", "go.mod"},
+		{"node package", []string{"package.json", "index.js", "lib/util.py"}, "node", "package.json"},
+		{"python requirements", []string{"requirements.txt", "app.py"}, "python", "requirements.txt"},
+		{"python project", []string{"pyproject.toml", "src/app/__init__.py"}, "python", "pyproject.toml"},
+		{"maven", []string{"pom.xml", "src/main/java/App.java"}, "java", "pom.xml"},
+		{"manifest order", []string{"package.json", "go.mod"}, "go", "go.mod"},
+		{"nested manifest ignored", []string{"web/package.json", "main.py", "util.py"}, "python", "*.py"},
+		{"extensions", []string{"handler.js", "lib/a.js", "scripts/build.py"}, "node", "*.js"},
+		{"nothing known", []string{"README.md", "Dockerfile"}, "", ""},
+		{"empty", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runtime, detectedFrom := detectRuntime(listNames(tt.files))
+			if runtime != tt.runtime || detectedFrom != tt.detectedFrom {
+				t.Errorf("detectRuntime() = %q, %q, want %q, %q", runtime, detectedFrom, tt.runtime, tt.detectedFrom)
+			}
+		})
+	}
+}
+
+// TestListingScript runs the detect container's listing script over the
+// names a clone or archive lists, and checks that its listing detects what
+// the files themselves would
+func TestListingScript(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not installed")
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		names   []string
+		listing sourceListing
+	}{
+		{
+			name:  "root",
+			names: []string{"go.mod", "main.go", "internal/db.go", "web/package.json", "web/app.js", "README.md"},
+			listing: sourceListing{top: map[string]bool{"go.mod": true},
+				extensions: map[string]int{".go": 2, ".js": 1}},
+		},
+		{
+			name:  "archive entries",
+			names: []string{"./", "./Dockerfile", "./src/", "./src/app.py", "./src/.hidden.py"},
+			listing: sourceListing{top: map[string]bool{"Dockerfile": true},
+				extensions: map[string]int{".py": 2}},
+		},
+		{
+			name:  "source dir",
+			dir:   "services/api",
+			names: []string{"go.mod", "services/api/package.json", "services/api/lib/index.js", "services/api-v2/main.py"},
+			listing: sourceListing{top: map[string]bool{"package.json": true},
+				extensions: map[string]int{".js": 1}},
+		},
+		{
+			name:    "nothing known",
+			names:   []string{"README.md", "docs/index.html"},
+			listing: sourceListing{top: map[string]bool{}, extensions: map[string]int{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := detectContainer(BuildReq{SourceType: "tar", SourcePath: tt.dir})
+			env := map[string]string{}
+			for _, v := range c.Env {
+				env[v.Name] = v.Value
+			}
+
+			cmd := exec.Command("awk", "-v", "dir="+env["SOURCE_DIR"], "-v", "top="+env["TOP_FILES"],
+				"-v", "exts="+env["EXTENSIONS"], env["LISTING_SCRIPT"])
+			cmd.Stdin = strings.NewReader(strings.Join(tt.names, "\n") + "\n")
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("listing script failed: %v", err)
+			}
+			if got := parseListing(string(out)); !reflect.DeepEqual(got, tt.listing) {
+				t.Errorf("listing = %+v, want %+v", got, tt.listing)
+			}
+		})
+	}
+}
+
+func TestDetectJobKeepsSourceAndCredentialsInTheJob(t *testing.T) {
+	for _, tt := range hostileBuildReqs {
+		if tt.sourceType == "code" {
+			continue // Inline source is listed by the worker
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			req := validBuildReq(tt.sourceType)
+			req.GitAuthSecret = "build-1a2b3c4d-git"
+			tt.modify(&req)
+			req.Source = strings.ReplaceAll(req.Source, "https://github.com/x/y.git", "https://github.com/"+hostile)
+
+			pod := createDetectJob("builds", req).Spec.Template.Spec
+			if pod.AutomountServiceAccountToken == nil || *pod.AutomountServiceAccountToken {
+				t.Error("detect Job mounts a ServiceAccount token")
+			}
+			for _, c := range pod.Containers {
+				if script, ok := shellScript(c); ok && strings.Contains(script, hostile) {
+					t.Errorf("container %s runs user input in its script: %q", c.Name, script)
+				}
+			}
+		})
+	}
+}
+
+func TestInspectSourceCode(t *testing.T) {
+	cnb, kaniko := strategyCloudNativeBuildpacks, strategyKaniko
+	tests := []struct {
+		name       string
+		runtime    string
+		prefer     *string
+		sourcePath string
+		files      []string
+		want       detection
+	}{
+		{
+			name:    "auto detects runtime and builder",
+			runtime: runtimeAuto,
+			files:   []string{"go.mod", "main.go"},
+			want: detection{Runtime: "go", DetectedFrom: "go.mod", Strategy: cnb,
+				BuilderImage: cnbBuilderImage("go")},
+		},
+		{
+			name:    "dockerfile picks a dockerfile strategy",
+			runtime: runtimeAuto,
+			files:   []string{"Dockerfile", "requirements.txt"},
+			want:    detection{Runtime: "python", DetectedFrom: "requirements.txt", Dockerfile: true, Strategy: kaniko},
+		},
+		{
+			name:    "named runtime is kept",
+			runtime: "node",
+			files:   []string{"go.mod"},
+			want:    detection{Runtime: "node", Strategy: cnb, BuilderImage: cnbBuilderImage("node")},
+		},
+		{
+			name:       "source path",
+			runtime:    runtimeAuto,
+			sourcePath: "services/api",
+			files:      []string{"go.mod", "services/api/package.json", "services/api/index.js"},
+			want: detection{Runtime: "node", DetectedFrom: "package.json", Strategy: cnb,
+				BuilderImage: cnbBuilderImage("node")},
+		},
+		{
+			name:    "preferred strategy",
+			runtime: runtimeAuto,
+			prefer:  &kaniko,
+			files:   []string{"main.py"},
+			want:    detection{Runtime: "python", DetectedFrom: "*.py", Strategy: kaniko},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string][]byte{}
+			for _, name := range tt.files {
+				files[name] = nil
+			}
+			req := BuildReq{BuildID: "test", SourceType: "code", Runtime: tt.runtime, Prefer: tt.prefer, SourcePath: tt.sourcePath}
+
+			got, err := inspectSource(context.Background(), nil, req, files)
+			if err != nil {
+				t.Fatalf("inspectSource() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("inspectSource() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineSourceNeedsFilesForAuto(t *testing.T) {
+	req := BuildReq{SourceType: "code", Runtime: runtimeAuto, Source: "print('hi')"}
+	if _, err := inlineSource(req); err == nil {
+		t.Error("inlineSource() = nil error, want one for a single source with runtime auto")
+	}
+
+	files := map[string][]byte{"README.md": nil}
+	if err := scaffoldSource(files, "", detection{Strategy: strategyCloudNativeBuildpacks}); err == nil {
+		t.Error("scaffoldSource() = nil error, want one for an undetected runtime")
+	}
+	if err := scaffoldSource(files, "", detection{Dockerfile: true, Strategy: strategyKaniko}); err != nil {
+		t.Errorf("scaffoldSource() = %v, want nil for a Dockerfile build", err)
+	}
+}
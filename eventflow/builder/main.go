@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -21,28 +28,60 @@ import (
 // Domain Models
 // ============================================================================
 
-// BuildReq represents a request to build a container image from source
+// BuildReq represents a request to build a container image from source.
+// It is version 1 of the build protocol; the API's events.BuildRequest
+// mirrors it and both must change together.
 type BuildReq struct {
+	Version            int               `json:"version"` // Build protocol version
 	BuildID            string            `json:"build_id"`
-	SourceType         string            `json:"source_type"` // "git" | "tar" | "code"
-	Source             string            `json:"source"`      // Git URL, tar URL, or inline code
-	ImageRef           string            `json:"image_ref"`   // Target image name with registry
-	Prefer             *string           `json:"prefer,omitempty"`
-	GitRef             string            `json:"git_ref,omitempty"`    // Branch/tag for git sources
-	Runtime            string            `json:"runtime,omitempty"`    // python, node, go, java, etc.
-	Env                map[string]string `json:"env,omitempty"`        // Environment variables
-	RegistrySecretName string            `json:"registry_secret_name"` // Kubernetes secret for registry auth
-	TimeoutSeconds     int32             `json:"timeout_seconds,omitempty"`
+	Tenant             string            `json:"tenant,omitempty"`          // Namespace of the function, for fair scheduling
+	SourceType         string            `json:"source_type"`               // "git" | "tar" | "code"
+	Source             string            `json:"source"`                    // Git URL, tar URL, or inline code
+	Files              map[string]string `json:"files,omitempty"`           // Inline source files by path (code)
+	Archive            string            `json:"archive,omitempty"`         // Base64 gzipped tar of the inline source (code)
+	SourcePath         string            `json:"source_path,omitempty"`     // Subdirectory to build, relative to the source root
+	ImageRef           string            `json:"image_ref"`                 // Target image name with registry
+	CacheRef           string            `json:"cache_ref,omitempty"`       // Repository build layers are cached in; no cache when empty
+	Prefer             *string           `json:"prefer,omitempty"`          // Build strategy: auto, cnb, pack, kaniko, buildkit
+	GitRef             string            `json:"git_ref,omitempty"`         // Branch/tag for git sources
+	GitAuthSecret      string            `json:"git_auth_secret,omitempty"` // Secret holding git credentials, deleted after the build
+	Runtime            string            `json:"runtime,omitempty"`         // python, node, go, java, etc.; detected when auto or empty
+	Env                map[string]string `json:"env,omitempty"`             // Environment variables
+	RegistrySecretName string            `json:"registry_secret_name"`      // Kubernetes secret for registry auth
+	TimeoutSeconds     int32             `json:"timeout_seconds,omitempty"` // Build deadline; buildTimeout when unset
 }
 
-// Status represents the current state of a build
+// Status represents the current state of a build. The API's
+// events.BuildStatus mirrors it.
 type Status struct {
+	Version  int    `json:"version"` // Build protocol version
 	BuildID  string `json:"build_id"`
-	Event    string `json:"event"` // started, building, complete, failed
+	Event    string `json:"event"` // queued, started, building, complete, failed, cancelled
 	Message  string `json:"message,omitempty"`
-	Strategy string `json:"strategy,omitempty"` // cnb (Cloud Native Buildpacks)
+	Strategy string `json:"strategy,omitempty"` // cnb, pack, kaniko, buildkit
 	ImageRef string `json:"image_ref,omitempty"`
 	Digest   string `json:"digest,omitempty"` // Image SHA256 digest
+	Commit   string `json:"commit,omitempty"` // Commit a git build fetched
+
+	// How the build builds (started): its runtime, the file the runtime was
+	// detected from when the request left it to auto, and the CNB builder
+	Runtime      string `json:"runtime,omitempty"`
+	DetectedFrom string `json:"detected_from,omitempty"`
+	BuilderImage string `json:"builder_image,omitempty"`
+
+	// While a build waits for a slot (queued): its place in the replica's
+	// queue and a rough estimate of the wait
+	QueuePosition        int `json:"queue_position,omitempty"`
+	EstimatedWaitSeconds int `json:"estimated_wait_seconds,omitempty"`
+}
+
+// LogLine is one line of build output, published on the build's log subject.
+// The API's events.BuildLogLine mirrors it.
+type LogLine struct {
+	Version   int    `json:"version"` // Build protocol version
+	BuildID   string `json:"build_id"`
+	Container string `json:"container"` // fetch, pack
+	Line      string `json:"line"`
 }
 
 // ============================================================================
@@ -51,27 +90,47 @@ type Status struct {
 
 const (
 	// Environment variable names for configuration
-	nsEnv             = "NAMESPACE"       // Kubernetes namespace
-	builderSAEnv      = "BUILDER_SA"      // Service account for build Jobs
-	kanikoImageEnv    = "KANIKO_IMAGE"    // Kaniko executor image (unused in CNB mode)
-	packImageEnv      = "PACK_IMAGE"      // Pack CLI image (unused, using docker:cli)
-	builderImageEnv   = "BUILDER_IMAGE"   // CNB builder image
-	registrySecretEnv = "REGISTRY_SECRET" // Registry credentials secret
-
-	// Build strategy
-	strategyCloudNativeBuildpacks = "cnb"
+	nsEnv             = "NAMESPACE"         // Kubernetes namespace
+	builderSAEnv      = "BUILDER_SA"        // Service account for build Jobs
+	kanikoImageEnv    = "KANIKO_IMAGE"      // Kaniko executor image
+	packImageEnv      = "PACK_IMAGE"        // Pack CLI image
+	builderImageEnv   = "BUILDER_IMAGE"     // CNB builder image
+	registrySecretEnv = "REGISTRY_SECRET"   // Registry credentials secret
+	consumerEnv       = "BUILD_CONSUMER"    // Durable consumer (and queue group) name
+	concurrencyEnv    = "BUILD_CONCURRENCY" // Builds run in parallel by one replica, across tenants
+
+	// Build protocol shared with the API
+	protocolVersion     = 1
+	streamName          = "EVENTFLOW"
+	buildRequestSubject = "eventflow.builds.requested"
+	buildStatusSubject  = "eventflow.builds.status." // + build ID
+	buildLogSubject     = "eventflow.builds.logs."   // + build ID
+	buildCancelSubject  = "eventflow.builds.cancel." // + build ID
 
 	// Default values
 	defaultNATSURL        = "nats://nats.eventflow.svc.cluster.local:4222"
 	defaultBuilderSA      = "builder"
 	defaultRegistrySecret = "registry-secret"
 	defaultCNBBuilder     = "paketobuildpacks/builder-jammy-base:latest"
+	defaultConsumer       = "builder"
+	defaultConcurrency    = 2
 
 	// Job configuration
-	jobTTLSeconds       = 600 // Clean up completed jobs after 10 minutes
-	jobBackoffLimit     = 0   // Don't retry failed builds
-	buildTimeout        = 10 * time.Minute
-	statusCheckInterval = 5 * time.Second
+	jobTTLSeconds   = 600              // Clean up completed jobs after 10 minutes
+	jobBackoffLimit = 0                // Don't retry failed builds
+	buildTimeout    = 10 * time.Minute // Unless the request sets TimeoutSeconds
+	maxBuildTimeout = time.Hour
+	deadlineGrace   = 30 * time.Second // How long the worker waits past a Job's deadline
+	registryTimeout = 10 * time.Second
+	logFlushTimeout = 30 * time.Second // How long a finished build waits for its logs
+	maxLogLineBytes = 64 * 1024
+
+	// Delivery of build requests. A request stays unacked while its build
+	// runs, so the ack wait is kept short and extended with progress acks.
+	ackWait          = time.Minute
+	progressInterval = 20 * time.Second
+	maxDeliver       = 5
+	busyDelay        = 10 * time.Second // Redelivery delay when the build queue is full
 )
 
 // ============================================================================
@@ -90,32 +149,147 @@ func main() {
 	}
 	defer nc.Close()
 
-	// Subscribe to build requests
-	_, err = nc.Subscribe("eventflow.events", func(msg *nats.Msg) {
-		handleBuildRequest(nc, msg.Data)
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Failed to get JetStream context: %v", err)
+	}
+
+	concurrency := defaultConcurrency
+	if v := os.Getenv(concurrencyEnv); v != "" {
+		if concurrency, err = strconv.Atoi(v); err != nil || concurrency < 1 {
+			log.Fatalf("Invalid %s: %q", concurrencyEnv, v)
+		}
+	}
+	tenantConcurrency, weights, err := schedulerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Follow build Jobs through an informer, and pick up the builds an
+	// earlier worker left running
+	clientset, _ := getKubernetesClient()
+	tracker, err := newJobTracker(clientset, namespace)
+	if err != nil {
+		log.Fatalf("Failed to track build jobs: %v", err)
+	}
+	recoverBuilds(js, tracker)
+
+	builds := newScheduler(js, concurrency, tenantConcurrency, weights, func(msg *nats.Msg, req BuildReq) {
+		handleBuildRequest(js, tracker, msg, req)
 	})
+
+	// Durable queue-group consumer: replicas share the requests, and a request
+	// is only acked once its build reached a terminal status, so builds cut
+	// short by a restart are redelivered. Requests wait in the scheduler
+	// until a slot is free.
+	consumer := getEnvOrDefault(consumerEnv, defaultConsumer)
+	_, err = js.QueueSubscribe(buildRequestSubject, consumer, func(msg *nats.Msg) {
+		if req, ok := parseBuildRequest(js, msg); ok {
+			builds.submit(msg, req)
+		}
+	},
+		nats.Durable(consumer),
+		nats.BindStream(streamName),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(ackWait),
+		nats.MaxDeliver(maxDeliver),
+	)
 	if err != nil {
-		log.Fatalf("Failed to subscribe to events: %v", err)
+		log.Fatalf("Failed to subscribe to %s: %v", buildRequestSubject, err)
 	}
 
-	log.Println("Worker listening on eventflow.events")
+	log.Printf("Worker consuming %s (stream %s, consumer %s, concurrency %d, per tenant %d)",
+		buildRequestSubject, streamName, consumer, concurrency, tenantConcurrency)
 	select {} // Block forever
 }
 
-// handleBuildRequest processes incoming build request messages
-func handleBuildRequest(nc *nats.Conn, data []byte) {
+// parseBuildRequest decodes a build request message. Requests that can never
+// be built are terminated, after their build is failed where it has an ID.
+func parseBuildRequest(js nats.JetStreamContext, msg *nats.Msg) (BuildReq, bool) {
 	var req BuildReq
-	if err := json.Unmarshal(data, &req); err != nil {
-		log.Printf("Failed to unmarshal build request: %v", err)
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Printf("Dropping malformed build request: %v", err)
+		msg.Term()
+		return req, false
+	}
+
+	if req.BuildID == "" {
+		log.Printf("Dropping build request without a build ID")
+		msg.Term()
+		return req, false
+	}
+
+	if req.Version != protocolVersion {
+		log.Printf("Dropping build request %s: unsupported protocol version %d", req.BuildID, req.Version)
+		message := fmt.Sprintf("unsupported build protocol version %d (builder speaks %d)", req.Version, protocolVersion)
+		if err := publishStatus(js, Status{BuildID: req.BuildID, Event: "failed", Message: message}); err != nil {
+			msg.Nak()
+			return req, false
+		}
+		msg.Term()
+		return req, false
+	}
+
+	if err := validateBuildReq(req); err != nil {
+		log.Printf("Dropping build request %s: %v", req.BuildID, err)
+		message := "invalid build request: " + err.Error()
+		if err := publishStatus(js, Status{BuildID: req.BuildID, Event: "failed", Message: message}); err != nil {
+			msg.Nak()
+			return req, false
+		}
+		msg.Term()
+		return req, false
+	}
+
+	log.Printf("Received build request for %s (tenant: %s, source: %s, runtime: %s)",
+		req.BuildID, tenantOf(req), req.SourceType, req.Runtime)
+	return req, true
+}
+
+// handleBuildRequest runs the build of one request once the scheduler gave
+// it a slot. The message is acked once a terminal status (complete, failed
+// or cancelled) is published; until then progress acks keep it from being
+// redelivered to another replica.
+func handleBuildRequest(js nats.JetStreamContext, tracker *jobTracker, msg *nats.Msg, req BuildReq) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+
+	strategy, digest, commit, buildErr := processBuild(js, tracker, req)
+	if errors.Is(buildErr, errBuildReported) {
+		log.Printf("Build %s already reported its outcome", req.BuildID)
+		ackBuildRequest(tracker, msg, req)
 		return
 	}
+	err := publishStatus(js, outcomeStatus(req.BuildID, req.ImageRef, strategy, digest, commit, buildErr))
 
-	log.Printf("Received build request for %s (source: %s, runtime: %s)",
-		req.BuildID, req.SourceType, req.Runtime)
+	// The API never heard the outcome; let the request be redelivered
+	if err != nil {
+		msg.Nak()
+		return
+	}
+	ackBuildRequest(tracker, msg, req)
+}
 
-	if err := processBuild(nc, req); err != nil {
-		log.Printf("Build failed for %s: %v", req.BuildID, err)
-		publishStatus(nc, req.BuildID, "failed", err.Error(), "", "", "")
+// ackBuildRequest acks a request whose outcome reached the API and deletes
+// its git credentials. A request that is redelivered instead still needs
+// them to fetch its source; should it never be, the build Job owns them.
+func ackBuildRequest(tracker *jobTracker, msg *nats.Msg, req BuildReq) {
+	msg.Ack()
+	if req.GitAuthSecret != "" {
+		deleteGitAuthSecret(context.Background(), tracker.clientset, tracker.namespace, req)
 	}
 }
 
@@ -123,36 +297,170 @@ func handleBuildRequest(nc *nats.Conn, data []byte) {
 // Build Processing
 // ============================================================================
 
-// processBuild handles the complete build lifecycle
-func processBuild(nc *nats.Conn, req BuildReq) error {
+// processBuild runs a build up to its completion and returns the strategy it
+// used, the digest of the pushed image and the commit a git build fetched.
+// The terminal status is left to the caller.
+func processBuild(js nats.JetStreamContext, tracker *jobTracker, req BuildReq) (strategy, digest, commit string, err error) {
 	ctx := context.Background()
 	clientset, namespace := getKubernetesClient()
 
-	// Determine build strategy (always CNB for now)
-	strategy := strategyCloudNativeBuildpacks
-	log.Printf("Using build strategy: %s", strategy)
-	publishStatus(nc, req.BuildID, "started",
-		fmt.Sprintf("Starting build with %s", strategy), strategy, "", "")
+	// A build cancelled while it waited in the queue never gets a Job
+	if buildCancelled(js, req.BuildID) {
+		return "", "", "", errBuildCancelled
+	}
+
+	// A redelivered request may find its build recovered and reported, or
+	// its Job gone while no worker followed it
+	switch event := lastBuildEvent(js, req.BuildID); {
+	case buildReported(event):
+		return "", "", "", errBuildReported
+	case event == "building":
+		_, err := clientset.BatchV1().Jobs(namespace).Get(ctx, buildJobName(req), meta.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return "", "", "", fmt.Errorf("build job %s is gone: it was deleted while no builder was following it", buildJobName(req))
+		}
+	}
+
+	// Inline source is packed by the worker and handed to the Job in a
+	// ConfigMap, never through a shell script
+	var files map[string][]byte
+	if req.SourceType == "code" {
+		if files, err = inlineSource(req); err != nil {
+			return "", "", "", err
+		}
+	}
+
+	detected, err := inspectSource(ctx, tracker, req, files)
+	if err != nil {
+		return "", "", "", err
+	}
+	// Listing a git or tar source takes a detect Job; a build cancelled
+	// meanwhile gets no build Job
+	if buildCancelled(js, req.BuildID) {
+		return "", "", "", errBuildCancelled
+	}
+	strategy = detected.Strategy
+	req.Runtime = detected.Runtime
+	if files != nil {
+		if err := scaffoldSource(files, req.Runtime, detected); err != nil {
+			return strategy, "", "", err
+		}
+	}
+
+	message := fmt.Sprintf("Starting build with %s", strategy)
+	if detected.DetectedFrom != "" {
+		message += fmt.Sprintf(" (runtime %s, detected from %s)", detected.Runtime, detected.DetectedFrom)
+	}
+	log.Printf("Build %s: %s", req.BuildID, message)
+	publishStatus(js, Status{BuildID: req.BuildID, Event: "started", Message: message, Strategy: strategy,
+		Runtime: detected.Runtime, DetectedFrom: detected.DetectedFrom, BuilderImage: detected.BuilderImage})
+
+	// Create Kubernetes Job for the build. A redelivered request finds the
+	// Job of its earlier delivery and waits for that one instead.
+	if files != nil {
+		if err := createSourceConfigMap(ctx, clientset, namespace, req, files); err != nil {
+			return strategy, "", "", err
+		}
+	}
 
-	// Create Kubernetes Job for the build
 	job := createBuildJob(namespace, req, strategy)
 	created, err := clientset.BatchV1().Jobs(namespace).Create(ctx, job, meta.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		log.Printf("Resuming existing build job: %s", job.Name)
+		created, err = clientset.BatchV1().Jobs(namespace).Get(ctx, job.Name, meta.GetOptions{})
+	} else if err == nil {
+		log.Printf("Created build job: %s", created.Name)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create build job: %w", err)
+		return strategy, "", "", fmt.Errorf("failed to create build job: %w", err)
+	}
+
+	if files != nil {
+		if err := ownSourceConfigMap(ctx, clientset, req, created); err != nil {
+			log.Printf("Failed to hand source of %s to job %s: %v", req.BuildID, created.Name, err)
+		}
+	}
+	if req.GitAuthSecret != "" {
+		if err := ownGitAuthSecret(ctx, clientset, req, created); err != nil {
+			log.Printf("Failed to hand git credentials of %s to job %s: %v", req.BuildID, created.Name, err)
+		}
 	}
 
-	log.Printf("Created build job: %s", created.Name)
-	publishStatus(nc, req.BuildID, "building",
-		"Build job created, building image...", strategy, req.ImageRef, "")
+	publishStatus(js, Status{BuildID: req.BuildID, Event: "building",
+		Message: "Build job created, building image...", Strategy: strategy, ImageRef: req.ImageRef})
+
+	// Stream the build output while the Job runs; every line is published
+	// before the caller reports the terminal status
+	logsCtx, stopLogs := context.WithCancel(ctx)
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		followBuildLogs(logsCtx, clientset, js, namespace, created.Name, req.BuildID)
+	}()
+	defer func() {
+		select {
+		case <-logsDone:
+		case <-time.After(logFlushTimeout):
+			log.Printf("Timed out following logs of %s", created.Name)
+		}
+		stopLogs()
+		<-logsDone
+		select {
+		case <-js.PublishAsyncComplete():
+		case <-time.After(logFlushTimeout):
+			log.Printf("Timed out publishing logs of %s", created.Name)
+		}
+	}()
 
-	// Wait for build completion
-	if err := waitForJobCompletion(ctx, clientset, namespace, created.Name, buildTimeout); err != nil {
-		return fmt.Errorf("build job failed: %w", err)
+	// The Job's own deadline stops it first; the worker only gives up on it
+	// after that
+	digest, commit, err = jobResult(ctx, js, tracker, created.Name, req.BuildID, req.SourceType, req.ImageRef,
+		buildDeadline(req)+deadlineGrace)
+	return strategy, digest, commit, err
+}
+
+// jobResult waits for a build Job to finish and returns the digest of the
+// image it pushed. The fetch container reports the commit a git build checked
+// out, even when the build fails afterwards.
+func jobResult(ctx context.Context, js nats.JetStreamContext, tracker *jobTracker, jobName, buildID, sourceType, imageRef string,
+	timeout time.Duration) (digest, commit string, err error) {
+	err = tracker.waitForJobCompletion(ctx, jobName, timeout)
+	if sourceType == "git" {
+		commit = fetchedCommit(ctx, tracker.clientset, tracker.namespace, jobName)
+	}
+	if errors.Is(err, errJobDeleted) && buildCancelled(js, buildID) {
+		return "", commit, errBuildCancelled
+	}
+	if err != nil {
+		return "", commit, fmt.Errorf("build job failed: %w", err)
 	}
 
-	publishStatus(nc, req.BuildID, "complete", "Build succeeded",
-		strategy, req.ImageRef, "sha256:placeholder")
-	return nil
+	// The digest pins the deployment to exactly the image built here, even
+	// if the tag is pushed again later
+	digest, err = imageDigest(ctx, tracker.clientset, tracker.namespace, jobName, imageRef)
+	if err != nil {
+		return "", commit, fmt.Errorf("image pushed but its digest is unknown: %w", err)
+	}
+	log.Printf("Build %s pushed %s@%s", buildID, imageRef, digest)
+
+	return digest, commit, nil
+}
+
+// outcomeStatus is the terminal status of a build that ended with err
+func outcomeStatus(buildID, imageRef, strategy, digest, commit string, err error) Status {
+	switch {
+	case errors.Is(err, errBuildCancelled):
+		log.Printf("Build %s was cancelled", buildID)
+		return Status{BuildID: buildID, Event: "cancelled", Message: "Build cancelled",
+			Strategy: strategy, Commit: commit}
+	case err != nil:
+		log.Printf("Build failed for %s: %v", buildID, err)
+		return Status{BuildID: buildID, Event: "failed", Message: err.Error(),
+			Strategy: strategy, Commit: commit}
+	default:
+		return Status{BuildID: buildID, Event: "complete", Message: "Build succeeded",
+			Strategy: strategy, ImageRef: imageRef, Digest: digest, Commit: commit}
+	}
 }
 
 // ============================================================================
@@ -163,7 +471,8 @@ func processBuild(nc *nats.Conn, req BuildReq) error {
 func createBuildJob(namespace string, req BuildReq, strategy string) *batchv1.Job {
 	ttl := int32(jobTTLSeconds)
 	backoff := int32(jobBackoffLimit)
-	jobName := fmt.Sprintf("build-%s", req.BuildID[:8])
+	deadline := int64(buildDeadline(req).Seconds())
+	jobName := buildJobName(req)
 
 	// Get registry secret name (for pushing images)
 	registrySecret := req.RegistrySecretName
@@ -179,19 +488,28 @@ func createBuildJob(namespace string, req BuildReq, strategy string) *batchv1.Jo
 			Name:      jobName,
 			Namespace: namespace,
 			Labels: map[string]string{
-				"app":      "builder",
-				"build-id": req.BuildID,
+				"app":           "builder",
+				"build-id":      req.BuildID,
+				"strategy":      strategy,
+				sourceTypeLabel: req.SourceType,
+			},
+			Annotations: map[string]string{
+				imageRefAnnotation: req.ImageRef,
 			},
 		},
 		Spec: batchv1.JobSpec{
 			TTLSecondsAfterFinished: &ttl,
 			BackoffLimit:            &backoff,
+			ActiveDeadlineSeconds:   &deadline,
 			Template: corev1.PodTemplateSpec{
 				Spec: corev1.PodSpec{
 					ServiceAccountName: builderSA,
-					RestartPolicy:      corev1.RestartPolicyNever,
-					InitContainers:     []corev1.Container{},
-					Containers:         []corev1.Container{},
+					// Dockerfile steps and buildpacks run user code; pushes
+					// authenticate with the registry Secret instead
+					AutomountServiceAccountToken: boolPtr(false),
+					RestartPolicy:                corev1.RestartPolicyNever,
+					InitContainers:               []corev1.Container{},
+					Containers:                   []corev1.Container{},
 					Volumes: []corev1.Volume{
 						{
 							Name: "workspace",
@@ -216,210 +534,304 @@ func createBuildJob(namespace string, req BuildReq, strategy string) *batchv1.Jo
 		},
 	}
 
+	// Inline source is unpacked from its ConfigMap
+	if req.SourceType == "code" {
+		job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: "source",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: sourceConfigMapName(req)},
+				},
+			},
+		})
+	}
+
+	// Git credentials and the known SSH hosts are mounted into the fetch container
+	if req.GitAuthSecret != "" {
+		job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, gitAuthVolumes(req)...)
+	}
+
 	// Add fetch init container
 	job.Spec.Template.Spec.InitContainers = append(
 		job.Spec.Template.Spec.InitContainers,
 		fetchContainer(req),
 	)
 
-	// Always use Cloud Native Buildpacks with DinD
-	// Add DinD sidecar
-	job.Spec.Template.Spec.Containers = append(
-		job.Spec.Template.Spec.Containers,
-		dindContainer(),
-	)
-	// Add Pack container
-	job.Spec.Template.Spec.Containers = append(
-		job.Spec.Template.Spec.Containers,
-		cnbContainer(req),
-	)
+	// Add the strategy's build containers
+	buildStrategies[strategy](req, &job.Spec.Template.Spec)
 
 	return job
 }
 
 // ============================================================================
-// Container Definitions (Init and Main Containers)
+// Job Monitoring
 // ============================================================================
 
-// fetchContainer creates an init container that fetches source code
-// Supports three source types: git (clone repo), tar (download/extract), code (inline)
-func fetchContainer(req BuildReq) corev1.Container {
-	container := corev1.Container{
-		Name:  "fetch",
-		Image: "alpine/git:latest",
-		VolumeMounts: []corev1.VolumeMount{
-			{Name: "workspace", MountPath: "/workspace"},
-		},
+// buildJobName is the name of a build's Job
+func buildJobName(req BuildReq) string {
+	return fmt.Sprintf("build-%s", req.BuildID[:8])
+}
+
+// buildDeadline is how long a build Job may run: the request's
+// TimeoutSeconds, up to maxBuildTimeout, or buildTimeout when unset
+func buildDeadline(req BuildReq) time.Duration {
+	if req.TimeoutSeconds <= 0 {
+		return buildTimeout
 	}
+	return min(time.Duration(req.TimeoutSeconds)*time.Second, maxBuildTimeout)
+}
 
-	switch req.SourceType {
-	case "git":
-		// Clone a Git repository
-		gitRef := req.GitRef
-		if gitRef == "" {
-			gitRef = "main"
-		}
-		container.Command = []string{"sh", "-c"}
-		container.Args = []string{
-			fmt.Sprintf("git clone --depth 1 --branch %s %s /workspace", gitRef, req.Source),
+// deleteBuildJob deletes a build Job and, before the Job itself, its pods,
+// so no build or Docker-in-Docker container outlives it
+func deleteBuildJob(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName string) {
+	foreground := meta.DeletePropagationForeground
+	err := clientset.BatchV1().Jobs(namespace).Delete(ctx, jobName, meta.DeleteOptions{PropagationPolicy: &foreground})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("Failed to delete build job %s: %v", jobName, err)
+	}
+}
+
+// errBuildCancelled is returned for a build the API cancelled
+var errBuildCancelled = errors.New("build cancelled")
+
+// errBuildReported is returned for a redelivered request whose build already
+// reported its outcome
+var errBuildReported = errors.New("build outcome already reported")
+
+// buildCancelled reports whether the API asked for a build to be cancelled.
+// The API stores the request in the stream, so it is seen by a worker that
+// picks the build up later too.
+func buildCancelled(js nats.JetStreamContext, buildID string) bool {
+	_, err := js.GetLastMsg(streamName, buildCancelSubject+buildID)
+	return err == nil
+}
+
+// ============================================================================
+// Build Logs
+// ============================================================================
+
+// buildContainers are the Job pod's containers whose output makes up the
+// build logs, in the order they run
+var buildContainers = []string{"fetch", buildContainerName}
+
+// followBuildLogs publishes the output of the build Job's containers line by
+// line until they exit or ctx is cancelled
+func followBuildLogs(ctx context.Context, clientset *kubernetes.Clientset, js nats.JetStreamContext, namespace, jobName, buildID string) {
+	podName, err := waitForJobPod(ctx, clientset, namespace, jobName)
+	if err != nil {
+		log.Printf("No logs for %s: %v", jobName, err)
+		return
+	}
+
+	for _, container := range buildContainers {
+		if err := followContainerLogs(ctx, clientset, js, namespace, podName, container, buildID); err != nil {
+			log.Printf("Stopped following %s/%s: %v", podName, container, err)
+			return
 		}
+	}
+}
+
+// waitForJobPod returns the name of the pod the build Job created
+func waitForJobPod(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName string) (string, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	case "tar":
-		// Download and extract a tarball
-		container.Image = "busybox:latest"
-		container.Command = []string{"sh", "-c"}
-		container.Args = []string{
-			fmt.Sprintf("wget -O /tmp/source.tar.gz %s && tar -xzf /tmp/source.tar.gz -C /workspace", req.Source),
+	for {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, meta.ListOptions{
+			LabelSelector: "job-name=" + jobName,
+		})
+		if err == nil && len(pods.Items) > 0 {
+			return pods.Items[0].Name, nil
 		}
 
-	case "code":
-		// Write inline code to a file (for code editor deployments)
-		container.Image = "busybox:latest"
-		container.Command = []string{"sh", "-c"}
-		container.Args = []string{
-			fmt.Sprintf("mkdir -p /workspace && cat > /workspace/main.py << 'EOFCODE'\n%s\nEOFCODE", req.Source),
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
 		}
 	}
-
-	return container
 }
 
-// cnbContainer creates the main container that runs Cloud Native Buildpacks
-// Uses docker:cli image with pack CLI downloaded at runtime
-func cnbContainer(req BuildReq) corev1.Container {
-	// Select appropriate CNB builder based on runtime
-	builderImage := getEnvOrDefault(builderImageEnv, defaultCNBBuilder)
-
-	if req.Runtime != "" {
-		switch req.Runtime {
-		case "python", "python3":
-			builderImage = "paketobuildpacks/builder-jammy-base:latest"
-		case "node", "nodejs":
-			builderImage = "paketobuildpacks/builder-jammy-base:latest"
-		case "go":
-			builderImage = "paketobuildpacks/builder-jammy-tiny:latest"
-		case "java":
-			builderImage = "paketobuildpacks/builder-jammy-base:latest"
+// followContainerLogs publishes one container's output. The log stream can
+// only be opened once the container has started, so opening is retried.
+func followContainerLogs(ctx context.Context, clientset *kubernetes.Clientset, js nats.JetStreamContext, namespace, podName, container, buildID string) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		stream, err := clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+			Container: container,
+			Follow:    true,
+		}).Stream(ctx)
+		if err == nil {
+			defer stream.Close()
+
+			scanner := bufio.NewScanner(stream)
+			scanner.Buffer(make([]byte, 0, 4096), maxLogLineBytes)
+			for scanner.Scan() {
+				publishLogLine(js, buildID, container, scanner.Text())
+			}
+			return scanner.Err()
 		}
-	}
 
-	return corev1.Container{
-		Name:    "pack",
-		Image:   "docker:27-cli",
-		Command: []string{"/bin/sh", "-c"},
-		Args: []string{
-			`
-			set -e
-			
-			echo "Waiting for Docker daemon..."
-			until docker -H tcp://localhost:2375 info > /dev/null 2>&1; do
-				sleep 2
-			done
-			echo "Docker daemon is ready!"
-			
-			# Download pack CLI
-			echo "Downloading pack CLI..."
-			wget -q -O - https://github.com/buildpacks/pack/releases/download/v0.35.1/pack-v0.35.1-linux.tgz | tar -xz -C /usr/local/bin
-			chmod +x /usr/local/bin/pack
-			
-			# Run pack build
-			echo "Running pack build..."
-			pack build ` + req.ImageRef + ` \
-				--path /workspace \
-				--builder ` + builderImage + ` \
-				--publish \
-				--docker-host tcp://localhost:2375 \
-				--trust-builder
-			
-			echo "Build complete!"
-			`,
-		},
-		VolumeMounts: []corev1.VolumeMount{
-			{Name: "workspace", MountPath: "/workspace"},
-		},
-		Env: []corev1.EnvVar{
-			{Name: "DOCKER_HOST", Value: "tcp://localhost:2375"},
-		},
+		// A container of a finished pod that has no logs never ran
+		pod, getErr := clientset.CoreV1().Pods(namespace).Get(ctx, podName, meta.GetOptions{})
+		if getErr == nil && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
 }
 
-// dindContainer creates a Docker-in-Docker sidecar container
-// Provides a Docker daemon that the pack container can use for building images
-func dindContainer() corev1.Container {
-	return corev1.Container{
-		Name:  "dind",
-		Image: "docker:24-dind",
-		Env: []corev1.EnvVar{
-			{Name: "DOCKER_TLS_CERTDIR", Value: ""}, // Disable TLS for local communication
-		},
-		SecurityContext: &corev1.SecurityContext{
-			Privileged: boolPtr(true), // Required for DinD to manage containers
-		},
-		Args: []string{
-			"--insecure-registry=docker-registry.eventflow.svc.cluster.local:5000",
-		},
+// publishLogLine stores a line of build output in the JetStream stream, on
+// the build's own log subject. Lines are published asynchronously; the build
+// waits for them before reporting its terminal status.
+func publishLogLine(js nats.JetStreamContext, buildID, container, line string) {
+	data, err := json.Marshal(LogLine{
+		Version:   protocolVersion,
+		BuildID:   buildID,
+		Container: container,
+		Line:      line,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal log line: %v", err)
+		return
+	}
+
+	if _, err := js.PublishAsync(buildLogSubject+buildID, data); err != nil {
+		log.Printf("Failed to publish log line of %s: %v", buildID, err)
 	}
 }
 
 // ============================================================================
-// Job Monitoring
+// Image Digests
 // ============================================================================
 
-// waitForJobCompletion waits for a Kubernetes Job to complete or fail
-func waitForJobCompletion(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName string, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+// digestPattern matches a sha256 manifest digest
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
 
-	ticker := time.NewTicker(statusCheckInterval)
-	defer ticker.Stop()
+// manifestMediaTypes are the manifest formats asked for when the registry is
+// queried for a digest
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("timeout waiting for job to complete")
-		case <-ticker.C:
-			job, err := clientset.BatchV1().Jobs(namespace).Get(ctx, jobName, meta.GetOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to get job status: %w", err)
-			}
+// imageDigest returns the digest of the image a finished build Job pushed:
+// the one the build container wrote to its termination message or, failing
+// that, the one the registry serves for the image's tag
+func imageDigest(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName, imageRef string) (string, error) {
+	if digest := terminationMessage(ctx, clientset, namespace, jobName, buildContainerName); digestPattern.MatchString(digest) {
+		return digest, nil
+	}
 
-			if job.Status.Succeeded > 0 {
-				log.Printf("Job %s completed successfully", jobName)
-				return nil
-			}
+	log.Printf("No digest reported by job %s, asking the registry for %s", jobName, imageRef)
+	return registryDigest(ctx, imageRef)
+}
 
-			if job.Status.Failed > 0 {
-				return fmt.Errorf("job %s failed", jobName)
+// terminationMessage returns what a container of a build Job's pod wrote to
+// its termination message, or "" when it has not terminated
+func terminationMessage(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName, container string) string {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, meta.ListOptions{
+		LabelSelector: "job-name=" + jobName,
+	})
+	if err != nil {
+		log.Printf("Failed to list pods of job %s: %v", jobName, err)
+		return ""
+	}
+
+	for _, pod := range pods.Items {
+		statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			if cs.Name == container && cs.State.Terminated != nil {
+				return strings.TrimSpace(cs.State.Terminated.Message)
 			}
 		}
 	}
+	return ""
+}
+
+// registryDigest asks the registry for the manifest digest of a tagged image.
+// HTTPS is tried first, then plain HTTP for insecure in-cluster registries.
+func registryDigest(ctx context.Context, imageRef string) (string, error) {
+	host, repository, tag, ok := splitImageRef(imageRef)
+	if !ok {
+		return "", fmt.Errorf("image reference %q has no registry host", imageRef)
+	}
+
+	client := &http.Client{Timeout: registryTimeout}
+	var lastErr error
+	for _, scheme := range []string{"https", "http"} {
+		url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, repository, tag)
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return "", err
+		}
+		httpReq.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("registry returned %s for %s", resp.Status, url)
+		}
+		digest := resp.Header.Get("Docker-Content-Digest")
+		if !digestPattern.MatchString(digest) {
+			return "", fmt.Errorf("registry returned no valid digest for %s", url)
+		}
+		return digest, nil
+	}
+
+	return "", fmt.Errorf("failed to reach registry %s: %w", host, lastErr)
+}
+
+// splitImageRef splits host/repository:tag into its parts. The tag defaults
+// to "latest".
+func splitImageRef(imageRef string) (host, repository, tag string, ok bool) {
+	host, rest, found := strings.Cut(imageRef, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "", "", "", false
+	}
+
+	repository, tag = rest, "latest"
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		repository, tag = rest[:i], rest[i+1:]
+	}
+	return host, repository, tag, true
 }
 
 // ============================================================================
 // NATS Event Publishing
 // ============================================================================
 
-// publishStatus sends a build status update to NATS
-func publishStatus(nc *nats.Conn, buildID, event, message, strategy, imageRef, digest string) {
-	status := Status{
-		BuildID:  buildID,
-		Event:    event,
-		Message:  message,
-		Strategy: strategy,
-		ImageRef: imageRef,
-		Digest:   digest,
-	}
+// publishStatus stores a build status update in the JetStream stream, on
+// the build's own status subject
+func publishStatus(js nats.JetStreamContext, status Status) error {
+	status.Version = protocolVersion
 
 	data, err := json.Marshal(status)
 	if err != nil {
 		log.Printf("Failed to marshal status: %v", err)
-		return
+		return err
 	}
 
-	subject := fmt.Sprintf("builds.status.%s", buildID)
-	if err := nc.Publish(subject, data); err != nil {
+	subject := buildStatusSubject + status.BuildID
+	if _, err := js.Publish(subject, data); err != nil {
 		log.Printf("Failed to publish status to %s: %v", subject, err)
+		return err
 	}
+	return nil
 }
 
 // ============================================================================
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// hostile is a marker every hostile input carries; it must never reach a
+// shell script
+const hostile = "pwned"
+
+func validBuildReq(sourceType string) BuildReq {
+	req := BuildReq{
+		Version:    protocolVersion,
+		BuildID:    "1a2b3c4d-0000-4000-8000-000000000000",
+		Tenant:     "team-a",
+		SourceType: sourceType,
+		ImageRef:   "docker-registry.eventflow.svc.cluster.local:5000/team-a/hello:1a2b3c4d",
+		CacheRef:   "docker-registry.eventflow.svc.cluster.local:5000/team-a/hello/cache",
+		Runtime:    "python",
+	}
+	switch sourceType {
+	case "git":
+		req.Source = "https://github.com/eventflow/examples.git"
+		req.GitRef = "release/v1.2"
+	case "tar":
+		req.Source = "https://api.eventflow.svc/v1/uploads/abc?expires=1&signature=def"
+	case "code":
+		req.Files = map[string]string{"main.py": "print('hi')"}
+	}
+	return req
+}
+
+func TestValidateBuildReqAccepts(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*BuildReq)
+	}{
+		{"git", func(r *BuildReq) {}},
+		{"git default ref", func(r *BuildReq) { r.GitRef = "" }},
+		{"ssh URL", func(r *BuildReq) { r.Source = "ssh://git@github.com/eventflow/examples.git" }},
+		{"scp-like URL", func(r *BuildReq) { r.Source = "git@github.com:eventflow/examples.git" }},
+		{"tag ref", func(r *BuildReq) { r.GitRef = "v1.2.3" }},
+		{"source path", func(r *BuildReq) { r.SourcePath = "services/hello" }},
+		{"no cache", func(r *BuildReq) { r.CacheRef = "" }},
+		{"secrets", func(r *BuildReq) {
+			r.GitAuthSecret = "build-1a2b3c4d-git"
+			r.RegistrySecretName = "registry-credentials"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := validBuildReq("git")
+			tt.modify(&req)
+			if err := validateBuildReq(req); err != nil {
+				t.Errorf("validateBuildReq() = %v, want nil", err)
+			}
+		})
+	}
+
+	for _, sourceType := range []string{"tar", "code"} {
+		if err := validateBuildReq(validBuildReq(sourceType)); err != nil {
+			t.Errorf("validateBuildReq(%s) = %v, want nil", sourceType, err)
+		}
+	}
+}
+
+// hostileBuildReqs are requests that try to run commands in, or smuggle
+// options into, the build Job
+var hostileBuildReqs = []struct {
+	name       string
+	sourceType string
+	modify     func(*BuildReq)
+}{
+	{"git ref command substitution", "git", func(r *BuildReq) { r.GitRef = "main$(touch /tmp/" + hostile + ")" }},
+	{"git ref backticks", "git", func(r *BuildReq) { r.GitRef = "main`" + hostile + "`" }},
+	{"git ref chained command", "git", func(r *BuildReq) { r.GitRef = "main; " + hostile }},
+	{"git ref option", "git", func(r *BuildReq) { r.GitRef = "--upload-pack=" + hostile }},
+	{"git ref traversal", "git", func(r *BuildReq) { r.GitRef = "../" + hostile }},
+	{"git URL chained command", "git", func(r *BuildReq) { r.Source = "https://github.com/x/y.git && " + hostile }},
+	{"git URL command substitution", "git", func(r *BuildReq) { r.Source = "https://github.com/$(" + hostile + ")" }},
+	{"git URL newline", "git", func(r *BuildReq) { r.Source = "https://github.com/x/y.git\n" + hostile }},
+	{"git URL option", "git", func(r *BuildReq) { r.Source = "--upload-pack=" + hostile }},
+	{"git ext transport", "git", func(r *BuildReq) { r.Source = "ext::sh -c " + hostile }},
+	{"git file URL", "git", func(r *BuildReq) { r.Source = "file:///etc/" + hostile }},
+	{"git host option", "git", func(r *BuildReq) { r.Source = "ssh://-oProxyCommand=" + hostile + "/x" }},
+	{"tar URL command substitution", "tar", func(r *BuildReq) { r.Source = "https://x/$(" + hostile + ")" }},
+	{"tar file URL", "tar", func(r *BuildReq) { r.Source = "file:///etc/" + hostile }},
+	{"image ref chained command", "code", func(r *BuildReq) { r.ImageRef = "registry:5000/a/b:1;" + hostile }},
+	{"image ref output option", "code", func(r *BuildReq) { r.ImageRef = "registry:5000/a/b,push=false," + hostile }},
+	{"image ref command substitution", "code", func(r *BuildReq) { r.ImageRef = "registry:5000/a/$(" + hostile + "):1" }},
+	{"cache ref option", "code", func(r *BuildReq) { r.CacheRef = "registry:5000/a --" + hostile }},
+	{"source path escape", "code", func(r *BuildReq) { r.SourcePath = "../../" + hostile }},
+	{"runtime command", "code", func(r *BuildReq) { r.Runtime = "python;" + hostile }},
+	{"tenant", "code", func(r *BuildReq) { r.Tenant = "a/" + hostile }},
+	{"git auth secret", "git", func(r *BuildReq) { r.GitAuthSecret = "x;" + hostile }},
+	{"registry secret", "code", func(r *BuildReq) { r.RegistrySecretName = "../" + hostile }},
+}
+
+func TestValidateBuildReqRejectsHostileInput(t *testing.T) {
+	for _, tt := range hostileBuildReqs {
+		t.Run(tt.name, func(t *testing.T) {
+			req := validBuildReq(tt.sourceType)
+			tt.modify(&req)
+			if err := validateBuildReq(req); err == nil {
+				t.Errorf("validateBuildReq() = nil, want an error")
+			}
+		})
+	}
+}
+
+// TestCreateBuildJobKeepsInputOutOfScripts builds Jobs from hostile requests,
+// as if validation had let them through, and checks that no user input is
+// part of a shell script
+func TestCreateBuildJobKeepsInputOutOfScripts(t *testing.T) {
+	for _, tt := range hostileBuildReqs {
+		for strategy := range buildStrategies {
+			t.Run(tt.name+"/"+strategy, func(t *testing.T) {
+				req := validBuildReq(tt.sourceType)
+				tt.modify(&req)
+				req.Source = strings.ReplaceAll(req.Source, "https://github.com/x/y.git", "https://github.com/"+hostile)
+
+				job := createBuildJob("builds", req, strategy)
+
+				pod := job.Spec.Template.Spec
+				if pod.AutomountServiceAccountToken == nil || *pod.AutomountServiceAccountToken {
+					t.Error("build Job mounts a ServiceAccount token")
+				}
+				for _, c := range append(pod.InitContainers, pod.Containers...) {
+					if script, ok := shellScript(c); ok && strings.Contains(script, hostile) {
+						t.Errorf("container %s runs user input in its script: %q", c.Name, script)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFetchContainerPassesGitSourceThroughEnv(t *testing.T) {
+	req := validBuildReq("git")
+	req.GitAuthSecret = "build-1a2b3c4d-git"
+
+	c := fetchContainer(req)
+	env := map[string]string{}
+	for _, v := range c.Env {
+		env[v.Name] = v.Value
+	}
+
+	if env["GIT_URL"] != req.Source {
+		t.Errorf("GIT_URL = %q, want %q", env["GIT_URL"], req.Source)
+	}
+	if env["GIT_REF"] != req.GitRef {
+		t.Errorf("GIT_REF = %q, want %q", env["GIT_REF"], req.GitRef)
+	}
+	if env["GIT_ALLOW_PROTOCOL"] != gitAllowProtocol {
+		t.Errorf("GIT_ALLOW_PROTOCOL = %q, want %q", env["GIT_ALLOW_PROTOCOL"], gitAllowProtocol)
+	}
+	if env["GIT_TERMINAL_PROMPT"] != "0" {
+		t.Errorf("git credentials are missing from the environment: %v", env)
+	}
+}
+
+func TestSourceDirStaysInWorkspace(t *testing.T) {
+	tests := map[string]string{
+		"":                  "/workspace",
+		"./":                "/workspace",
+		"services/api":      "/workspace/services/api",
+		"../":               "/workspace",
+		"../workspace-x":    "/workspace",
+		"../workspace2/src": "/workspace",
+		"a/../../etc":       "/workspace",
+	}
+	for sourcePath, want := range tests {
+		if got := sourceDir(BuildReq{SourcePath: sourcePath}); got != want {
+			t.Errorf("sourceDir(%q) = %q, want %q", sourcePath, got, want)
+		}
+	}
+}
+
+// shellScript returns the script a container hands to sh -c
+func shellScript(c corev1.Container) (string, bool) {
+	args := append(append([]string{}, c.Command...), c.Args...)
+	for i, arg := range args {
+		if (arg == "sh" || arg == "/bin/sh") && i+2 < len(args) && args[i+1] == "-c" {
+			return args[i+2], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ============================================================================
+// Build Scheduling
+// ============================================================================
+
+const (
+	// Environment variable names for scheduler configuration
+	tenantConcurrencyEnv = "BUILD_TENANT_CONCURRENCY" // Builds one tenant runs in parallel on one replica
+	tenantWeightsEnv     = "BUILD_TENANT_WEIGHTS"     // Shares of the build slots: tenant-a=2,tenant-b=0.5
+
+	// Default values
+	defaultTenantConcurrency = 1
+	defaultTenantWeight      = 1.0
+	defaultTenant            = "default"
+
+	// maxQueuedBuilds bounds the builds one replica holds while they wait for
+	// a slot; further requests are left to other replicas
+	maxQueuedBuilds = 200
+
+	// initialBuildDuration estimates how long a build takes until one has
+	// finished on this replica
+	initialBuildDuration = 2 * time.Minute
+
+	// durationSmoothing is the weight of the latest build in the moving
+	// average of build durations
+	durationSmoothing = 0.2
+)
+
+// queuedBuild is a build request waiting for a build slot
+type queuedBuild struct {
+	req      BuildReq
+	msg      *nats.Msg
+	position int // queue position last reported to the API
+}
+
+// tenantQueue holds the waiting builds of one tenant. vtime is the virtual
+// time of the tenant: it advances by 1/weight with every build the tenant
+// starts, and the tenant with the lowest virtual time starts next.
+type tenantQueue struct {
+	builds  []*queuedBuild
+	running int
+	weight  float64
+	vtime   float64
+}
+
+// scheduler starts builds in weighted fair order across tenants, at most
+// limit at once and at most tenantLimit per tenant. Builds wait in memory,
+// their requests kept unacked with progress acks.
+type scheduler struct {
+	js          nats.JetStreamContext
+	run         func(msg *nats.Msg, req BuildReq)
+	limit       int
+	tenantLimit int
+	weights     map[string]float64
+
+	mu          sync.Mutex
+	tenants     map[string]*tenantQueue
+	running     int
+	queued      int
+	avgDuration time.Duration
+}
+
+func newScheduler(js nats.JetStreamContext, limit, tenantLimit int, weights map[string]float64,
+	run func(msg *nats.Msg, req BuildReq)) *scheduler {
+	s := &scheduler{
+		js:          js,
+		run:         run,
+		limit:       limit,
+		tenantLimit: tenantLimit,
+		weights:     weights,
+		tenants:     map[string]*tenantQueue{},
+		avgDuration: initialBuildDuration,
+	}
+	go s.keepQueuedAlive()
+	return s
+}
+
+// schedulerConfig reads the per-tenant concurrency limit and the tenant
+// weights from the environment
+func schedulerConfig() (tenantLimit int, weights map[string]float64, err error) {
+	tenantLimit = defaultTenantConcurrency
+	if v := os.Getenv(tenantConcurrencyEnv); v != "" {
+		if tenantLimit, err = strconv.Atoi(v); err != nil || tenantLimit < 1 {
+			return 0, nil, fmt.Errorf("invalid %s: %q", tenantConcurrencyEnv, v)
+		}
+	}
+
+	weights = map[string]float64{}
+	for _, entry := range strings.Split(os.Getenv(tenantWeightsEnv), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.ParseFloat(value, 64)
+		if !ok || tenant == "" || err != nil || weight <= 0 {
+			return 0, nil, fmt.Errorf("invalid %s entry: %q", tenantWeightsEnv, entry)
+		}
+		weights[tenant] = weight
+	}
+	return tenantLimit, weights, nil
+}
+
+// tenantOf returns the tenant a build is scheduled for: the function's
+// namespace, taken from the image reference for requests that do not name it
+func tenantOf(req BuildReq) string {
+	if req.Tenant != "" {
+		return req.Tenant
+	}
+	if _, repository, _, ok := splitImageRef(req.ImageRef); ok {
+		if namespace, _, found := strings.Cut(repository, "/"); found {
+			return namespace
+		}
+	}
+	return defaultTenant
+}
+
+// submit queues a build and starts whatever builds fit in the free slots
+func (s *scheduler) submit(msg *nats.Msg, req BuildReq) {
+	s.mu.Lock()
+	if s.queued >= maxQueuedBuilds {
+		s.mu.Unlock()
+		msg.NakWithDelay(busyDelay)
+		return
+	}
+
+	name := tenantOf(req)
+	tenant, ok := s.tenants[name]
+	if !ok {
+		tenant = &tenantQueue{weight: defaultTenantWeight}
+		if weight, ok := s.weights[name]; ok {
+			tenant.weight = weight
+		}
+		// A tenant that was idle joins at the virtual time of the busiest
+		// tenants, so it cannot claim the slots it left unused
+		tenant.vtime = s.minVirtualTime()
+		s.tenants[name] = tenant
+	}
+	tenant.builds = append(tenant.builds, &queuedBuild{req: req, msg: msg})
+	s.queued++
+
+	s.dispatch()
+	updates := s.queueUpdates()
+	s.mu.Unlock()
+
+	s.publishQueue(updates)
+}
+
+// dispatch starts queued builds while slots are free. The caller holds mu.
+func (s *scheduler) dispatch() {
+	for s.running < s.limit {
+		name, tenant := s.next()
+		if tenant == nil {
+			return
+		}
+		build := tenant.builds[0]
+		tenant.builds = tenant.builds[1:]
+		tenant.running++
+		tenant.vtime += 1 / tenant.weight
+		s.queued--
+		s.running++
+
+		go s.runBuild(name, build)
+	}
+}
+
+// next returns the tenant whose build starts next: the one with the lowest
+// virtual time among those with a waiting build and a free tenant slot
+func (s *scheduler) next() (string, *tenantQueue) {
+	var nextName string
+	var next *tenantQueue
+	for name, tenant := range s.tenants {
+		if len(tenant.builds) == 0 || tenant.running >= s.tenantLimit {
+			continue
+		}
+		if next == nil || tenant.vtime < next.vtime || (tenant.vtime == next.vtime && name < nextName) {
+			nextName, next = name, tenant
+		}
+	}
+	return nextName, next
+}
+
+// minVirtualTime is the lowest virtual time of the tenants with builds
+func (s *scheduler) minVirtualTime() float64 {
+	vtime := math.Inf(1)
+	for _, tenant := range s.tenants {
+		if len(tenant.builds) > 0 || tenant.running > 0 {
+			vtime = math.Min(vtime, tenant.vtime)
+		}
+	}
+	if math.IsInf(vtime, 1) {
+		return 0
+	}
+	return vtime
+}
+
+func (s *scheduler) runBuild(name string, build *queuedBuild) {
+	started := time.Now()
+	s.run(build.msg, build.req)
+	elapsed := time.Since(started)
+
+	s.mu.Lock()
+	s.running--
+	tenant := s.tenants[name]
+	tenant.running--
+	if len(tenant.builds) == 0 && tenant.running == 0 {
+		delete(s.tenants, name)
+	}
+	s.avgDuration = time.Duration((1-durationSmoothing)*float64(s.avgDuration) + durationSmoothing*float64(elapsed))
+
+	s.dispatch()
+	updates := s.queueUpdates()
+	s.mu.Unlock()
+
+	s.publishQueue(updates)
+}
+
+// queueUpdates returns a queued status for every waiting build whose
+// position changed. Positions follow the order fair queuing would start the
+// builds in; the estimated wait assumes builds of average length. The caller
+// holds mu.
+func (s *scheduler) queueUpdates() []Status {
+	vtimes := make(map[*tenantQueue]float64, len(s.tenants))
+	taken := make(map[*tenantQueue]int, len(s.tenants))
+	for _, tenant := range s.tenants {
+		vtimes[tenant] = tenant.vtime
+	}
+
+	var updates []Status
+	for position := 1; position <= s.queued; position++ {
+		var nextName string
+		var next *tenantQueue
+		for name, tenant := range s.tenants {
+			if taken[tenant] == len(tenant.builds) {
+				continue
+			}
+			if next == nil || vtimes[tenant] < vtimes[next] || (vtimes[tenant] == vtimes[next] && name < nextName) {
+				nextName, next = name, tenant
+			}
+		}
+		build := next.builds[taken[next]]
+		taken[next]++
+		vtimes[next] += 1 / next.weight
+
+		if build.position == position {
+			continue
+		}
+		build.position = position
+		wait := time.Duration(math.Ceil(float64(position)/float64(s.limit))) * s.avgDuration
+		updates = append(updates, Status{
+			BuildID:              build.req.BuildID,
+			Event:                "queued",
+			Message:              fmt.Sprintf("Waiting for a build slot (position %d)", position),
+			QueuePosition:        position,
+			EstimatedWaitSeconds: int(wait.Seconds()),
+		})
+	}
+	return updates
+}
+
+func (s *scheduler) publishQueue(updates []Status) {
+	for _, status := range updates {
+		publishStatus(s.js, status)
+	}
+}
+
+// keepQueuedAlive sends progress acks for the waiting builds, so their
+// requests are not redelivered to another replica
+func (s *scheduler) keepQueuedAlive() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		msgs := make([]*nats.Msg, 0, s.queued)
+		for _, tenant := range s.tenants {
+			for _, build := range tenant.builds {
+				msgs = append(msgs, build.msg)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, msg := range msgs {
+			if err := msg.InProgress(); err != nil {
+				log.Printf("Failed to extend queued build request: %v", err)
+			}
+		}
+	}
+}
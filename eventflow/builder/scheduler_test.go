@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// recordingJS keeps the statuses the scheduler publishes
+type recordingJS struct {
+	nats.JetStreamContext
+
+	mu       sync.Mutex
+	statuses []Status
+}
+
+func (r *recordingJS) Publish(subject string, data []byte, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.statuses = append(r.statuses, status)
+	r.mu.Unlock()
+	return &nats.PubAck{}, nil
+}
+
+// waitPositions waits until the positions last published match want
+func (r *recordingJS) waitPositions(t *testing.T, want map[string]int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := r.positions()
+		matched := true
+		for id, position := range want {
+			matched = matched && got[id] == position
+		}
+		if matched {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("positions = %v, want %v", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// positions returns the queue position last published for each build
+func (r *recordingJS) positions() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	positions := map[string]int{}
+	for _, status := range r.statuses {
+		if status.Event == "queued" {
+			positions[status.BuildID] = status.QueuePosition
+		}
+	}
+	return positions
+}
+
+// blockingRun is a scheduler run func that reports each build it starts and
+// holds it until it is finished
+type blockingRun struct {
+	started chan string
+
+	mu   sync.Mutex
+	done map[string]chan struct{}
+}
+
+func newBlockingRun() *blockingRun {
+	return &blockingRun{started: make(chan string, 16), done: map[string]chan struct{}{}}
+}
+
+func (b *blockingRun) run(msg *nats.Msg, req BuildReq) {
+	b.started <- req.BuildID
+	<-b.doneChan(req.BuildID)
+}
+
+func (b *blockingRun) doneChan(id string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done[id] == nil {
+		b.done[id] = make(chan struct{})
+	}
+	return b.done[id]
+}
+
+// finish lets a build return
+func (b *blockingRun) finish(ids ...string) {
+	for _, id := range ids {
+		close(b.doneChan(id))
+	}
+}
+
+// next waits for the next build to start
+func (b *blockingRun) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case id := <-b.started:
+		return id
+	case <-time.After(time.Second):
+		t.Fatal("no build started")
+		return ""
+	}
+}
+
+// none checks that no further build starts
+func (b *blockingRun) none(t *testing.T) {
+	t.Helper()
+	select {
+	case id := <-b.started:
+		t.Fatalf("build %s started, want none", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func submitBuilds(s *scheduler, builds ...[2]string) {
+	for _, build := range builds {
+		s.submit(nil, BuildReq{BuildID: build[0], Tenant: build[1]})
+	}
+}
+
+func TestSchedulerStartsBuildsInWeightedFairOrder(t *testing.T) {
+	js := &recordingJS{}
+	run := newBlockingRun()
+	s := newScheduler(js, 1, 1, map[string]float64{"tenant-a": 2}, run.run)
+
+	// a1 takes the only slot; tenant-b joins at tenant-a's virtual time
+	submitBuilds(s, [2]string{"a1", "tenant-a"})
+	if id := run.next(t); id != "a1" {
+		t.Fatalf("first build = %s, want a1", id)
+	}
+	submitBuilds(s,
+		[2]string{"a2", "tenant-a"}, [2]string{"a3", "tenant-a"}, [2]string{"a4", "tenant-a"},
+		[2]string{"b1", "tenant-b"}, [2]string{"b2", "tenant-b"})
+
+	want := []string{"a2", "b1", "a3", "a4", "b2"}
+	running := "a1"
+	for _, wantID := range want {
+		run.finish(running)
+		if running = run.next(t); running != wantID {
+			t.Fatalf("next build = %s, want %s (order %v)", running, wantID, want)
+		}
+	}
+	run.finish(running)
+	run.none(t)
+}
+
+func TestSchedulerRespectsTenantLimit(t *testing.T) {
+	run := newBlockingRun()
+	s := newScheduler(&recordingJS{}, 3, 1, nil, run.run)
+
+	submitBuilds(s, [2]string{"a1", "tenant-a"}, [2]string{"a2", "tenant-a"}, [2]string{"b1", "tenant-b"})
+
+	started := map[string]bool{run.next(t): true, run.next(t): true}
+	if !started["a1"] || !started["b1"] {
+		t.Fatalf("started %v, want a1 and b1", started)
+	}
+	// A slot is free, but tenant-a already runs its one build
+	run.none(t)
+
+	s.mu.Lock()
+	running, queued := s.running, s.queued
+	s.mu.Unlock()
+	if running != 2 || queued != 1 {
+		t.Errorf("running %d, queued %d, want 2 and 1", running, queued)
+	}
+
+	run.finish("a1")
+	if id := run.next(t); id != "a2" {
+		t.Errorf("next build = %s, want a2", id)
+	}
+	run.finish("a2", "b1")
+}
+
+func TestSchedulerQueueUpdates(t *testing.T) {
+	js := &recordingJS{}
+	run := newBlockingRun()
+	s := newScheduler(js, 1, 1, map[string]float64{"tenant-a": 2}, run.run)
+
+	submitBuilds(s, [2]string{"a1", "tenant-a"})
+	run.next(t)
+	submitBuilds(s,
+		[2]string{"a2", "tenant-a"}, [2]string{"a3", "tenant-a"}, [2]string{"a4", "tenant-a"},
+		[2]string{"b1", "tenant-b"}, [2]string{"b2", "tenant-b"})
+
+	// Positions follow the fair order, whatever order the builds arrived in
+	js.waitPositions(t, map[string]int{"a2": 1, "b1": 2, "a3": 3, "a4": 4, "b2": 5})
+	if _, ok := js.positions()["a1"]; ok {
+		t.Error("the running build a1 was reported queued")
+	}
+	// One slot and no finished build: every position waits one initial estimate
+	js.mu.Lock()
+	for _, status := range js.statuses {
+		if want := status.QueuePosition * int(initialBuildDuration.Seconds()); status.EstimatedWaitSeconds != want {
+			t.Errorf("estimated wait of %s at position %d = %ds, want %ds",
+				status.BuildID, status.QueuePosition, status.EstimatedWaitSeconds, want)
+		}
+	}
+	js.mu.Unlock()
+
+	s.mu.Lock()
+	if updates := s.queueUpdates(); len(updates) != 0 {
+		t.Errorf("queueUpdates() = %v, want no updates when no position changed", updates)
+	}
+	s.mu.Unlock()
+
+	// Every later build moves up when one starts
+	js.mu.Lock()
+	js.statuses = nil
+	js.mu.Unlock()
+	run.finish("a1")
+	run.next(t)
+	js.waitPositions(t, map[string]int{"b1": 1, "a3": 2, "a4": 3, "b2": 4})
+
+	js.mu.Lock()
+	for _, status := range js.statuses {
+		// a1 was quick, so the average build time dropped
+		wait := status.QueuePosition * int(initialBuildDuration.Seconds())
+		if status.Event == "queued" && status.EstimatedWaitSeconds >= wait {
+			t.Errorf("estimated wait of %s = %ds, want at most %ds", status.BuildID, status.EstimatedWaitSeconds, wait)
+		}
+	}
+	js.mu.Unlock()
+
+	for _, id := range []string{"a2", "b1", "a3", "a4"} {
+		run.finish(id)
+		run.next(t)
+	}
+	run.finish("b2")
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ============================================================================
+// Inline Source
+// ============================================================================
+
+const (
+	// sourceArchiveKey is the ConfigMap key holding an inline source archive
+	sourceArchiveKey = "source.tar.gz"
+
+	// maxSourceBytes bounds an inline source archive; it has to fit in a
+	// ConfigMap, which Kubernetes caps at 1 MiB
+	maxSourceBytes = 900 * 1024
+
+	// maxUnpackedSourceBytes bounds the files read out of an uploaded archive
+	maxUnpackedSourceBytes = 16 * 1024 * 1024
+)
+
+// runtimeScaffold describes what an inline source of a runtime needs to build
+// with buildpacks
+type runtimeScaffold struct {
+	entrypoint string            // file a single source_code is written to
+	files      map[string]string // generated when the source lacks them
+}
+
+// runtimeScaffolds are the runtimes inline source can be written in
+var runtimeScaffolds = map[string]runtimeScaffold{
+	"python": {
+		entrypoint: "main.py",
+		files: map[string]string{
+			"requirements.txt": "",
+			"Procfile":         "web: python main.py\n",
+		},
+	},
+	"node": {
+		entrypoint: "index.js",
+		files: map[string]string{
+			"package.json": `{
+  "name": "function",
+  "version": "1.0.0",
+  "private": true,
+  "main": "index.js",
+  "scripts": {
+    "start": "node index.js"
+  }
+}
+`,
+		},
+	},
+	"go": {
+		entrypoint: "main.go",
+		files: map[string]string{
+			"go.mod": "module function\n\ngo 1.22\n",
+		},
+	},
+}
+
+// runtimeAliases map alternative runtime names onto runtimeScaffolds keys
+var runtimeAliases = map[string]string{
+	"python3": "python",
+	"nodejs":  "node",
+	"golang":  "go",
+}
+
+// inlineSource reads the files of a code build: the uploaded archive, the
+// file map, or the single source written to the runtime's entrypoint
+func inlineSource(req BuildReq) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	switch {
+	case req.Archive != "":
+		archive, err := base64.StdEncoding.DecodeString(req.Archive)
+		if err != nil {
+			return nil, fmt.Errorf("source archive is not base64 encoded: %w", err)
+		}
+		if files, err = readArchive(archive); err != nil {
+			return nil, fmt.Errorf("invalid source archive: %w", err)
+		}
+
+	case len(req.Files) > 0:
+		for name, content := range req.Files {
+			clean, err := cleanSourcePath(name)
+			if err != nil {
+				return nil, err
+			}
+			files[clean] = []byte(content)
+		}
+
+	default:
+		if autoRuntime(req.Runtime) {
+			return nil, fmt.Errorf("runtime %q needs source files or an archive: a single source has no file name to detect its language from", req.Runtime)
+		}
+		scaffold, ok := runtimeScaffolds[scaffoldRuntime(req.Runtime)]
+		if !ok {
+			return nil, fmt.Errorf("runtime %q does not support inline source", req.Runtime)
+		}
+		files[scaffold.entrypoint] = []byte(req.Source)
+	}
+	return files, nil
+}
+
+// scaffoldSource completes the files of a code build with the manifest files
+// its runtime needs to build with buildpacks. A source that was detected to
+// build from its Dockerfile needs none.
+func scaffoldSource(files map[string][]byte, runtime string, detected detection) error {
+	scaffold, ok := runtimeScaffolds[scaffoldRuntime(runtime)]
+	switch {
+	case ok:
+	case detected.Dockerfile && !buildsWithBuildpacks(detected.Strategy):
+		return nil
+	case runtime == "":
+		return fmt.Errorf("could not detect the runtime of the source: add one of %s, or name the runtime",
+			strings.Join(manifestNames(), ", "))
+	default:
+		return fmt.Errorf("runtime %q does not support inline source", runtime)
+	}
+
+	for name, content := range scaffold.files {
+		if _, ok := files[name]; !ok {
+			files[name] = []byte(content)
+		}
+	}
+	return nil
+}
+
+// scaffoldRuntime maps a runtime name onto its runtimeScaffolds key
+func scaffoldRuntime(runtime string) string {
+	if alias, ok := runtimeAliases[runtime]; ok {
+		return alias
+	}
+	return runtime
+}
+
+// cleanSourcePath returns a source file name relative to the workspace, or
+// an error when it would point outside of it
+func cleanSourcePath(name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if name == "" || path.IsAbs(name) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid source file name %q", name)
+	}
+	return clean, nil
+}
+
+// readArchive reads the regular files of a gzipped tar archive
+func readArchive(archive []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	var total int64
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name, err := cleanSourcePath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		total += hdr.Size
+		if total > maxUnpackedSourceBytes {
+			return nil, fmt.Errorf("unpacked source exceeds %d bytes", maxUnpackedSourceBytes)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+}
+
+// writeArchive packs files into a gzipped tar archive
+func writeArchive(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name]))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// createSourceConfigMap stores the archive of a code build in a ConfigMap the
+// fetch container unpacks. A redelivered build replaces the one stored before.
+func createSourceConfigMap(ctx context.Context, clientset *kubernetes.Clientset, namespace string, req BuildReq, files map[string][]byte) error {
+	archive, err := writeArchive(files)
+	if err != nil {
+		return fmt.Errorf("failed to pack source: %w", err)
+	}
+	if len(archive) > maxSourceBytes {
+		return fmt.Errorf("packed source is %d bytes, more than the %d allowed", len(archive), maxSourceBytes)
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      sourceConfigMapName(req),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":      "builder",
+				"build-id": req.BuildID,
+			},
+		},
+		BinaryData: map[string][]byte{sourceArchiveKey: archive},
+	}
+
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+	_, err = configMaps.Create(ctx, cm, meta.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = configMaps.Update(ctx, cm, meta.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store source: %w", err)
+	}
+	return nil
+}
+
+// ownSourceConfigMap makes the build Job the owner of its source ConfigMap,
+// so the ConfigMap is deleted along with the Job
+func ownSourceConfigMap(ctx context.Context, clientset *kubernetes.Clientset, req BuildReq, job *batchv1.Job) error {
+	patch := fmt.Sprintf(`{"metadata":{"ownerReferences":[{"apiVersion":"batch/v1","kind":"Job","name":%q,"uid":%q}]}}`,
+		job.Name, job.UID)
+	_, err := clientset.CoreV1().ConfigMaps(job.Namespace).Patch(ctx, sourceConfigMapName(req),
+		types.MergePatchType, []byte(patch), meta.PatchOptions{})
+	return err
+}
+
+// sourceConfigMapName names the ConfigMap holding a code build's source
+func sourceConfigMapName(req BuildReq) string {
+	return fmt.Sprintf("build-%s-source", req.BuildID[:8])
+}
+
+// ============================================================================
+// Uploaded Source
+// ============================================================================
+
+// archiveFormat returns the format of a tar build's archive, zip or tar.gz,
+// from the extension the API stored it under
+func archiveFormat(req BuildReq) string {
+	u, err := url.Parse(req.Source)
+	if err == nil && strings.HasSuffix(u.Path, ".zip") {
+		return "zip"
+	}
+	return "tar.gz"
+}
+
+// ============================================================================
+// Git Credentials
+// ============================================================================
+
+const (
+	// Where the fetch container finds the build's git credentials and the
+	// SSH host keys git may connect to
+	gitAuthMountPath    = "/git-auth"
+	knownHostsMountPath = "/etc/git-known-hosts"
+
+	// knownHostsConfigMapEnv names the ConfigMap of SSH host keys trusted
+	// besides those a build's credentials bring
+	knownHostsConfigMapEnv     = "KNOWN_HOSTS_CONFIGMAP"
+	defaultKnownHostsConfigMap = "git-known-hosts"
+)
+
+// commitPattern matches the SHA-1 or SHA-256 object name of a commit
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// gitAuthEnv configures git to authenticate with the credentials of a build's
+// git auth Secret, unpacked in dir: a credential helper answers HTTPS
+// prompts from username and password, and SSH uses ssh-privatekey, trusting
+// only the hosts in known_hosts and the known hosts ConfigMap. Credentials
+// reach git through files, never through its command line.
+func gitAuthEnv(dir string) []corev1.EnvVar {
+	helper := fmt.Sprintf(`!f() { echo "username=$(cat %[1]s/username)"; echo "password=$(cat %[1]s/password)"; }; f`, dir)
+	ssh := fmt.Sprintf("ssh -i %[1]s/ssh-privatekey -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes"+
+		" -o UserKnownHostsFile=%[1]s/known_hosts -o GlobalKnownHostsFile=%[2]s/known_hosts", dir, knownHostsMountPath)
+
+	return []corev1.EnvVar{
+		{Name: "GIT_CONFIG_COUNT", Value: "1"},
+		{Name: "GIT_CONFIG_KEY_0", Value: "credential.helper"},
+		{Name: "GIT_CONFIG_VALUE_0", Value: helper},
+		{Name: "GIT_SSH_COMMAND", Value: ssh},
+		{Name: "GIT_TERMINAL_PROMPT", Value: "0"},
+	}
+}
+
+// gitAuthVolumes are the build's git auth Secret, readable by its owner only
+// as ssh requires of a private key, and the known hosts ConfigMap
+func gitAuthVolumes(req BuildReq) []corev1.Volume {
+	ownerOnly := int32(0o400)
+	optional := true
+	return []corev1.Volume{
+		{
+			Name: "git-auth",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  req.GitAuthSecret,
+					DefaultMode: &ownerOnly,
+				},
+			},
+		},
+		{
+			Name: "git-known-hosts",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: getEnvOrDefault(knownHostsConfigMapEnv, defaultKnownHostsConfigMap),
+					},
+					Optional: &optional,
+				},
+			},
+		},
+	}
+}
+
+// gitAuthMounts mount the volumes of gitAuthVolumes where gitAuthEnv
+// expects them
+func gitAuthMounts() []corev1.VolumeMount {
+	return []corev1.VolumeMount{
+		{Name: "git-auth", MountPath: gitAuthMountPath, ReadOnly: true},
+		{Name: "git-known-hosts", MountPath: knownHostsMountPath, ReadOnly: true},
+	}
+}
+
+// ownGitAuthSecret makes the build Job the owner of its git auth Secret, so
+// the Secret is garbage collected with the Job should the worker not delete
+// it
+func ownGitAuthSecret(ctx context.Context, clientset *kubernetes.Clientset, req BuildReq, job *batchv1.Job) error {
+	patch := fmt.Sprintf(`{"metadata":{"ownerReferences":[{"apiVersion":"batch/v1","kind":"Job","name":%q,"uid":%q}]}}`,
+		job.Name, job.UID)
+	_, err := clientset.CoreV1().Secrets(job.Namespace).Patch(ctx, req.GitAuthSecret,
+		types.MergePatchType, []byte(patch), meta.PatchOptions{})
+	return err
+}
+
+// deleteGitAuthSecret removes a build's git credentials once its Job is done
+// with them
+func deleteGitAuthSecret(ctx context.Context, clientset *kubernetes.Clientset, namespace string, req BuildReq) {
+	err := clientset.CoreV1().Secrets(namespace).Delete(ctx, req.GitAuthSecret, meta.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("Failed to delete git credentials of %s: %v", req.BuildID, err)
+	}
+}
+
+// fetchedCommit returns the commit the fetch container of a git build
+// checked out, or "" when it reported none
+func fetchedCommit(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName string) string {
+	commit := terminationMessage(ctx, clientset, namespace, jobName, "fetch")
+	if !commitPattern.MatchString(commit) {
+		return ""
+	}
+	return commit
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ============================================================================
+// Build Strategies
+// ============================================================================
+
+const (
+	// Build strategies
+	strategyCloudNativeBuildpacks = "cnb"      // CNB lifecycle run directly in the builder image, rootless
+	strategyPack                  = "pack"     // pack CLI image against a Docker-in-Docker sidecar (privileged)
+	strategyKaniko                = "kaniko"   // Dockerfile build with Kaniko, unprivileged
+	strategyBuildKit              = "buildkit" // Dockerfile build with rootless BuildKit
+	strategyAuto                  = "auto"     // Dockerfile strategy if the source has a Dockerfile, else CNB
+
+	// Environment variable names for strategy configuration
+	buildkitImageEnv      = "BUILDKIT_IMAGE"      // Rootless BuildKit image
+	dockerfileStrategyEnv = "DOCKERFILE_STRATEGY" // Strategy for sources with a Dockerfile: kaniko or buildkit
+	insecureRegistryEnv   = "INSECURE_REGISTRY"   // Registry pushed to over plain HTTP
+
+	// Default values
+	defaultKanikoImage      = "gcr.io/kaniko-project/executor:v1.23.2"
+	defaultBuildKitImage    = "moby/buildkit:v0.16.0-rootless"
+	defaultPackImage        = "buildpacksio/pack:0.35.1"
+	defaultDindImage        = "docker:24-dind"
+	defaultInsecureRegistry = "docker-registry.eventflow.svc.cluster.local:5000"
+
+	// buildContainerName is the Job pod's container that builds and pushes
+	// the image, and reports its digest in its termination message
+	buildContainerName = "build"
+
+	// User the CNB lifecycle and rootless BuildKit run as
+	cnbUserID      = 1000
+	buildkitUserID = 1000
+
+	// detectContainerName is the detect Job's container, which reports the
+	// listing of the source in its termination message
+	detectContainerName = "detect"
+
+	// How long a detect Job may take to list a git repository or uploaded archive
+	detectTimeout = time.Minute
+)
+
+// buildStrategy adds the containers and settings that build the fetched
+// source in /workspace to a build Job's pod
+type buildStrategy func(req BuildReq, pod *corev1.PodSpec)
+
+// buildStrategies are the strategies a build request may prefer
+var buildStrategies = map[string]buildStrategy{
+	strategyCloudNativeBuildpacks: cnbStrategy,
+	strategyPack:                  packStrategy,
+	strategyKaniko:                kanikoStrategy,
+	strategyBuildKit:              buildkitStrategy,
+}
+
+// cnbStrategy runs the CNB lifecycle creator in the builder image for the
+// runtime. It needs neither a Docker daemon nor privileges.
+func cnbStrategy(req BuildReq, pod *corev1.PodSpec) {
+	uid := int64(cnbUserID)
+	pod.SecurityContext = &corev1.PodSecurityContext{FSGroup: &uid}
+	pod.Volumes = append(pod.Volumes, emptyDirVolume("layers"))
+
+	env := buildEnv(req)
+	if registry := insecureRegistry(req.ImageRef); registry != "" {
+		env = append(env, corev1.EnvVar{Name: "CNB_INSECURE_REGISTRIES", Value: registry})
+	}
+	if cache := cacheImage(req, strategyCloudNativeBuildpacks); cache != "" {
+		env = append(env, corev1.EnvVar{Name: "CACHE_IMAGE", Value: cache})
+	}
+
+	pod.Containers = append(pod.Containers, corev1.Container{
+		Name:    buildContainerName,
+		Image:   cnbBuilderImage(req.Runtime),
+		Command: []string{"/bin/sh", "-c"},
+		Args: []string{`
+			set -e
+			/cnb/lifecycle/creator -app="$APP_DIR" -layers=/layers -report=/layers/report.toml \
+				${CACHE_IMAGE:+-cache-image="$CACHE_IMAGE"} "$IMAGE_REF"
+
+			# Hand the pushed manifest digest to the worker
+			grep -o 'sha256:[0-9a-f]\{64\}' /layers/report.toml | head -n 1 > /dev/termination-log || true
+			`,
+		},
+		Env: env,
+		VolumeMounts: append(buildMounts(),
+			corev1.VolumeMount{Name: "layers", MountPath: "/layers"},
+		),
+		SecurityContext:          restrictedSecurityContext(uid),
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	})
+}
+
+// packStrategy runs a prebuilt pack CLI image against a Docker-in-Docker
+// sidecar. The sidecar must run privileged; prefer cnb where that is not
+// allowed.
+func packStrategy(req BuildReq, pod *corev1.PodSpec) {
+	pod.InitContainers = append(pod.InitContainers, dindSidecar())
+
+	args := []string{
+		"build", req.ImageRef,
+		"--path", sourceDir(req),
+		"--builder", cnbBuilderImage(req.Runtime),
+		"--publish",
+		"--trust-builder",
+	}
+	if cache := cacheImage(req, strategyPack); cache != "" {
+		args = append(args, "--cache-image", cache)
+	}
+
+	env := append(buildEnv(req), corev1.EnvVar{Name: "DOCKER_HOST", Value: "tcp://localhost:2375"})
+	pod.Containers = append(pod.Containers, corev1.Container{
+		Name:         buildContainerName,
+		Image:        getEnvOrDefault(packImageEnv, defaultPackImage),
+		Args:         args,
+		Env:          env,
+		VolumeMounts: buildMounts(),
+	})
+}
+
+// kanikoStrategy builds the source's Dockerfile with Kaniko, which needs no
+// privileges and no Docker daemon
+func kanikoStrategy(req BuildReq, pod *corev1.PodSpec) {
+	dir := sourceDir(req)
+	args := []string{
+		"--context=dir://" + dir,
+		"--dockerfile=" + path.Join(dir, "Dockerfile"),
+		"--destination=" + req.ImageRef,
+		"--digest-file=/dev/termination-log",
+	}
+	if registry := insecureRegistry(req.ImageRef); registry != "" {
+		args = append(args, "--insecure-registry="+registry)
+	}
+	// Kaniko tags cached layers by their cache key, so it gets the whole
+	// repository
+	if req.CacheRef != "" {
+		args = append(args, "--cache=true", "--cache-repo="+req.CacheRef)
+	}
+
+	pod.Containers = append(pod.Containers, corev1.Container{
+		Name:         buildContainerName,
+		Image:        getEnvOrDefault(kanikoImageEnv, defaultKanikoImage),
+		Args:         args,
+		Env:          buildEnv(req),
+		VolumeMounts: buildMounts(),
+		SecurityContext: &corev1.SecurityContext{
+			AllowPrivilegeEscalation: boolPtr(false),
+		},
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	})
+}
+
+// buildkitStrategy builds the source's Dockerfile with a rootless, daemonless
+// BuildKit. It runs unprivileged but without seccomp and AppArmor profiles,
+// which rootless BuildKit needs to create its namespaces.
+func buildkitStrategy(req BuildReq, pod *corev1.PodSpec) {
+	uid := int64(buildkitUserID)
+	insecure := ""
+	if insecureRegistry(req.ImageRef) != "" {
+		insecure = ",registry.insecure=true"
+	}
+	output := "type=image,name=" + req.ImageRef + ",push=true" + insecure
+
+	env := append(buildEnv(req),
+		corev1.EnvVar{Name: "BUILDKIT_OUTPUT", Value: output},
+		corev1.EnvVar{Name: "BUILDKITD_FLAGS", Value: "--oci-worker-no-process-sandbox"},
+	)
+	if cache := cacheImage(req, strategyBuildKit); cache != "" {
+		env = append(env,
+			corev1.EnvVar{Name: "BUILDKIT_CACHE_IMPORT", Value: "type=registry,ref=" + cache + insecure},
+			corev1.EnvVar{Name: "BUILDKIT_CACHE_EXPORT", Value: "type=registry,ref=" + cache + ",mode=max" + insecure},
+		)
+	}
+
+	pod.Containers = append(pod.Containers, corev1.Container{
+		Name:    buildContainerName,
+		Image:   getEnvOrDefault(buildkitImageEnv, defaultBuildKitImage),
+		Command: []string{"/bin/sh", "-c"},
+		Args: []string{`
+			set -e
+			buildctl-daemonless.sh build \
+				--frontend dockerfile.v0 \
+				--local context="$APP_DIR" \
+				--local dockerfile="$APP_DIR" \
+				--output "$BUILDKIT_OUTPUT" \
+				${BUILDKIT_CACHE_IMPORT:+--import-cache "$BUILDKIT_CACHE_IMPORT"} \
+				${BUILDKIT_CACHE_EXPORT:+--export-cache "$BUILDKIT_CACHE_EXPORT"} \
+				--metadata-file /tmp/metadata.json
+
+			# Hand the pushed manifest digest to the worker
+			sed -n 's/.*"containerimage.digest": *"\(sha256:[0-9a-f]*\)".*/\1/p' /tmp/metadata.json > /dev/termination-log || true
+			`,
+		},
+		Env:          env,
+		VolumeMounts: buildMounts(),
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:                &uid,
+			RunAsGroup:               &uid,
+			AllowPrivilegeEscalation: boolPtr(true), // newuidmap needs its setuid bit
+			SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+			AppArmorProfile:          &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined},
+		},
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	})
+}
+
+// ============================================================================
+// Container Definitions (Init and Main Containers)
+// ============================================================================
+
+// fetchContainer creates an init container that fetches source code
+// Supports three source types: git (clone repo), tar (download/extract), code (inline, from a ConfigMap)
+func fetchContainer(req BuildReq) corev1.Container {
+	container := corev1.Container{
+		Name:  "fetch",
+		Image: "alpine/git:latest",
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "workspace", MountPath: "/workspace"},
+		},
+	}
+
+	// Build containers may run as another user than the fetch container
+	const shareWorkspace = " && chmod -R a+rwX /workspace"
+
+	switch req.SourceType {
+	case "git":
+		// Clone a Git repository and report the commit checked out. The ref
+		// and URL reach git through the environment, never as code.
+		container.Command = []string{"sh", "-c"}
+		container.Args = []string{
+			`git clone --depth 1 --branch "$GIT_REF" -- "$GIT_URL" /workspace` +
+				" && git -C /workspace rev-parse HEAD > /dev/termination-log" + shareWorkspace,
+		}
+		container.Env = []corev1.EnvVar{
+			{Name: "GIT_REF", Value: gitRef(req)},
+			{Name: "GIT_URL", Value: req.Source},
+			{Name: "GIT_ALLOW_PROTOCOL", Value: gitAllowProtocol},
+		}
+		if req.GitAuthSecret != "" {
+			container.Env = append(container.Env, gitAuthEnv(gitAuthMountPath)...)
+			container.VolumeMounts = append(container.VolumeMounts, gitAuthMounts()...)
+		}
+
+	case "tar":
+		// Download and unpack the uploaded archive from the URL the API signed.
+		// The URL reaches the shell through the environment, never as code.
+		unpack := "tar -xzf /tmp/source -C /workspace"
+		if archiveFormat(req) == "zip" {
+			unpack = "unzip -q /tmp/source -d /workspace"
+		}
+		container.Image = "busybox:latest"
+		container.Env = []corev1.EnvVar{{Name: "SOURCE_URL", Value: req.Source}}
+		container.Command = []string{"sh", "-c"}
+		container.Args = []string{
+			`wget -q -O /tmp/source "$SOURCE_URL" && ` + unpack + shareWorkspace,
+		}
+
+	case "code":
+		// Unpack the inline source the worker stored in a ConfigMap
+		container.Image = "busybox:latest"
+		container.Command = []string{"sh", "-c"}
+		container.Args = []string{
+			"tar -xzf /source/" + sourceArchiveKey + " -C /workspace" + shareWorkspace,
+		}
+		container.VolumeMounts = append(container.VolumeMounts,
+			corev1.VolumeMount{Name: "source", MountPath: "/source", ReadOnly: true},
+		)
+	}
+
+	return container
+}
+
+// listingScript turns a list of file names, one per line and relative to the
+// root of the source, into the listing of $SOURCE_DIR that parseListing reads
+const listingScript = `
+	BEGIN {
+		n = split(top, t, " "); for (i = 1; i <= n; i++) wanted[t[i]] = 1
+		n = split(exts, e, " "); for (i = 1; i <= n; i++) known[e[i]] = 1
+	}
+	{
+		name = $0
+		sub(/^\.\//, "", name)
+		if (dir != "") {
+			if (index(name, dir "/") != 1) next
+			name = substr(name, length(dir) + 2)
+		}
+		if (index(name, "/") == 0 && (name in wanted)) print name
+		n = split(name, parts, "/")
+		if (match(parts[n], /\.[^.]+$/) && (substr(parts[n], RSTART) in known)) count[substr(parts[n], RSTART)]++
+	}
+	END { for (ext in count) print "*" ext " " count[ext] }`
+
+// detectContainer creates the container of a detect Job, which lists the
+// source of a git or tar build without keeping it: a git repository is cloned
+// without file contents, an uploaded archive is downloaded and its entries
+// listed. Like fetchContainer, it takes the source only through the
+// environment.
+func detectContainer(req BuildReq) corev1.Container {
+	exts := make([]string, 0, len(runtimeExtensions))
+	for ext := range runtimeExtensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	container := corev1.Container{
+		Name:    detectContainerName,
+		Image:   "busybox:latest",
+		Command: []string{"sh", "-c"},
+		Env: []corev1.EnvVar{
+			{Name: "SOURCE_DIR", Value: sourceSubdir(req)},
+			{Name: "TOP_FILES", Value: strings.Join(append(manifestNames(), "Dockerfile"), " ")},
+			{Name: "EXTENSIONS", Value: strings.Join(exts, " ")},
+			{Name: "LISTING_SCRIPT", Value: listingScript},
+		},
+		// A failed listing reports why in place of the listing
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+	}
+
+	var list string
+	switch req.SourceType {
+	case "git":
+		// A blobless clone without checkout fetches the trees but no file contents
+		container.Image = "alpine/git:latest"
+		container.Env = append(container.Env,
+			corev1.EnvVar{Name: "GIT_REF", Value: gitRef(req)},
+			corev1.EnvVar{Name: "GIT_URL", Value: req.Source},
+			corev1.EnvVar{Name: "GIT_ALLOW_PROTOCOL", Value: gitAllowProtocol},
+		)
+		if req.GitAuthSecret != "" {
+			container.Env = append(container.Env, gitAuthEnv(gitAuthMountPath)...)
+			container.VolumeMounts = gitAuthMounts()
+		}
+		list = `git clone --quiet --depth 1 --filter=blob:none --no-checkout --branch "$GIT_REF" -- "$GIT_URL" /tmp/source` +
+			" && git -C /tmp/source -c core.quotePath=false ls-tree -r --name-only HEAD > /tmp/names"
+
+	case "tar":
+		container.Env = append(container.Env, corev1.EnvVar{Name: "SOURCE_URL", Value: req.Source})
+		list = `wget -q -O /tmp/source "$SOURCE_URL" && tar -tzf /tmp/source > /tmp/names`
+		if archiveFormat(req) == "zip" {
+			list = `wget -q -O /tmp/source "$SOURCE_URL" && unzip -l /tmp/source` +
+				` | awk 'NF >= 4 && $1 ~ /^[0-9]+$/ { sub(/^ *[0-9]+ +[^ ]+ +[^ ]+ +/, ""); print }' > /tmp/names`
+		}
+	}
+
+	container.Args = []string{
+		list + ` && awk -v dir="$SOURCE_DIR" -v top="$TOP_FILES" -v exts="$EXTENSIONS" "$LISTING_SCRIPT" /tmp/names > /dev/termination-log`,
+	}
+	return container
+}
+
+// dindSidecar creates a Docker-in-Docker sidecar container
+// Provides a Docker daemon for the pack strategy. It runs as a native sidecar,
+// so the build container starts once the daemon answers and the Job completes
+// when the build container exits.
+func dindSidecar() corev1.Container {
+	always := corev1.ContainerRestartPolicyAlways
+
+	args := []string{}
+	if registry := getEnvOrDefault(insecureRegistryEnv, defaultInsecureRegistry); registry != "" {
+		args = append(args, "--insecure-registry="+registry)
+	}
+
+	return corev1.Container{
+		Name:          "dind",
+		Image:         defaultDindImage,
+		RestartPolicy: &always,
+		Env: []corev1.EnvVar{
+			{Name: "DOCKER_TLS_CERTDIR", Value: ""}, // Disable TLS for local communication
+		},
+		SecurityContext: &corev1.SecurityContext{
+			Privileged: boolPtr(true), // Required for DinD to manage containers
+		},
+		Args: args,
+		StartupProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(2375)},
+			},
+			PeriodSeconds:    2,
+			FailureThreshold: 60,
+		},
+	}
+}
+
+// ============================================================================
+// Strategy Helpers
+// ============================================================================
+
+// cnbBuilderImage selects the CNB builder image for a runtime
+func cnbBuilderImage(runtime string) string {
+	switch runtime {
+	case "python", "python3", "node", "nodejs", "java":
+		return "paketobuildpacks/builder-jammy-base:latest"
+	case "go":
+		return "paketobuildpacks/builder-jammy-tiny:latest"
+	}
+	return getEnvOrDefault(builderImageEnv, defaultCNBBuilder)
+}
+
+// cacheImage returns the image a strategy keeps its build cache in: the
+// request's cache repository, tagged with the strategy so strategies never
+// read each other's cache. It is "" when the build is not cached.
+func cacheImage(req BuildReq, strategy string) string {
+	if req.CacheRef == "" {
+		return ""
+	}
+	return req.CacheRef + ":" + strategy
+}
+
+// buildEnv returns the environment every build container gets. Scripts read
+// the build's parameters from it rather than having them interpolated.
+func buildEnv(req BuildReq) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "APP_DIR", Value: sourceDir(req)},
+		{Name: "IMAGE_REF", Value: req.ImageRef},
+		{Name: "DOCKER_CONFIG", Value: "/docker-config"},
+	}
+}
+
+// buildMounts returns the volume mounts every build container gets: the
+// fetched source and the registry credentials
+func buildMounts() []corev1.VolumeMount {
+	return []corev1.VolumeMount{
+		{Name: "workspace", MountPath: "/workspace"},
+		{Name: "docker-config", MountPath: "/docker-config", ReadOnly: true},
+	}
+}
+
+// restrictedSecurityContext runs a container as an unprivileged user that
+// cannot gain privileges
+func restrictedSecurityContext(uid int64) *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		RunAsUser:                &uid,
+		RunAsNonRoot:             boolPtr(true),
+		AllowPrivilegeEscalation: boolPtr(false),
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+}
+
+// insecureRegistry returns the registry of imageRef when it is the one pushed
+// to over plain HTTP, and "" otherwise
+func insecureRegistry(imageRef string) string {
+	registry := getEnvOrDefault(insecureRegistryEnv, defaultInsecureRegistry)
+	if host, _, _ := strings.Cut(imageRef, "/"); host == registry {
+		return registry
+	}
+	return ""
+}
+
+// emptyDirVolume returns a scratch volume
+func emptyDirVolume(name string) corev1.Volume {
+	return corev1.Volume{
+		Name:         name,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}
+}
+
+// gitRef returns the branch or tag a git build checks out
+func gitRef(req BuildReq) string {
+	if req.GitRef == "" {
+		return "main"
+	}
+	return req.GitRef
+}
+
+// sourceDir returns the directory the build builds from: the workspace, or
+// the requested subdirectory of it
+func sourceDir(req BuildReq) string {
+	dir := path.Clean("/workspace/" + req.SourcePath)
+	if dir != "/workspace" && !strings.HasPrefix(dir, "/workspace/") {
+		return "/workspace"
+	}
+	return dir
+}
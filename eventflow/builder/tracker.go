@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ============================================================================
+// Job Tracking
+// ============================================================================
+
+const (
+	// buildJobSelector selects the Jobs the worker creates for builds
+	buildJobSelector = "app=builder"
+
+	// imageRefAnnotation and sourceTypeLabel record on a build Job what the
+	// worker needs to report its outcome after a restart
+	imageRefAnnotation = "eventflow.io/image-ref"
+	sourceTypeLabel    = "source-type"
+
+	// stageLabel marks the Jobs that only list a build's source; they are
+	// not recovered, since a redelivered request runs its detection again
+	stageLabel  = "stage"
+	stageDetect = "detect"
+
+	// informerSyncTimeout bounds the initial listing of build Jobs
+	informerSyncTimeout = time.Minute
+)
+
+// errJobDeleted is returned when a build Job disappears while it runs
+var errJobDeleted = errors.New("build job was deleted")
+
+// jobTracker follows the worker's build Jobs through an informer, so waiting
+// builds are woken by Job changes instead of polling the API server
+type jobTracker struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	jobs      batchlisters.JobLister
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{} // by Job name
+}
+
+// newJobTracker starts the build Job informer and waits for its first listing
+func newJobTracker(clientset *kubernetes.Clientset, namespace string) (*jobTracker, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *meta.ListOptions) {
+			options.LabelSelector = buildJobSelector
+		}),
+	)
+	informer := factory.Batch().V1().Jobs()
+
+	t := &jobTracker{
+		clientset: clientset,
+		namespace: namespace,
+		jobs:      informer.Lister(),
+		waiters:   map[string][]chan struct{}{},
+	}
+	_, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    t.notify,
+		UpdateFunc: func(_, obj interface{}) { t.notify(obj) },
+		DeleteFunc: t.notify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch build jobs: %w", err)
+	}
+
+	factory.Start(context.Background().Done())
+
+	ctx, cancel := context.WithTimeout(context.Background(), informerSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("timed out listing build jobs")
+	}
+	return t, nil
+}
+
+// notify wakes the builds waiting for the Job an event is about
+func (t *jobTracker) notify(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	waiters := t.waiters[name]
+	delete(t.waiters, name)
+	t.mu.Unlock()
+
+	for _, changed := range waiters {
+		close(changed)
+	}
+}
+
+// changed returns a channel that is closed on the next event about a Job
+func (t *jobTracker) changed(name string) <-chan struct{} {
+	ch := make(chan struct{})
+	t.mu.Lock()
+	t.waiters[name] = append(t.waiters[name], ch)
+	t.mu.Unlock()
+	return ch
+}
+
+// waitForJobCompletion waits for a build Job to complete or fail. A Job
+// still running after timeout is deleted.
+func (t *jobTracker) waitForJobCompletion(ctx context.Context, jobName string, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		// Watch before looking, so a change in between is not missed
+		changed := t.changed(jobName)
+
+		job, err := t.jobs.Jobs(t.namespace).Get(jobName)
+		if apierrors.IsNotFound(err) {
+			// The informer may not have seen a Job that was just created
+			job, err = t.clientset.BatchV1().Jobs(t.namespace).Get(waitCtx, jobName, meta.GetOptions{})
+		}
+		if apierrors.IsNotFound(err) {
+			return errJobDeleted
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get job status: %w", err)
+		}
+
+		if finished, err := jobOutcome(job); finished {
+			return err
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() == nil {
+				deleteBuildJob(ctx, t.clientset, t.namespace, jobName)
+			}
+			return fmt.Errorf("timeout waiting for job to complete")
+		case <-changed:
+		}
+	}
+}
+
+// jobOutcome reports whether a build Job finished, and why it failed if it
+// did not succeed
+func jobOutcome(job *batchv1.Job) (bool, error) {
+	if job.Status.Succeeded > 0 {
+		log.Printf("Job %s completed successfully", job.Name)
+		return true, nil
+	}
+
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue && cond.Reason == "DeadlineExceeded" {
+			return true, fmt.Errorf("build timed out after %ds", *job.Spec.ActiveDeadlineSeconds)
+		}
+	}
+	if job.Status.Failed > 0 {
+		return true, fmt.Errorf("job %s failed", job.Name)
+	}
+	return false, nil
+}
+
+// ============================================================================
+// Crash Recovery
+// ============================================================================
+
+// recoverBuilds resumes the builds whose Jobs outlived an earlier worker: each
+// Job whose build has not reported an outcome is followed to its end, and
+// the outcome is published. A redelivered request for such a build waits for
+// the same Job; the API keeps only the first outcome.
+func recoverBuilds(js nats.JetStreamContext, tracker *jobTracker) {
+	jobs, err := tracker.jobs.Jobs(tracker.namespace).List(labels.Everything())
+	if err != nil {
+		log.Printf("Failed to list build jobs to recover: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		buildID := job.Labels["build-id"]
+		if buildID == "" || job.Labels[stageLabel] == stageDetect || buildReported(lastBuildEvent(js, buildID)) {
+			continue
+		}
+		log.Printf("Recovering build %s from job %s", buildID, job.Name)
+		go recoverBuild(js, tracker, job)
+	}
+}
+
+func recoverBuild(js nats.JetStreamContext, tracker *jobTracker, job *batchv1.Job) {
+	ctx := context.Background()
+	buildID := job.Labels["build-id"]
+	imageRef := job.Annotations[imageRefAnnotation]
+	strategy := job.Labels["strategy"]
+
+	timeout := maxBuildTimeout + deadlineGrace
+	if job.Spec.ActiveDeadlineSeconds != nil {
+		timeout = time.Duration(*job.Spec.ActiveDeadlineSeconds)*time.Second + deadlineGrace
+	}
+
+	digest, commit, err := jobResult(ctx, js, tracker, job.Name, buildID, job.Labels[sourceTypeLabel], imageRef, timeout)
+	if buildReported(lastBuildEvent(js, buildID)) {
+		return // A redelivered request got there first
+	}
+	if err := publishStatus(js, outcomeStatus(buildID, imageRef, strategy, digest, commit, err)); err != nil {
+		log.Printf("Failed to report recovered build %s: %v", buildID, err)
+	}
+}
+
+// lastBuildEvent returns the last status event published for a build, or ""
+// when none was
+func lastBuildEvent(js nats.JetStreamContext, buildID string) string {
+	msg, err := js.GetLastMsg(streamName, buildStatusSubject+buildID)
+	if err != nil {
+		if !errors.Is(err, nats.ErrMsgNotFound) {
+			log.Printf("Failed to read last status of %s: %v", buildID, err)
+		}
+		return ""
+	}
+	var status Status
+	if err := json.Unmarshal(msg.Data, &status); err != nil {
+		return ""
+	}
+	return status.Event
+}
+
+// buildReported reports whether a status event is an outcome
+func buildReported(event string) bool {
+	return event == "complete" || event == "failed" || event == "cancelled"
+}
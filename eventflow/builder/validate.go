@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ============================================================================
+// Request Validation
+// ============================================================================
+
+// Every field of a build request ends up in a Job spec, a git command line
+// or a container's environment. Requests are checked against these patterns
+// before anything is built, and fields are never interpolated into shell
+// scripts, so a request cannot run commands in the fetch or build containers.
+var (
+	buildIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	// A registry host with an optional port, then lowercase path components
+	repositoryPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]+)?(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)+$`)
+	imageTagPattern   = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+	// Kubernetes object names and namespaces
+	dnsSubdomainPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	dnsLabelPattern     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	// scp-like git locations: user@host:path
+	scpLikePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[A-Za-z0-9._~/-]+$`)
+
+	gitRefPattern  = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+	runtimePattern = regexp.MustCompile(`^[a-z0-9.+-]*$`)
+)
+
+// shellMetacharacters never occur in the URLs the API sends. They are
+// harmless where URLs reach commands through the environment, but a URL with
+// them is an attempt at injection rather than a source.
+const shellMetacharacters = "`$;|<>(){}'\"\\!*"
+
+// gitSchemes are the transports a git build may clone over. Others, such as
+// ext:: and file://, run commands or read the builder's own files.
+var gitSchemes = map[string]bool{"https": true, "http": true, "ssh": true, "git": true}
+
+// gitAllowProtocol limits the transports git itself uses, also for
+// submodules and redirects
+const gitAllowProtocol = "https:http:ssh:git"
+
+// validateBuildReq rejects a build request with a field that is malformed
+// or could be read as an option or a command
+func validateBuildReq(req BuildReq) error {
+	if !buildIDPattern.MatchString(req.BuildID) {
+		return fmt.Errorf("invalid build ID %q", req.BuildID)
+	}
+	if err := validateImageRef(req.ImageRef); err != nil {
+		return err
+	}
+	if req.CacheRef != "" && (len(req.CacheRef) > 255 || !repositoryPattern.MatchString(req.CacheRef)) {
+		return fmt.Errorf("invalid cache reference %q", req.CacheRef)
+	}
+	if req.Tenant != "" && (len(req.Tenant) > 63 || !dnsLabelPattern.MatchString(req.Tenant)) {
+		return fmt.Errorf("invalid tenant %q", req.Tenant)
+	}
+	if !runtimePattern.MatchString(req.Runtime) {
+		return fmt.Errorf("invalid runtime %q", req.Runtime)
+	}
+	if req.SourcePath != "" && req.SourcePath != "." && req.SourcePath != "./" {
+		if _, err := cleanSourcePath(req.SourcePath); err != nil {
+			return fmt.Errorf("invalid source path %q", req.SourcePath)
+		}
+	}
+	for _, name := range []string{req.GitAuthSecret, req.RegistrySecretName} {
+		if name != "" && (len(name) > 253 || !dnsSubdomainPattern.MatchString(name)) {
+			return fmt.Errorf("invalid secret name %q", name)
+		}
+	}
+
+	switch req.SourceType {
+	case "git":
+		if err := validateGitURL(req.Source); err != nil {
+			return err
+		}
+		if req.GitRef != "" {
+			return validateGitRef(req.GitRef)
+		}
+	case "tar":
+		return validateArchiveURL(req.Source)
+	case "code":
+	default:
+		return fmt.Errorf("unknown source type %q", req.SourceType)
+	}
+	return nil
+}
+
+// validateImageRef accepts registry/repository:tag references
+func validateImageRef(imageRef string) error {
+	name, tag, found := strings.Cut(imageRef, "@")
+	if found {
+		return fmt.Errorf("invalid image reference %q: must be tagged, not pinned", imageRef)
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	if len(imageRef) > 255 || !repositoryPattern.MatchString(name) || (tag != "" && !imageTagPattern.MatchString(tag)) {
+		return fmt.Errorf("invalid image reference %q", imageRef)
+	}
+	return nil
+}
+
+// validateGitURL accepts https, http, ssh and git URLs and scp-like
+// user@host:path locations
+func validateGitURL(source string) error {
+	if len(source) > 2048 || strings.HasPrefix(source, "-") || hasUnsafeChars(source) || strings.Contains(source, "&") {
+		return fmt.Errorf("invalid git URL %q", source)
+	}
+	if scpLikePattern.MatchString(source) && !strings.Contains(source, "::") {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || !gitSchemes[u.Scheme] || u.Host == "" || strings.HasPrefix(u.Host, "-") {
+		return fmt.Errorf("invalid git URL %q: must be an https, http, ssh or git URL, or user@host:path", source)
+	}
+	return nil
+}
+
+// validateGitRef accepts branch and tag names by the rules of
+// git check-ref-format
+func validateGitRef(ref string) error {
+	invalid := len(ref) > 255 ||
+		!gitRefPattern.MatchString(ref) ||
+		strings.HasPrefix(ref, "-") || strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, ".") ||
+		strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".") || strings.HasSuffix(ref, ".lock") ||
+		strings.Contains(ref, "..") || strings.Contains(ref, "//") || strings.Contains(ref, "/.")
+	if invalid {
+		return fmt.Errorf("invalid git ref %q", ref)
+	}
+	return nil
+}
+
+// validateArchiveURL accepts the http(s) URL an uploaded archive is served
+// from
+func validateArchiveURL(source string) error {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || hasUnsafeChars(source) {
+		return fmt.Errorf("invalid source URL %q", source)
+	}
+	return nil
+}
+
+// hasUnsafeChars reports whether a URL contains whitespace, control
+// characters or shell metacharacters
+func hasUnsafeChars(s string) bool {
+	for _, r := range s {
+		if r <= ' ' || r == 0x7f {
+			return true
+		}
+	}
+	return strings.ContainsAny(s, shellMetacharacters)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+)
+
+// ============================================================================
+// Domain Models
+// ============================================================================
+
+// Event mirrors the envelope published by the API's events.Publisher
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Function  string                 `json:"function"`
+	Image     string                 `json:"image"`
+	Command   []string               `json:"command"`
+	Payload   map[string]interface{} `json:"payload"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// Invocation is the payload of a function.invoke event
+type Invocation struct {
+	ID        string              `json:"invocation_id"`
+	Namespace string              `json:"namespace"`
+	Method    string              `json:"method"`
+	Query     string              `json:"query"`
+	Headers   map[string][]string `json:"headers"`
+	Body      string              `json:"body"` // Base64 encoded request body
+}
+
+// ============================================================================
+// Configuration Constants
+// ============================================================================
+
+const (
+	// Environment variable names for configuration
+	natsURLEnv     = "NATS_URL"
+	databaseURLEnv = "DATABASE_URL"
+	consumerEnv    = "DISPATCH_CONSUMER"    // Durable consumer name
+	concurrencyEnv = "DISPATCH_CONCURRENCY" // Invocations delivered in parallel
+	backoffEnv     = "DISPATCH_BACKOFF"     // Comma-separated retry delays, e.g. "1s,5s,30s"
+	maxAttemptsEnv = "DISPATCH_MAX_ATTEMPTS"
+	timeoutEnv     = "DISPATCH_TIMEOUT" // Per-attempt timeout for a function call
+
+	// JetStream stream and subject the API publishes to
+	streamName    = "EVENTFLOW"
+	eventsSubject = "eventflow.events"
+
+	// Event type handled by the dispatcher
+	eventTypeInvoke = "function.invoke"
+
+	// Default values
+	defaultNATSURL     = "nats://nats.eventflow.svc.cluster.local:4222"
+	defaultConsumer    = "dispatcher"
+	defaultConcurrency = 10
+	defaultBackoff     = "1s,5s,30s,2m"
+	defaultTimeout     = 30 * time.Second
+
+	// How long a pull request waits for new messages
+	fetchWait = 5 * time.Second
+
+	// Writes of an invocation's outcome are retried in-process, doubling the
+	// delay from recordBackoff, before the message is handed back
+	recordAttempts = 6
+	recordBackoff  = time.Second
+
+	// Deliveries beyond MaxAttempts, kept to record the outcome of an
+	// invocation whose last attempt could not be recorded
+	recordDeliveries = 3
+)
+
+// Config holds the dispatcher settings
+type Config struct {
+	NATSURL     string
+	DatabaseURL string
+	Consumer    string
+	Concurrency int
+	Backoff     []time.Duration
+	MaxAttempts int
+	Timeout     time.Duration
+}
+
+// ============================================================================
+// Main Application Entry Point
+// ============================================================================
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Connect to the invocations database
+	pool, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	// Connect to NATS messaging system
+	nc, err := nats.Connect(cfg.NATSURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS at %s: %v", cfg.NATSURL, err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Failed to get JetStream context: %v", err)
+	}
+
+	// Durable pull consumer: unacked invocations survive dispatcher restarts
+	sub, err := js.PullSubscribe(eventsSubject, cfg.Consumer,
+		nats.BindStream(streamName),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(cfg.Timeout+30*time.Second),
+		nats.MaxDeliver(cfg.MaxAttempts+recordDeliveries),
+	)
+	if err != nil {
+		log.Fatalf("Failed to create consumer %s: %v", cfg.Consumer, err)
+	}
+
+	d := &Dispatcher{
+		cfg:    cfg,
+		db:     pool,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+
+	log.Printf("Dispatcher consuming %s (stream %s, consumer %s, concurrency %d)",
+		eventsSubject, streamName, cfg.Consumer, cfg.Concurrency)
+	d.Run(ctx, sub)
+	log.Println("Dispatcher stopped")
+}
+
+// ============================================================================
+// Dispatching
+// ============================================================================
+
+// Dispatcher delivers queued invocations to function Services
+type Dispatcher struct {
+	cfg    *Config
+	db     *pgxpool.Pool
+	client *http.Client
+}
+
+// Run fetches messages until ctx is cancelled, then waits for in-flight deliveries
+func (d *Dispatcher) Run(ctx context.Context, sub *nats.Subscription) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, d.cfg.Concurrency)
+
+	for ctx.Err() == nil {
+		msgs, err := sub.Fetch(d.cfg.Concurrency, nats.MaxWait(fetchWait))
+		if err != nil && err != nats.ErrTimeout {
+			log.Printf("Failed to fetch messages: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, msg := range msgs {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(msg *nats.Msg) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				d.handleMessage(msg)
+			}(msg)
+		}
+	}
+
+	wg.Wait()
+}
+
+// handleMessage delivers one event and acks it only once the outcome is recorded
+func (d *Dispatcher) handleMessage(msg *nats.Msg) {
+	var event Event
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		log.Printf("Dropping malformed event: %v", err)
+		msg.Term()
+		return
+	}
+
+	// Other event types share the subject; they are not ours to deliver
+	if event.Type != eventTypeInvoke {
+		msg.Ack()
+		return
+	}
+
+	inv, err := decodeInvocation(event.Payload)
+	if err != nil {
+		log.Printf("Dropping invalid invocation event %s: %v", event.ID, err)
+		msg.Term()
+		return
+	}
+
+	attempt := 1
+	if meta, err := msg.Metadata(); err == nil {
+		attempt = int(meta.NumDelivered)
+	}
+
+	ctx := context.Background()
+
+	// A redelivered invocation may have finished already: its outcome was
+	// recorded but the ack was lost. It is not called again.
+	if attempt > 1 {
+		finished, err := d.finished(ctx, inv.ID)
+		if err != nil {
+			log.Printf("Failed to look up invocation %s: %v", inv.ID, err)
+		}
+		if finished {
+			msg.Ack()
+			return
+		}
+	}
+
+	// Every attempt was made; this delivery only records that it failed
+	if attempt > d.cfg.MaxAttempts {
+		errorMsg := fmt.Sprintf("failed after %d attempts", d.cfg.MaxAttempts)
+		if err := d.record(msg, func() error { return d.finish(ctx, inv.ID, "failed", errorMsg, 0) }); err != nil {
+			log.Printf("Failed to record invocation %s: %v", inv.ID, err)
+			msg.Nak()
+			return
+		}
+		msg.Term()
+		return
+	}
+
+	if err := d.markRunning(ctx, inv.ID); err != nil {
+		log.Printf("Failed to mark invocation %s running: %v", inv.ID, err)
+	}
+
+	start := time.Now()
+	status, err := d.deliver(ctx, event.Function, inv)
+	duration := time.Since(start)
+
+	if err == nil {
+		log.Printf("Invocation %s of %s/%s completed with %d in %s",
+			inv.ID, inv.Namespace, event.Function, status, duration)
+		if err := d.record(msg, func() error { return d.finish(ctx, inv.ID, "completed", "", duration) }); err != nil {
+			// The call is not repeated for the sake of its record
+			log.Printf("Error: invocation %s completed but could not be recorded, it stays running: %v", inv.ID, err)
+		}
+		msg.Ack()
+		return
+	}
+
+	if attempt < d.cfg.MaxAttempts {
+		delay := d.backoff(attempt)
+		log.Printf("Invocation %s attempt %d/%d failed, retrying in %s: %v",
+			inv.ID, attempt, d.cfg.MaxAttempts, delay, err)
+		if recordErr := d.recordAttemptError(ctx, inv.ID, err.Error()); recordErr != nil {
+			log.Printf("Failed to record attempt error for %s: %v", inv.ID, recordErr)
+		}
+		msg.NakWithDelay(delay)
+		return
+	}
+
+	log.Printf("Invocation %s failed after %d attempts: %v", inv.ID, attempt, err)
+	if recordErr := d.record(msg, func() error { return d.finish(ctx, inv.ID, "failed", err.Error(), duration) }); recordErr != nil {
+		// A delivery past MaxAttempts records the failure
+		log.Printf("Failed to record invocation %s: %v", inv.ID, recordErr)
+		msg.Nak()
+		return
+	}
+	msg.Term()
+}
+
+// deliver calls the function's Service and returns its status code. Transport
+// errors and 5xx responses are returned as errors so they are retried.
+func (d *Dispatcher) deliver(ctx context.Context, function string, inv *Invocation) (int, error) {
+	body, err := base64.StdEncoding.DecodeString(inv.Body)
+	if err != nil {
+		return 0, fmt.Errorf("invalid body encoding: %w", err)
+	}
+
+	method := inv.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	target := url.URL{
+		Scheme:   "http",
+		Host:     fmt.Sprintf("fn-%s.%s.svc.cluster.local", function, inv.Namespace),
+		Path:     "/",
+		RawQuery: inv.Query,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %w", err)
+	}
+	for key, values := range inv.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("X-Invocation-Id", inv.ID)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to call function: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return resp.StatusCode, fmt.Errorf("function returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record runs a write of an invocation's outcome, retrying it with a doubling
+// delay. The message is kept in progress meanwhile so it is not redelivered.
+func (d *Dispatcher) record(msg *nats.Msg, write func() error) error {
+	delay := recordBackoff
+	var err error
+	for i := 0; i < recordAttempts; i++ {
+		if i > 0 {
+			msg.InProgress()
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = write(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// backoff returns the delay before the next attempt
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	if attempt > len(d.cfg.Backoff) {
+		return d.cfg.Backoff[len(d.cfg.Backoff)-1]
+	}
+	return d.cfg.Backoff[attempt-1]
+}
+
+// ============================================================================
+// Invocation Persistence
+// ============================================================================
+
+// markRunning flags a pending invocation as picked up
+func (d *Dispatcher) markRunning(ctx context.Context, id string) error {
+	_, err := d.db.Exec(ctx, `
+		UPDATE invocations
+		SET status = 'running'
+		WHERE id::text = $1 AND status IN ('pending', 'running')
+	`, id)
+	return err
+}
+
+// finished reports whether an invocation already has its outcome recorded
+func (d *Dispatcher) finished(ctx context.Context, id string) (bool, error) {
+	var finished bool
+	err := d.db.QueryRow(ctx, `
+		SELECT COALESCE(bool_or(status IN ('completed', 'failed')), false)
+		FROM invocations
+		WHERE id::text = $1
+	`, id).Scan(&finished)
+	return finished, err
+}
+
+// recordAttemptError keeps the last delivery error visible while retrying
+func (d *Dispatcher) recordAttemptError(ctx context.Context, id, errorMsg string) error {
+	_, err := d.db.Exec(ctx, `
+		UPDATE invocations
+		SET error = $2
+		WHERE id::text = $1 AND status = 'running'
+	`, id, errorMsg)
+	return err
+}
+
+// finish stores the terminal status, error and duration of an invocation
+func (d *Dispatcher) finish(ctx context.Context, id, status, errorMsg string, duration time.Duration) error {
+	_, err := d.db.Exec(ctx, `
+		UPDATE invocations
+		SET status = $2, error = NULLIF($3, ''), duration_ms = $4, completed_at = NOW()
+		WHERE id::text = $1
+	`, id, status, errorMsg, duration.Milliseconds())
+	return err
+}
+
+// ============================================================================
+// Helper Functions
+// ============================================================================
+
+// decodeInvocation converts an event payload into an Invocation
+func decodeInvocation(payload map[string]interface{}) (*Invocation, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var inv Invocation
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, err
+	}
+	if inv.ID == "" || inv.Namespace == "" {
+		return nil, fmt.Errorf("invocation_id and namespace are required")
+	}
+	return &inv, nil
+}
+
+// loadConfig reads the dispatcher settings from the environment
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		NATSURL:     getEnvOrDefault(natsURLEnv, defaultNATSURL),
+		DatabaseURL: mustEnv(databaseURLEnv),
+		Consumer:    getEnvOrDefault(consumerEnv, defaultConsumer),
+		Concurrency: defaultConcurrency,
+		Timeout:     defaultTimeout,
+	}
+
+	if value := os.Getenv(concurrencyEnv); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%s must be a positive integer", concurrencyEnv)
+		}
+		cfg.Concurrency = n
+	}
+
+	if value := os.Getenv(timeoutEnv); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration", timeoutEnv)
+		}
+		cfg.Timeout = timeout
+	}
+
+	for _, part := range strings.Split(getEnvOrDefault(backoffEnv, defaultBackoff), ",") {
+		delay, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("%s contains an invalid duration %q", backoffEnv, part)
+		}
+		cfg.Backoff = append(cfg.Backoff, delay)
+	}
+
+	// One initial attempt plus one retry per backoff step by default
+	cfg.MaxAttempts = len(cfg.Backoff) + 1
+	if value := os.Getenv(maxAttemptsEnv); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%s must be a positive integer", maxAttemptsEnv)
+		}
+		cfg.MaxAttempts = n
+	}
+
+	return cfg, nil
+}
+
+// getEnvOrDefault returns the value of an environment variable or a default value
+func getEnvOrDefault(key, defaultValue string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultValue
+}
+
+// mustEnv returns the value of an environment variable or exits if not set
+func mustEnv(key string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		log.Fatalf("Required environment variable not set: %s", key)
+	}
+	return val
+}
@@ -19,21 +19,27 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	eventflowv1alpha1 "github.com/relhajja/eventflow/operator/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+// functionPort is the port every function container is expected to listen on
+const functionPort = 8080
+
 // FunctionReconciler reconciles a Function object
 type FunctionReconciler struct {
 	client.Client
@@ -44,6 +50,7 @@ type FunctionReconciler struct {
 // +kubebuilder:rbac:groups=eventflow.eventflow.io,resources=functions/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=eventflow.eventflow.io,resources=functions/finalizers,verbs=update
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -102,7 +109,13 @@ func (r *FunctionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return ctrl.Result{}, err
 	}
 
-	// 4. Deployment exists, check if update needed
+	// 4. Ensure the Service that fronts the function pods exists
+	if err := r.reconcileService(ctx, function); err != nil {
+		logger.Error(err, "Failed to reconcile Service for Function", "function", function.Name)
+		return ctrl.Result{}, err
+	}
+
+	// 5. Deployment exists, check if update needed
 	needsUpdate := false
 
 	// Get desired replicas (default to 1 if not set)
@@ -117,14 +130,40 @@ func (r *FunctionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		needsUpdate = true
 	}
 
-	// Check if image changed
+	// Check if the pod template drifted from the Function spec
+	// (image, env, command, args or resources changed)
+	desired, err := r.buildDeployment(function)
+	if err != nil {
+		logger.Error(err, "Failed to build Deployment for Function", "function", function.Name)
+		return ctrl.Result{}, err
+	}
 	if len(deployment.Spec.Template.Spec.Containers) > 0 {
-		if deployment.Spec.Template.Spec.Containers[0].Image != function.Spec.Image {
-			deployment.Spec.Template.Spec.Containers[0].Image = function.Spec.Image
+		current := &deployment.Spec.Template.Spec.Containers[0]
+		want := desired.Spec.Template.Spec.Containers[0]
+		if current.Image != want.Image ||
+			!equality.Semantic.DeepEqual(current.Env, want.Env) ||
+			!equality.Semantic.DeepEqual(current.Command, want.Command) ||
+			!equality.Semantic.DeepEqual(current.Args, want.Args) ||
+			!equality.Semantic.DeepEqual(current.Resources, want.Resources) ||
+			!equality.Semantic.DeepEqual(current.Ports, want.Ports) {
+			current.Image = want.Image
+			current.Env = want.Env
+			current.Command = want.Command
+			current.Args = want.Args
+			current.Resources = want.Resources
+			current.Ports = want.Ports
 			needsUpdate = true
 		}
 	}
 
+	// Check if the Function's labels changed
+	if !equality.Semantic.DeepEqual(deployment.Labels, desired.Labels) ||
+		!equality.Semantic.DeepEqual(deployment.Spec.Template.Labels, desired.Spec.Template.Labels) {
+		deployment.Labels = desired.Labels
+		deployment.Spec.Template.Labels = desired.Spec.Template.Labels
+		needsUpdate = true
+	}
+
 	if needsUpdate {
 		logger.Info("Updating Deployment for Function", "deployment", deployment.Name)
 		if err := r.Update(ctx, deployment); err != nil {
@@ -133,7 +172,7 @@ func (r *FunctionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
-	// 5. Update Function status with Deployment info
+	// 6. Update Function status with Deployment info
 	function.Status.Replicas = deployment.Status.Replicas
 	function.Status.AvailableReplicas = deployment.Status.AvailableReplicas
 
@@ -179,23 +218,92 @@ func (r *FunctionReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&eventflowv1alpha1.Function{}).
 		Owns(&appsv1.Deployment{}). // Watch Deployments owned by Functions
+		Owns(&corev1.Service{}).    // Watch Services owned by Functions
 		Named("function").
 		Complete(r)
 }
 
+// reconcileService creates the fn-{name} Service used to invoke the function
+func (r *FunctionReconciler) reconcileService(ctx context.Context, function *eventflowv1alpha1.Function) error {
+	service := &corev1.Service{}
+	serviceName := fmt.Sprintf("fn-%s", function.Name)
+	err := r.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: function.Namespace}, service)
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+
+	service = r.buildService(function)
+	if err := controllerutil.SetControllerReference(function, service, r.Scheme); err != nil {
+		return err
+	}
+
+	logf.FromContext(ctx).Info("Creating a new Service", "Service.Namespace", service.Namespace, "Service.Name", service.Name)
+	if err := r.Create(ctx, service); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// buildService creates a ClusterIP Service spec that targets the function pods
+func (r *FunctionReconciler) buildService(function *eventflowv1alpha1.Function) *corev1.Service {
+	labels := map[string]string{
+		"app":      "eventflow-function",
+		"function": function.Name,
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("fn-%s", function.Name),
+			Namespace: function.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Port:       80,
+					TargetPort: intstr.FromString("http"),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
 // buildDeployment creates a Deployment spec from a Function CR
 func (r *FunctionReconciler) buildDeployment(function *eventflowv1alpha1.Function) (*appsv1.Deployment, error) {
-	labels := map[string]string{
+	selectorLabels := map[string]string{
 		"app":      "eventflow-function",
 		"function": function.Name,
 	}
 
-	// Build environment variables
+	// Copy the Function's labels onto the Deployment and pods; the selector
+	// labels win so user labels can never detach the pods from the Service
+	labels := make(map[string]string, len(function.Labels)+len(selectorLabels))
+	for key, value := range function.Labels {
+		labels[key] = value
+	}
+	for key, value := range selectorLabels {
+		labels[key] = value
+	}
+
+	// Build environment variables (sorted so the pod template is stable)
+	envKeys := make([]string, 0, len(function.Spec.Env))
+	for key := range function.Spec.Env {
+		envKeys = append(envKeys, key)
+	}
+	sort.Strings(envKeys)
+
 	var envVars []corev1.EnvVar
-	for key, value := range function.Spec.Env {
+	for _, key := range envKeys {
 		envVars = append(envVars, corev1.EnvVar{
 			Name:  key,
-			Value: value,
+			Value: function.Spec.Env[key],
 		})
 	}
 
@@ -205,6 +313,13 @@ func (r *FunctionReconciler) buildDeployment(function *eventflowv1alpha1.Functio
 		Image:           function.Spec.Image,
 		ImagePullPolicy: corev1.PullIfNotPresent, // For kind clusters
 		Env:             envVars,
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "http",
+				ContainerPort: functionPort,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
 	}
 
 	// Add command if specified
@@ -231,9 +346,27 @@ func (r *FunctionReconciler) buildDeployment(function *eventflowv1alpha1.Functio
 	}
 
 	// Override with custom resources if specified
-	if function.Spec.Resources != nil {
-		// Note: For simplicity, we're not parsing the resource strings yet
-		// In production, you'd parse strings like "100m" and "128Mi" from function.Spec.Resources
+	if res := function.Spec.Resources; res != nil {
+		overrides := []struct {
+			list  corev1.ResourceList
+			name  corev1.ResourceName
+			value string
+		}{
+			{container.Resources.Requests, corev1.ResourceCPU, res.CPURequest},
+			{container.Resources.Requests, corev1.ResourceMemory, res.MemoryRequest},
+			{container.Resources.Limits, corev1.ResourceCPU, res.CPULimit},
+			{container.Resources.Limits, corev1.ResourceMemory, res.MemoryLimit},
+		}
+		for _, o := range overrides {
+			if o.value == "" {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(o.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s quantity %q: %w", o.name, o.value, err)
+			}
+			o.list[o.name] = quantity
+		}
 	}
 
 	// Get desired replicas (default to 1 if not set)
@@ -251,7 +384,7 @@ func (r *FunctionReconciler) buildDeployment(function *eventflowv1alpha1.Functio
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &replicas,
 			Selector: &metav1.LabelSelector{
-				MatchLabels: labels,
+				MatchLabels: selectorLabels,
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
@@ -1,17 +1,29 @@
-import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query'
+import { useState } from 'react'
+import { useQuery, useMutation, useQueryClient, keepPreviousData } from '@tanstack/react-query'
 import { useNavigate } from 'react-router-dom'
 import { functionsApi } from '@/services/api'
-import { Plus, Play, Trash2, AlertCircle, Server } from 'lucide-react'
+import { Plus, Play, Trash2, AlertCircle, Server, ChevronLeft, ChevronRight } from 'lucide-react'
+
+// Functions shown per page
+const pageSize = 24
 
 export default function Dashboard() {
   const navigate = useNavigate()
   const queryClient = useQueryClient()
 
-  const { data: functions, isLoading, error } = useQuery({
-    queryKey: ['functions'],
-    queryFn: functionsApi.list,
+  // Tokens of the pages visited so far; the last one is shown
+  const [pageTokens, setPageTokens] = useState<(string | undefined)[]>([undefined])
+  const pageToken = pageTokens[pageTokens.length - 1]
+
+  const { data, isLoading, error } = useQuery({
+    queryKey: ['functions', pageToken],
+    queryFn: () => functionsApi.list(pageSize, pageToken),
+    placeholderData: keepPreviousData,
     refetchInterval: 5000, // Auto-refresh every 5 seconds
   })
+  const functions = data?.functions
+  const total = data?.total_count ?? 0
+  const firstShown = (pageTokens.length - 1) * pageSize + 1
 
   const deleteMutation = useMutation({
     mutationFn: functionsApi.delete,
@@ -75,7 +87,7 @@ export default function Dashboard() {
         <div>
           <h2 className="text-3xl font-bold text-white">Functions</h2>
           <p className="text-slate-400 mt-1">
-            {functions?.length || 0} function{functions?.length !== 1 ? 's' : ''} deployed
+            {total} function{total !== 1 ? 's' : ''} deployed
           </p>
         </div>
         <button
@@ -137,6 +149,8 @@ export default function Dashboard() {
             </div>
           ))}
         </div>
+      ) : pageTokens.length > 1 ? (
+        <div className="text-center py-12 text-slate-400">No more functions</div>
       ) : (
         <div className="text-center py-12 bg-slate-800 rounded-lg border border-slate-700">
           <Server className="w-16 h-16 text-slate-600 mx-auto mb-4" />
@@ -151,6 +165,35 @@ export default function Dashboard() {
           </button>
         </div>
       )}
+
+      {/* Pagination */}
+      {(pageTokens.length > 1 || data?.next_page_token) && (
+        <div className="flex items-center justify-between">
+          <span className="text-sm text-slate-400">
+            {functions && functions.length > 0
+              ? `${firstShown}-${firstShown + functions.length - 1} of ${total}`
+              : `${total} total`}
+          </span>
+          <div className="flex space-x-2">
+            <button
+              onClick={() => setPageTokens(pageTokens.slice(0, -1))}
+              disabled={pageTokens.length === 1}
+              className="flex items-center space-x-1 px-3 py-2 bg-slate-800 hover:bg-slate-700 disabled:opacity-50 text-white text-sm rounded transition"
+            >
+              <ChevronLeft className="w-4 h-4" />
+              <span>Previous</span>
+            </button>
+            <button
+              onClick={() => data?.next_page_token && setPageTokens([...pageTokens, data.next_page_token])}
+              disabled={!data?.next_page_token}
+              className="flex items-center space-x-1 px-3 py-2 bg-slate-800 hover:bg-slate-700 disabled:opacity-50 text-white text-sm rounded transition"
+            >
+              <span>Next</span>
+              <ChevronRight className="w-4 h-4" />
+            </button>
+          </div>
+        </div>
+      )}
     </div>
   )
 }
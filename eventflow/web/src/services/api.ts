@@ -1,5 +1,5 @@
 import axios from 'axios'
-import type { FunctionStatus, CreateFunctionRequest, AuthToken } from '@/types'
+import type { FunctionStatus, FunctionList, CreateFunctionRequest, AuthToken } from '@/types'
 
 const api = axios.create({
   baseURL: import.meta.env.VITE_API_URL || '',
@@ -26,8 +26,10 @@ export const authApi = {
 }
 
 export const functionsApi = {
-  list: async (): Promise<FunctionStatus[]> => {
-    const { data } = await api.get<FunctionStatus[]>('/v1/functions')
+  list: async (limit: number, pageToken?: string): Promise<FunctionList> => {
+    const { data } = await api.get<FunctionList>('/v1/functions', {
+      params: { limit, page_token: pageToken },
+    })
     return data
   },
 
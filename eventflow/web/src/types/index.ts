@@ -7,9 +7,18 @@ export interface FunctionStatus {
   ready_replicas: number
   updated_replicas: number
   status: 'Running' | 'Pending' | 'Failed'
+  labels?: Record<string, string>
+  annotations?: Record<string, string>
+  description?: string
   created_at: string
 }
 
+export interface FunctionList {
+  functions: FunctionStatus[]
+  next_page_token?: string
+  total_count: number
+}
+
 export interface GitConfig {
   url: string
   branch?: string
@@ -22,10 +31,16 @@ export interface CreateFunctionRequest {
   image?: string
   runtime?: string
   source_code?: string
+  source_files?: Record<string, string>
+  source_archive?: string
   git_config?: GitConfig
+  build_strategy?: 'auto' | 'cnb' | 'pack' | 'kaniko' | 'buildkit'
   command?: string[]
   env?: Record<string, string>
   replicas: number
+  labels?: Record<string, string>
+  annotations?: Record<string, string>
+  description?: string
 }
 
 export interface AuthToken {
@@ -26,6 +26,13 @@ docker build -t eventflow-operator:latest .
 echo "✅ Operator image built"
 echo ""
 
+# Build Dispatcher
+echo "Building EventFlow Dispatcher..."
+cd "$PROJECT_ROOT/eventflow/dispatcher"
+docker build -t eventflow-dispatcher:latest .
+echo "✅ Dispatcher image built"
+echo ""
+
 # Build Web UI
 echo "Building EventFlow Web UI..."
 cd "$PROJECT_ROOT/eventflow/web"
@@ -43,6 +50,9 @@ docker save eventflow-api:latest | sudo k3s ctr images import -
 echo "Importing eventflow-operator..."
 docker save eventflow-operator:latest | sudo k3s ctr images import -
 
+echo "Importing eventflow-dispatcher..."
+docker save eventflow-dispatcher:latest | sudo k3s ctr images import -
+
 echo "Importing eventflow-web..."
 docker save eventflow-web:latest | sudo k3s ctr images import -
 